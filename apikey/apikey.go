@@ -0,0 +1,209 @@
+package apikey
+
+import (
+	"chatservice/atomicfile"
+	"chatservice/locale"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// What a key may do. Admin keys may do everything
+const (
+	ScopeSend     = "send"      // Send messages and use channels
+	ScopeReadLogs = "read-logs" // Read the log, message history and message streams
+	ScopeStats    = "stats"     // Read stats and list channels and users
+	ScopeAdmin    = "admin"     // Bans, closing channels and removing users
+)
+
+var Scopes = []string{ScopeSend, ScopeReadLogs, ScopeStats, ScopeAdmin}
+
+// An api key. Only a hash of the key is kept
+type Key struct {
+	Name    string    `json:"name"`
+	Hash    string    `json:"hash"`
+	Scopes  []string  `json:"scopes"`
+	Created time.Time `json:"created"`
+	By      string    `json:"by,omitempty"`
+	Config  bool      `json:"-"` // Set in the config instead of the key file. Can not be removed
+}
+
+var keys = []Key{}   // Keys added with Add
+var static = []Key{} // Keys from the config
+var keyFile string
+var mu sync.Mutex
+
+var ErrNotFound = locale.Errorf("api key does not exist") // Returned when removing a key that does not exist
+
+// Loads keys from a json file. Keys added later are saved to the same file
+func Load(filepath string) error {
+	loaded := []Key{}
+	contents, err := os.ReadFile(filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 {
+		err = json.Unmarshal(contents, &loaded)
+		if err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	keys = loaded
+	keyFile = filepath
+	log.Printf("loaded %d api keys", len(loaded))
+	return nil
+}
+
+// Replaces the keys set in the config. Each entry is "name:key:scope+scope"
+func SetStatic(entries []string) error {
+	loaded := []Key{}
+	for _, entry := range entries {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" {
+			return locale.Errorf("api keys must look like name:key:scope+scope")
+		}
+		scopes := strings.Split(parts[2], "+")
+		err := checkScopes(scopes)
+		if err != nil {
+			return err
+		}
+		loaded = append(loaded, Key{Name: parts[0], Hash: hash(parts[1]), Scopes: scopes, Config: true})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	static = loaded
+	return nil
+}
+
+// Writes the keys to the key file if there is one. mu must be held
+func save() error {
+	if keyFile == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(keys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(keyFile, contents, 0600)
+}
+
+// Checks that every scope is known
+func checkScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return locale.Errorf("api key needs at least one scope")
+	}
+	for _, scope := range scopes {
+		known := false
+		for _, s := range Scopes {
+			known = known || s == scope
+		}
+		if !known {
+			return locale.Errorf("unknown scope: %s. scopes are %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
+
+// Hashes a key for storing
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a key and returns it. The key can not be shown again
+func Add(name string, scopes []string, by string) (string, error) {
+	if name == "" || strings.ContainsAny(name, " :") {
+		return "", locale.Errorf("api key name can not be empty or contain spaces or ':'")
+	}
+	err := checkScopes(scopes)
+	if err != nil {
+		return "", err
+	}
+	random := make([]byte, 24)
+	_, err = rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	secret := hex.EncodeToString(random)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, k := range all() {
+		if k.Name == name {
+			return "", locale.Errorf("api key already exists")
+		}
+	}
+	keys = append(keys, Key{Name: name, Hash: hash(secret), Scopes: scopes, Created: time.Now().UTC(), By: by})
+	err = save()
+	if err != nil {
+		keys = keys[:len(keys)-1]
+		return "", err
+	}
+	log.Printf("api key: %s added by: %s. scopes: %s", name, by, strings.Join(scopes, ","))
+	return secret, nil
+}
+
+// Removes a key by its name
+func Remove(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, k := range static {
+		if k.Name == name {
+			return locale.Errorf("api key is set in the config")
+		}
+	}
+	for i, k := range keys {
+		if k.Name == name {
+			keys = append(keys[:i], keys[i+1:]...)
+			log.Printf("api key removed: %s", name)
+			return save()
+		}
+	}
+	return ErrNotFound
+}
+
+// Returns all keys, config keys first
+func List() []Key {
+	mu.Lock()
+	defer mu.Unlock()
+	return all()
+}
+
+// Returns a copy of all keys. mu must be held
+func all() []Key {
+	return append(append([]Key{}, static...), keys...)
+}
+
+// Finds the key matching a secret
+func Check(secret string) (Key, bool) {
+	if secret == "" {
+		return Key{}, false
+	}
+	h := []byte(hash(secret))
+	mu.Lock()
+	defer mu.Unlock()
+	for _, k := range all() {
+		if subtle.ConstantTimeCompare(h, []byte(k.Hash)) == 1 {
+			return k, true
+		}
+	}
+	return Key{}, false
+}
+
+// Checks if a key has a scope. Admin keys have every scope
+func (k Key) Allows(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
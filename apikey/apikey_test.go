@@ -0,0 +1,77 @@
+package apikey
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	require.NoError(t, Load(path))
+	defer Load("")
+	require.NoError(t, SetStatic([]string{"ci:s3cret:send+stats"}))
+	defer SetStatic(nil)
+
+	_, err := Add("bot", []string{"fly"}, "tester")
+	assert.EqualError(t, err, "unknown scope: fly. scopes are send, read-logs, stats, admin")
+	_, err = Add("bad name", []string{ScopeSend}, "tester")
+	assert.Error(t, err)
+	_, err = Add("ci", []string{ScopeSend}, "tester")
+	assert.EqualError(t, err, "api key already exists")
+
+	secret, err := Add("reader", []string{ScopeReadLogs}, "tester")
+	require.NoError(t, err)
+	admin, err := Add("root", []string{ScopeAdmin}, "tester")
+	require.NoError(t, err)
+
+	tests := []struct {
+		secret string
+		name   string
+		scope  string
+		allow  bool
+	}{
+		{"s3cret", "ci", ScopeSend, true},
+		{"s3cret", "ci", ScopeStats, true},
+		{"s3cret", "ci", ScopeReadLogs, false},
+		{secret, "reader", ScopeReadLogs, true},
+		{secret, "reader", ScopeSend, false},
+		{admin, "root", ScopeStats, true},
+	}
+	for _, tt := range tests {
+		k, ok := Check(tt.secret)
+		require.True(t, ok, tt.name)
+		assert.Equal(t, tt.name, k.Name)
+		assert.Equal(t, tt.allow, k.Allows(tt.scope), tt.name+" "+tt.scope)
+	}
+	_, ok := Check("wrong")
+	assert.False(t, ok)
+	_, ok = Check("")
+	assert.False(t, ok)
+
+	//Keys are saved hashed and survive a reload
+	require.NoError(t, Load(path))
+	_, ok = Check(secret)
+	assert.True(t, ok)
+	for _, k := range List() {
+		assert.NotEqual(t, secret, k.Hash)
+	}
+
+	assert.EqualError(t, Remove("ci"), "api key is set in the config")
+	assert.NoError(t, Remove("reader"))
+	assert.Equal(t, ErrNotFound, Remove("reader"))
+	_, ok = Check(secret)
+	assert.False(t, ok)
+	assert.Len(t, List(), 2)
+}
+
+func TestSetStatic(t *testing.T) {
+	defer SetStatic(nil)
+	assert.EqualError(t, SetStatic([]string{"nokey"}), "api keys must look like name:key:scope+scope")
+	assert.EqualError(t, SetStatic([]string{"a::send"}), "api keys must look like name:key:scope+scope")
+	assert.EqualError(t, SetStatic([]string{"a:b:send+fly"}), "unknown scope: fly. scopes are send, read-logs, stats, admin")
+	assert.NoError(t, SetStatic([]string{"a:b:send", "c:d:admin"}))
+	assert.Len(t, List(), 2)
+}
@@ -0,0 +1,54 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// Replaces a file so a crash or a concurrent reader never sees it half written. The
+// contents go to a new temporary file in the same directory, which is synced and then
+// renamed over the file. The temporary file is removed if anything fails
+func Write(path string, contents []byte, perm os.FileMode) (err error) {
+	dir, name := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, name+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(contents); err != nil {
+		return err
+	}
+	if err = f.Chmod(perm); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(f.Name(), path); err != nil {
+		return err
+	}
+	syncDir(dir)
+	return nil
+}
+
+// Syncs a directory so a rename in it survives a crash. Not every platform can open
+// a directory for this, so failures are ignored
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
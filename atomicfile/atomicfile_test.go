@@ -0,0 +1,39 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWrite(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.json")
+
+	assert.NoError(t, Write(path, []byte("first"), 0600))
+	assert.NoError(t, Write(path, []byte("second"), 0600))
+	contents, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "second", string(contents))
+	info, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	//A leftover temp file from an older version does not get in the way
+	assert.NoError(t, os.WriteFile(path+".tmp", []byte("stale"), 0600))
+	assert.NoError(t, Write(path, []byte("third"), 0600))
+	entries, err := os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+
+	//Nothing is left behind when the file can not be replaced
+	assert.Error(t, Write(filepath.Join(dir, "missing", "data.json"), []byte("lost"), 0600))
+	assert.NoError(t, os.Mkdir(filepath.Join(dir, "taken"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "taken", "file"), nil, 0600))
+	assert.Error(t, Write(filepath.Join(dir, "taken"), []byte("lost"), 0600))
+	entries, err = os.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 3)
+}
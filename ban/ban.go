@@ -0,0 +1,182 @@
+package ban
+
+import (
+	"chatservice/atomicfile"
+	"chatservice/locale"
+	"encoding/json"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A banned ip address or network
+type Ban struct {
+	Network string    `json:"network"` // CIDR, single ips are stored as /32 or /128
+	Reason  string    `json:"reason,omitempty"`
+	By      string    `json:"by,omitempty"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitempty"` // Zero means the ban never expires
+}
+
+var bans = []Ban{}
+var banFile string
+var mu sync.Mutex
+
+var ErrNotFound = locale.Errorf("ban does not exist") // Returned when removing a ban that does not exist
+
+// Loads bans from a json file. Changes to the ban list are saved to the same file
+func Load(filepath string) error {
+	loaded := []Ban{}
+	contents, err := os.ReadFile(filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 {
+		err = json.Unmarshal(contents, &loaded)
+		if err != nil {
+			return err
+		}
+	}
+	for _, b := range loaded {
+		_, _, err = net.ParseCIDR(b.Network)
+		if err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	bans = loaded
+	banFile = filepath
+	log.Printf("loaded %d bans", len(loaded))
+	return nil
+}
+
+// Writes the ban list to the ban file if there is one. mu must be held
+func save() error {
+	if banFile == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(bans, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(banFile, contents, 0600)
+}
+
+// Turns an ip or CIDR into a CIDR
+func normalize(target string) (string, error) {
+	target = strings.TrimSpace(target)
+	if strings.Contains(target, "/") {
+		_, network, err := net.ParseCIDR(target)
+		if err != nil {
+			return "", locale.Errorf("invalid ip or network: %s", target)
+		}
+		return network.String(), nil
+	}
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return "", locale.Errorf("invalid ip or network: %s", target)
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", nil
+	}
+	return ip.String() + "/128", nil
+}
+
+// Bans an ip or CIDR. A duration of 0 bans forever
+func Add(target string, duration time.Duration, reason string, by string) (Ban, error) {
+	network, err := normalize(target)
+	if err != nil {
+		return Ban{}, err
+	}
+	b := Ban{
+		Network: network,
+		Reason:  reason,
+		By:      by,
+		Created: time.Now().UTC(),
+	}
+	if duration > 0 {
+		b.Expires = b.Created.Add(duration)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	//Replace an existing ban on the same network
+	for i, existing := range bans {
+		if existing.Network == network {
+			bans = append(bans[:i], bans[i+1:]...)
+			break
+		}
+	}
+	bans = append(bans, b)
+	err = save()
+	if err != nil {
+		return Ban{}, err
+	}
+	log.Printf("banned: %s by: %s. reason: %s. expires: %v", network, by, reason, b.Expires)
+	return b, nil
+}
+
+// Removes the ban on an ip or CIDR
+func Remove(target string) error {
+	network, err := normalize(target)
+	if err != nil {
+		return err
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for i, b := range bans {
+		if b.Network == network {
+			bans = append(bans[:i], bans[i+1:]...)
+			log.Printf("unbanned: %s", network)
+			return save()
+		}
+	}
+	return ErrNotFound
+}
+
+// Returns all bans that have not expired
+func List() []Ban {
+	mu.Lock()
+	defer mu.Unlock()
+	pruneExpired()
+	return append([]Ban{}, bans...)
+}
+
+// Checks if an ip is covered by a ban that has not expired
+func IsBanned(ip string) (Ban, bool) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return Ban{}, false
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	pruneExpired()
+	for _, b := range bans {
+		_, network, err := net.ParseCIDR(b.Network)
+		if err == nil && network.Contains(parsed) {
+			return b, true
+		}
+	}
+	return Ban{}, false
+}
+
+// Drops expired bans. mu must be held
+func pruneExpired() {
+	now := time.Now()
+	kept := bans[:0]
+	for _, b := range bans {
+		if b.Expires.IsZero() || b.Expires.After(now) {
+			kept = append(kept, b)
+		}
+	}
+	if len(kept) != len(bans) {
+		bans = kept
+		err := save()
+		if err != nil {
+			log.Printf("unable to save bans. err: %s", err)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package ban
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.json")
+	assert.NoError(t, Load(path))
+
+	_, err := Add("not an ip", 0, "", "tester")
+	assert.EqualError(t, err, "invalid ip or network: not an ip")
+
+	//Single ips and networks
+	_, err = Add("10.1.2.3", 0, "spam", "tester")
+	assert.NoError(t, err)
+	_, err = Add("192.168.0.0/16", 0, "", "tester")
+	assert.NoError(t, err)
+	_, err = Add("2001:db8::1", 0, "", "tester")
+	assert.NoError(t, err)
+
+	tests := []struct {
+		ip     string
+		banned bool
+	}{
+		{"10.1.2.3", true},
+		{"10.1.2.4", false},
+		{"192.168.44.1", true},
+		{"2001:db8::1", true},
+		{"2001:db8::2", false},
+		{"garbage", false},
+	}
+	for _, tt := range tests {
+		_, banned := IsBanned(tt.ip)
+		assert.Equal(t, tt.banned, banned, tt.ip)
+	}
+
+	//Bans are persisted
+	assert.NoError(t, Load(path))
+	b, banned := IsBanned("10.1.2.3")
+	assert.True(t, banned)
+	assert.Equal(t, "10.1.2.3/32", b.Network)
+	assert.Equal(t, "spam", b.Reason)
+
+	//Removing
+	assert.NoError(t, Remove("10.1.2.3"))
+	_, banned = IsBanned("10.1.2.3")
+	assert.False(t, banned)
+	assert.EqualError(t, Remove("10.1.2.3"), "ban does not exist")
+	assert.Len(t, List(), 2)
+}
+
+func TestBanExpiry(t *testing.T) {
+	assert.NoError(t, Load(filepath.Join(t.TempDir(), "bans.json")))
+	_, err := Add("172.16.0.1", time.Second/10, "", "tester")
+	assert.NoError(t, err)
+	_, banned := IsBanned("172.16.0.1")
+	assert.True(t, banned)
+
+	time.Sleep(time.Second / 5)
+	_, banned = IsBanned("172.16.0.1")
+	assert.False(t, banned)
+	assert.Empty(t, List())
+}
@@ -3,23 +3,72 @@ package config
 import (
 	"errors"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
 
 type Config struct {
-	TelNetIp   string
-	TelNetPort string
-	HttpIp     string
-	HttpPort   string
-	LogFile    string
+	TelNetIp     string
+	TelNetPort   string
+	HttpIp       string
+	HttpPort     string
+	LogFile      string
+	PluginFile   string
+	HistoryFile  string
+	AccountsFile string
+	MailboxFile  string
+	MailboxLimit int
+	BanFile      string
+	PrefsFile    string
+	AuditLog     string
+	Admins       []string
+	LocaleDir    string // Directory of translation files
+	DefaultLang  string // Language used for users that have not picked one
+
+	APIKeyFile    string   // Where api keys added with /admin apikey are saved
+	APIKeys       []string // Api keys set in the config, "name:key:scope+scope"
+	RequireAPIKey bool     // Refuse http requests without an api key even when no keys are set
+
+	WebhookFile string // Json list of outgoing webhooks
+	WebhookLog  string // File webhook deliveries are recorded to. Empty records them to the main log
+
+	IncomingHookFile string   // Where incoming webhooks added with /admin hook are saved
+	IncomingHooks    []string // Incoming webhooks set in the config, "name:channel:token"
+
+	UsernameMinLength int
+	UsernameMaxLength int
+	ChannelMinLength  int
+	ChannelMaxLength  int
+	NameCharset       string   // "unicode" allows letters of any alphabet, "ascii" only a-z and 0-9
+	ReservedNames     []string // Names nobody can use for a user or channel
+
+	LoginTimeout      time.Duration
+	IdleTimeout       time.Duration
+	KeepAliveInterval time.Duration
+	SessionTimeout    time.Duration // How long an http session lasts without requests
+
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	MaxPendingLogins    int
 }
 
 func LoadConfig(filepath string) (Config, error) {
+	return loadConfig(filepath, godotenv.Load)
+}
+
+// Loads the config again, letting values in the file replace ones already loaded
+func ReloadConfig(filepath string) (Config, error) {
+	return loadConfig(filepath, godotenv.Overload)
+}
+
+func loadConfig(filepath string, load func(...string) error) (Config, error) {
 	//Load file
-	err := godotenv.Load(filepath)
+	err := load(filepath)
 	if err != nil {
-		return Config{}, nil
+		return Config{}, err
 	}
 
 	//Get values
@@ -47,12 +96,187 @@ func LoadConfig(filepath string) (Config, error) {
 	if logFile == "" {
 		return Config{}, errors.New("LOG_FILE missing")
 	}
+	//Optional values
+	pluginFile := os.Getenv("PLUGIN_FILE")
+	historyFile := os.Getenv("HISTORY_FILE")
+	accountsFile := os.Getenv("ACCOUNTS_FILE")
+	mailboxFile := os.Getenv("MAILBOX_FILE")
+	banFile := os.Getenv("BAN_FILE")
+	prefsFile := os.Getenv("PREFS_FILE")
+	auditLog := os.Getenv("AUDIT_LOG")
+	localeDir := os.Getenv("LOCALE_DIR")
+	defaultLang := os.Getenv("DEFAULT_LANG")
+	apiKeyFile := os.Getenv("API_KEY_FILE")
+	apiKeys := []string{}
+	for _, key := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		if key = strings.TrimSpace(key); key != "" {
+			apiKeys = append(apiKeys, key)
+		}
+	}
+	webhookFile := os.Getenv("WEBHOOK_FILE")
+	webhookLog := os.Getenv("WEBHOOK_LOG")
+	incomingHookFile := os.Getenv("INCOMING_HOOK_FILE")
+	incomingHooks := []string{}
+	for _, hook := range strings.Split(os.Getenv("INCOMING_HOOKS"), ",") {
+		if hook = strings.TrimSpace(hook); hook != "" {
+			incomingHooks = append(incomingHooks, hook)
+		}
+	}
+	requireAPIKey, err := boolOrDefault("REQUIRE_API_KEY", false)
+	if err != nil {
+		return Config{}, err
+	}
+	admins := []string{}
+	for _, admin := range strings.Split(os.Getenv("ADMINS"), ",") {
+		if admin = strings.TrimSpace(admin); admin != "" {
+			admins = append(admins, admin)
+		}
+	}
+	reservedNames := []string{}
+	for _, name := range strings.Split(os.Getenv("RESERVED_NAMES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			reservedNames = append(reservedNames, name)
+		}
+	}
+	nameCharset := os.Getenv("NAME_CHARSET")
+	if nameCharset == "" {
+		nameCharset = "unicode"
+	}
+	if nameCharset != "unicode" && nameCharset != "ascii" {
+		return Config{}, errors.New("NAME_CHARSET must be unicode or ascii")
+	}
+	usernameMinLength, err := intOrDefault("USERNAME_MIN_LENGTH", 1)
+	if err != nil {
+		return Config{}, err
+	}
+	usernameMaxLength, err := intOrDefault("USERNAME_MAX_LENGTH", 32)
+	if err != nil {
+		return Config{}, err
+	}
+	channelMinLength, err := intOrDefault("CHANNEL_MIN_LENGTH", 1)
+	if err != nil {
+		return Config{}, err
+	}
+	channelMaxLength, err := intOrDefault("CHANNEL_MAX_LENGTH", 64)
+	if err != nil {
+		return Config{}, err
+	}
+	mailboxLimit, err := intOrDefault("MAILBOX_LIMIT", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxConnections, err := intOrDefault("MAX_CONNECTIONS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxConnectionsPerIP, err := intOrDefault("MAX_CONNECTIONS_PER_IP", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	maxPendingLogins, err := intOrDefault("MAX_PENDING_LOGINS", 0)
+	if err != nil {
+		return Config{}, err
+	}
+
+	loginTimeout, err := durationOrDefault("LOGIN_TIMEOUT", time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+	idleTimeout, err := durationOrDefault("IDLE_TIMEOUT", 0)
+	if err != nil {
+		return Config{}, err
+	}
+	keepAliveInterval, err := durationOrDefault("KEEPALIVE_INTERVAL", 30*time.Second)
+	if err != nil {
+		return Config{}, err
+	}
+	sessionTimeout, err := durationOrDefault("SESSION_TIMEOUT", 5*time.Minute)
+	if err != nil {
+		return Config{}, err
+	}
+
 	//Return config struct
 	return Config{
-		TelNetIp:   telNetIP,
-		TelNetPort: telNetPort,
-		HttpIp:     httpIp,
-		HttpPort:   httpPort,
-		LogFile:    logFile,
+		TelNetIp:     telNetIP,
+		TelNetPort:   telNetPort,
+		HttpIp:       httpIp,
+		HttpPort:     httpPort,
+		LogFile:      logFile,
+		PluginFile:   pluginFile,
+		HistoryFile:  historyFile,
+		AccountsFile: accountsFile,
+		MailboxFile:  mailboxFile,
+		MailboxLimit: mailboxLimit,
+		BanFile:      banFile,
+		PrefsFile:    prefsFile,
+		AuditLog:     auditLog,
+		Admins:       admins,
+		LocaleDir:    localeDir,
+		DefaultLang:  defaultLang,
+
+		APIKeyFile:    apiKeyFile,
+		APIKeys:       apiKeys,
+		RequireAPIKey: requireAPIKey,
+
+		WebhookFile: webhookFile,
+		WebhookLog:  webhookLog,
+
+		IncomingHookFile: incomingHookFile,
+		IncomingHooks:    incomingHooks,
+
+		UsernameMinLength: usernameMinLength,
+		UsernameMaxLength: usernameMaxLength,
+		ChannelMinLength:  channelMinLength,
+		ChannelMaxLength:  channelMaxLength,
+		NameCharset:       nameCharset,
+		ReservedNames:     reservedNames,
+
+		LoginTimeout:      loginTimeout,
+		IdleTimeout:       idleTimeout,
+		KeepAliveInterval: keepAliveInterval,
+		SessionTimeout:    sessionTimeout,
+
+		MaxConnections:      maxConnections,
+		MaxConnectionsPerIP: maxConnectionsPerIP,
+		MaxPendingLogins:    maxPendingLogins,
 	}, nil
 }
+
+// Reads an optional number that can not be negative
+func intOrDefault(key string, def int) (int, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, errors.New(key + " must be a positive number")
+	}
+	return n, nil
+}
+
+// Reads an optional duration such as "30s" or "5m". "0" disables the setting
+func durationOrDefault(key string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		return 0, errors.New(key + " must be a duration such as 30s or 5m")
+	}
+	return d, nil
+}
+
+// Reads an optional true or false
+func boolOrDefault(key string, def bool) (bool, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, errors.New(key + " must be true or false")
+	}
+	return b, nil
+}
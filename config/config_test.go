@@ -2,6 +2,7 @@ package config
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -12,3 +13,76 @@ func TestLoadConfig(t *testing.T) {
 	assert.NoError(t, err)
 	assert.Equal(t, config.HttpPort, "8080")
 }
+
+func TestLoadConfigMissingFile(t *testing.T) {
+	//A reload of a missing file must not apply an empty config
+	_, err := LoadConfig("../missing.env")
+	assert.Error(t, err)
+	_, err = ReloadConfig("../missing.env")
+	assert.Error(t, err)
+}
+
+func TestLoadConfigDurations(t *testing.T) {
+	config, err := LoadConfig("../config.env")
+	assert.NoError(t, err)
+	assert.Equal(t, time.Minute, config.LoginTimeout)
+	assert.Equal(t, time.Duration(0), config.IdleTimeout)
+	assert.Equal(t, 5*time.Minute, config.SessionTimeout)
+
+	t.Setenv("IDLE_TIMEOUT", "5m")
+	config, err = LoadConfig("../config.env")
+	assert.NoError(t, err)
+	assert.Equal(t, 5*time.Minute, config.IdleTimeout)
+
+	t.Setenv("IDLE_TIMEOUT", "soon")
+	_, err = LoadConfig("../config.env")
+	assert.EqualError(t, err, "IDLE_TIMEOUT must be a duration such as 30s or 5m")
+}
+
+func TestLoadConfigAdmins(t *testing.T) {
+	t.Setenv("ADMINS", " alice, bob,,")
+	config, err := LoadConfig("../config.env")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alice", "bob"}, config.Admins)
+}
+
+func TestLoadConfigNames(t *testing.T) {
+	config, err := LoadConfig("../config.env")
+	assert.NoError(t, err)
+	assert.Equal(t, 32, config.UsernameMaxLength)
+	assert.Equal(t, "unicode", config.NameCharset)
+
+	t.Setenv("RESERVED_NAMES", "server, root")
+	t.Setenv("NAME_CHARSET", "ascii")
+	config, err = LoadConfig("../config.env")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"server", "root"}, config.ReservedNames)
+	assert.Equal(t, "ascii", config.NameCharset)
+
+	t.Setenv("NAME_CHARSET", "klingon")
+	_, err = LoadConfig("../config.env")
+	assert.EqualError(t, err, "NAME_CHARSET must be unicode or ascii")
+}
+
+func TestLoadConfigAPIKeys(t *testing.T) {
+	config, err := LoadConfig("../config.env")
+	assert.NoError(t, err)
+	assert.False(t, config.RequireAPIKey)
+	assert.Empty(t, config.APIKeys)
+
+	t.Setenv("API_KEYS", "ci:secret:send+stats, ops:other:admin")
+	t.Setenv("REQUIRE_API_KEY", "true")
+	config, err = LoadConfig("../config.env")
+	assert.NoError(t, err)
+	assert.True(t, config.RequireAPIKey)
+	assert.Equal(t, []string{"ci:secret:send+stats", "ops:other:admin"}, config.APIKeys)
+
+	t.Setenv("INCOMING_HOOKS", "alerts:ops:token,")
+	config, err = LoadConfig("../config.env")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"alerts:ops:token"}, config.IncomingHooks)
+
+	t.Setenv("REQUIRE_API_KEY", "sometimes")
+	_, err = LoadConfig("../config.env")
+	assert.EqualError(t, err, "REQUIRE_API_KEY must be true or false")
+}
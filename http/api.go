@@ -0,0 +1,277 @@
+package http
+
+import (
+	"chatservice/locale"
+	"chatservice/telnet"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// A channel as returned by the api
+type channelInfo struct {
+	Name      string   `json:"name"`
+	Topic     string   `json:"topic,omitempty"`
+	Operators []string `json:"operators"`
+	Members   []string `json:"members"`
+}
+
+// A user as returned by the api
+type userInfo struct {
+	Name       string   `json:"name"`
+	Online     bool     `json:"online"`
+	Client     string   `json:"client,omitempty"` // How an online user is connected: telnet, websocket or http
+	Registered bool     `json:"registered"`
+	Channels   []string `json:"channels"`
+}
+
+type channelPost struct {
+	Name  string
+	Topic string
+}
+
+// Splits the part of a path after prefix into its segments
+func pathParts(path string, prefix string) []string {
+	rest := strings.Trim(strings.TrimPrefix(path, prefix), "/")
+	if rest == "" {
+		return nil
+	}
+	return strings.Split(rest, "/")
+}
+
+// Routes /api/v1/channels, /api/v1/channels/{name} and /api/v1/channels/{name}/members[/{user}]
+func channelsAPI(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	parts := pathParts(r.URL.Path, "/api/v1/channels")
+	switch {
+	case len(parts) == 0:
+		switch r.Method {
+		case http.MethodGet:
+			listChannels(w)
+		case http.MethodPost:
+			createChannel(w, r, lang)
+		default:
+			methodNotAllowed(w, lang, "GET, POST")
+		}
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			getChannel(w, lang, parts[0])
+		case http.MethodDelete:
+			deleteChannel(w, lang, parts[0])
+		default:
+			methodNotAllowed(w, lang, "GET, DELETE")
+		}
+	case len(parts) == 2 && parts[1] == "members":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, lang, "GET")
+			return
+		}
+		listMembers(w, lang, parts[0])
+	case len(parts) == 3 && parts[1] == "members":
+		switch r.Method {
+		case http.MethodPut:
+			joinChannel(w, r, lang, parts[0], parts[2])
+		case http.MethodDelete:
+			leaveChannel(w, lang, parts[0], parts[2])
+		default:
+			methodNotAllowed(w, lang, "PUT, DELETE")
+		}
+	default:
+		writeError(w, lang, http.StatusNotFound, codeNotFound, locale.Errorf("not found"))
+	}
+}
+
+// Describes a channel
+func describeChannel(name string) channelInfo {
+	channel, ok := telnet.GetChannel(name)
+	if !ok {
+		//Closed since the caller checked it
+		return channelInfo{Name: name, Operators: []string{}, Members: []string{}}
+	}
+	sort.Strings(channel.Members)
+	return channelInfo{
+		Name:      name,
+		Topic:     channel.Topic,
+		Operators: channel.Operators,
+		Members:   channel.Members,
+	}
+}
+
+// Lists all channels
+func listChannels(w http.ResponseWriter) {
+	channels := []channelInfo{}
+	for _, name := range telnet.ListChannels() {
+		channels = append(channels, describeChannel(name))
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	writeJSON(w, http.StatusOK, channels)
+}
+
+// Creates a channel. {"name": "foo", "topic": "optional topic"}. A logged in session
+// becomes the operator of the channel, anonymous requests leave it without one
+func createChannel(w http.ResponseWriter, r *http.Request, lang string) {
+	s, err := requestSession(r)
+	if err != nil {
+		writeError(w, lang, http.StatusUnauthorized, codeUnauthorized, err)
+		return
+	}
+	var req channelPost
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+	by := ""
+	if s != nil {
+		by = s.username
+	}
+	err = telnet.CreateChannel(req.Name, by)
+	if err != nil {
+		writeError(w, lang, http.StatusBadRequest, codeInvalidName, err)
+		return
+	}
+	if req.Topic != "" {
+		telnet.SetTopic(req.Name, req.Topic, by)
+	}
+	w.Header().Set("Location", "/api/v1/channels/"+req.Name)
+	writeJSON(w, http.StatusCreated, describeChannel(req.Name))
+}
+
+// Returns a channel
+func getChannel(w http.ResponseWriter, lang string, name string) {
+	if !telnet.ChannelExists(name) {
+		writeError(w, lang, http.StatusNotFound, codeChannelNotFound, telnet.ErrNoChannel)
+		return
+	}
+	writeJSON(w, http.StatusOK, describeChannel(name))
+}
+
+// Closes a channel, taking all of its members out of it
+func deleteChannel(w http.ResponseWriter, lang string, name string) {
+	err := telnet.CloseChannel(name, "http")
+	if err != nil {
+		writeError(w, lang, http.StatusNotFound, codeNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Lists the members of a channel
+func listMembers(w http.ResponseWriter, lang string, name string) {
+	if !telnet.ChannelExists(name) {
+		writeError(w, lang, http.StatusNotFound, codeChannelNotFound, telnet.ErrNoChannel)
+		return
+	}
+	writeJSON(w, http.StatusOK, describeChannel(name).Members)
+}
+
+// Adds a connected user to a channel. Adding a member again does nothing. Sessions can
+// only add their own user, adding anyone else takes admin credentials
+func joinChannel(w http.ResponseWriter, r *http.Request, lang string, channel string, username string) {
+	s, err := requestSession(r)
+	if err != nil {
+		writeError(w, lang, http.StatusUnauthorized, codeUnauthorized, err)
+		return
+	}
+	if s == nil || s.username != username {
+		if status, code, err := checkAdmin(r); err != nil {
+			writeError(w, lang, status, code, err)
+			return
+		}
+	}
+	_, err = telnet.JoinChannel(username, channel)
+	if err != nil {
+		writeError(w, lang, http.StatusNotFound, codeNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, describeChannel(channel))
+}
+
+// Takes a connected user out of a channel
+func leaveChannel(w http.ResponseWriter, lang string, channel string, username string) {
+	err := telnet.LeaveChannel(username, channel)
+	if err != nil {
+		writeError(w, lang, http.StatusNotFound, codeNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Routes /api/v1/users and /api/v1/users/{name}
+func usersAPI(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	parts := pathParts(r.URL.Path, "/api/v1/users")
+	switch {
+	case len(parts) == 0:
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, lang, "GET")
+			return
+		}
+		listUsers(w)
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			getUser(w, lang, parts[0])
+		case http.MethodDelete:
+			deleteUser(w, lang, parts[0])
+		default:
+			methodNotAllowed(w, lang, "GET, DELETE")
+		}
+	default:
+		writeError(w, lang, http.StatusNotFound, codeNotFound, locale.Errorf("not found"))
+	}
+}
+
+// Describes a user. Returns false if the user is neither online nor registered
+func describeUser(name string) (userInfo, bool) {
+	info := userInfo{
+		Name:       name,
+		Registered: telnet.Registered(name),
+		Channels:   []string{},
+	}
+	if user, ok := telnet.OnlineUser(name); ok {
+		info.Online = true
+		info.Client = user.Client()
+		info.Channels = user.ChannelNames()
+		sort.Strings(info.Channels)
+	}
+	return info, info.Online || info.Registered
+}
+
+// Lists connected users
+func listUsers(w http.ResponseWriter) {
+	users := []userInfo{}
+	for _, name := range telnet.ListUsers() {
+		info, _ := describeUser(name)
+		users = append(users, info)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Name < users[j].Name
+	})
+	writeJSON(w, http.StatusOK, users)
+}
+
+// Returns a connected or registered user
+func getUser(w http.ResponseWriter, lang string, name string) {
+	info, ok := describeUser(name)
+	if !ok {
+		writeError(w, lang, http.StatusNotFound, codeUserNotFound, telnet.ErrNoUser)
+		return
+	}
+	writeJSON(w, http.StatusOK, info)
+}
+
+// Disconnects a user
+func deleteUser(w http.ResponseWriter, lang string, name string) {
+	if _, ok := telnet.OnlineUser(name); !ok {
+		writeError(w, lang, http.StatusNotFound, codeUserOffline, telnet.ErrUserOffline)
+		return
+	}
+	err := telnet.Kick(name, "removed through the api")
+	if err != nil {
+		writeError(w, lang, http.StatusNotFound, codeNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
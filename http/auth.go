@@ -0,0 +1,102 @@
+package http
+
+import (
+	"chatservice/apikey"
+	"chatservice/locale"
+	"chatservice/telnet"
+	"net/http"
+)
+
+// Middleware that lets a request through if its key has the scope. Keys are checked
+// once any are set or REQUIRE_API_KEY is on. The admin scope always needs admin
+// credentials. The key is sent in the X-API-Key header
+func requireScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return checkScope(scope, false, next)
+}
+
+// Like requireScope but also takes the key as ?api_key=, for clients such as browsers
+// that can not set headers on streams and websockets
+func requireStreamScope(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return checkScope(scope, true, next)
+}
+
+func checkScope(scope string, inQuery bool, next http.HandlerFunc) http.HandlerFunc {
+	if scope == apikey.ScopeAdmin {
+		return requireAdmin(next)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !getSettings().requireAPIKey && len(apikey.List()) == 0 {
+			next(w, r)
+			return
+		}
+		lang := requestLang(w, r)
+		secret := r.Header.Get("X-API-Key")
+		if secret == "" && inQuery {
+			secret = r.URL.Query().Get("api_key")
+		}
+		if secret == "" {
+			writeError(w, lang, http.StatusUnauthorized, codeUnauthorized, locale.Errorf("api key missing"))
+			return
+		}
+		key, ok := apikey.Check(secret)
+		if !ok {
+			writeError(w, lang, http.StatusUnauthorized, codeUnauthorized, locale.Errorf("invalid api key"))
+			return
+		}
+		if !key.Allows(scope) {
+			writeError(w, lang, http.StatusForbidden, codeForbidden, locale.Errorf("api key does not have the %s scope", scope))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Like requireScope with the scope picked by the request method. Methods that are
+// not listed need admin credentials
+func requireMethodScope(scopes map[string]string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		scope, ok := scopes[r.Method]
+		if !ok {
+			scope = apikey.ScopeAdmin
+		}
+		requireScope(scope, next)(w, r)
+	}
+}
+
+// Middleware that lets a request through only with admin credentials. See checkAdmin
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if status, code, err := checkAdmin(r); err != nil {
+			writeError(w, requestLang(w, r), status, code, err)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Checks that a request has admin credentials, a key with the admin scope or the session
+// of a server admin. Checked even when keys are not required. Returns the status and
+// code to reply with if it does not
+func checkAdmin(r *http.Request) (int, string, error) {
+	if secret := r.Header.Get("X-API-Key"); secret != "" {
+		key, ok := apikey.Check(secret)
+		if !ok {
+			return http.StatusUnauthorized, codeUnauthorized, locale.Errorf("invalid api key")
+		}
+		if !key.Allows(apikey.ScopeAdmin) {
+			return http.StatusForbidden, codeForbidden, locale.Errorf("api key does not have the %s scope", apikey.ScopeAdmin)
+		}
+		return 0, "", nil
+	}
+	s, err := requestSession(r)
+	if err != nil {
+		return http.StatusUnauthorized, codeUnauthorized, err
+	}
+	if s == nil {
+		return http.StatusUnauthorized, codeUnauthorized, locale.Errorf("admin credentials missing")
+	}
+	if !telnet.IsAdmin(s.username) {
+		return http.StatusForbidden, codeForbidden, locale.Errorf("permission denied")
+	}
+	return 0, "", nil
+}
@@ -0,0 +1,136 @@
+package http
+
+import (
+	"chatservice/ban"
+	"chatservice/locale"
+	"chatservice/telnet"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Machine readable codes sent in the "code" field of error responses
+const (
+	codeInvalidJSON      = "invalid_json"
+	codeUnknownField     = "unknown_field"
+	codeEmptyMessage     = "empty_message"
+	codeInvalidType      = "invalid_type"
+	codeInvalidName      = "invalid_name"
+	codeInvalidID        = "invalid_id"
+	codeInvalidTarget    = "invalid_target"
+	codeInvalidDuration  = "invalid_duration"
+	codeInvalidQuery     = "invalid_query"
+	codeChannelNotFound  = "channel_not_found"
+	codeChannelExists    = "channel_exists"
+	codeUserNotFound     = "user_not_found"
+	codeUserOffline      = "user_offline"
+	codeNotMember        = "not_member"
+	codeMessageNotFound  = "message_not_found"
+	codeMessageDeleted   = "message_deleted"
+	codeNotAuthor        = "not_author"
+	codeMailboxFull      = "mailbox_full"
+	codeBanNotFound      = "ban_not_found"
+	codeBanned           = "banned"
+	codeUnauthorized     = "unauthorized"
+	codeForbidden        = "forbidden"
+	codeUsernameTaken    = "username_taken"
+	codeServerBusy       = "server_busy"
+	codeNotFound         = "not_found"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeInternal         = "internal_error"
+)
+
+// The body of every error response, e.g. {"error":{"code":"channel_not_found","message":"channel does not exist"}}
+type errorBody struct {
+	Error apiError `json:"error"`
+}
+
+type apiError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"` // In the language of the request
+}
+
+// Status codes and error codes for errors from the chat server
+var knownErrors = []struct {
+	err    error
+	status int
+	code   string
+}{
+	{telnet.ErrNoChannel, http.StatusNotFound, codeChannelNotFound},
+	{telnet.ErrChannelExists, http.StatusConflict, codeChannelExists},
+	{telnet.ErrNoUser, http.StatusNotFound, codeUserNotFound},
+	{telnet.ErrUserOffline, http.StatusNotFound, codeUserOffline},
+	{telnet.ErrNotMember, http.StatusNotFound, codeNotMember},
+	{telnet.ErrNoMessage, http.StatusNotFound, codeMessageNotFound},
+	{telnet.ErrMessageDeleted, http.StatusConflict, codeMessageDeleted},
+	{telnet.ErrNotAuthor, http.StatusForbidden, codeNotAuthor},
+	{telnet.ErrMailboxFull, http.StatusConflict, codeMailboxFull},
+	{ban.ErrNotFound, http.StatusNotFound, codeBanNotFound},
+	{telnet.ErrBadPassword, http.StatusUnauthorized, codeUnauthorized},
+	{telnet.ErrUsernameTaken, http.StatusConflict, codeUsernameTaken},
+	{telnet.ErrBanned, http.StatusForbidden, codeBanned},
+}
+
+// Writes an error as json. Errors from the chat server get their own status and code,
+// anything else uses the status and code passed in
+func writeError(w http.ResponseWriter, lang string, status int, code string, err error) {
+	for _, known := range knownErrors {
+		if errors.Is(err, known.err) {
+			status, code = known.status, known.code
+			break
+		}
+	}
+	errorsTotal.Inc(code)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	writeJSON(w, status, errorBody{apiError{Code: code, Message: locale.TranslateError(lang, err)}})
+}
+
+// Writes a value as json
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	ret, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Println("json marshelling error: ", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(ret)
+}
+
+// Decodes a json request body, refusing fields that v does not have. Writes the error
+// response and returns false if the body is invalid
+func decodeBody(w http.ResponseWriter, r *http.Request, lang string, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(v)
+	if err != nil {
+		code := codeInvalidJSON
+		if strings.HasPrefix(err.Error(), "json: unknown field") {
+			code = codeUnknownField
+		}
+		writeError(w, lang, http.StatusBadRequest, code, err)
+		log.Println("json decoding error: ", err)
+		return false
+	}
+	return true
+}
+
+// Rejects a request whose method is not one of allowed
+func methodNotAllowed(w http.ResponseWriter, lang string, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, lang, http.StatusMethodNotAllowed, codeMethodNotAllowed, locale.Errorf("method not allowed"))
+}
+
+// Middleware that only lets requests with one method through
+func allow(method string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			methodNotAllowed(w, requestLang(w, r), method)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,68 @@
+package http
+
+import (
+	"chatservice/incoming"
+	"chatservice/locale"
+	"chatservice/telnet"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Body of a Slack style incoming webhook. Other fields Slack accepts are ignored
+type slackPost struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel"` // Ignored, hooks always post into their own channel
+	Username string `json:"username"`
+}
+
+// Slack escapes these in text
+var slackUnescaper = strings.NewReplacer("&lt;", "<", "&gt;", ">", "&amp;", "&")
+
+// Posts a Slack style payload into the channel of the hook named by the token in the
+// url, /api/v1/hooks/<token>. The body is json or a form with the json in payload
+func incomingHook(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	hook, ok := incoming.Check(strings.TrimPrefix(r.URL.Path, "/api/v1/hooks/"))
+	if !ok {
+		writeError(w, lang, http.StatusNotFound, codeNotFound, locale.Errorf("not found"))
+		return
+	}
+	var req slackPost
+	var err error
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		err = json.Unmarshal([]byte(r.PostFormValue("payload")), &req)
+	} else {
+		err = json.NewDecoder(r.Body).Decode(&req)
+	}
+	if err != nil {
+		log.Println("json decoding error: ", err)
+		writeError(w, lang, http.StatusBadRequest, codeInvalidJSON, err)
+		return
+	}
+	text := slackUnescaper.Replace(req.Text)
+	if strings.TrimSpace(text) == "" {
+		writeError(w, lang, http.StatusBadRequest, codeEmptyMessage, locale.Errorf("message can not be empty"))
+		return
+	}
+	//Hooks may pick their name but not pose as a user
+	from := hook.Name
+	if req.Username != "" {
+		if err := telnet.CheckUsername(req.Username); err != nil {
+			writeError(w, lang, http.StatusBadRequest, codeInvalidName, err)
+			return
+		}
+		if telnet.NameInUse(req.Username) {
+			writeError(w, lang, http.StatusBadRequest, codeInvalidName, locale.Errorf("name %s belongs to a user", req.Username))
+			return
+		}
+		from = req.Username
+	}
+	if sendMessage(w, lang, from, telnet.KindMessage, hook.Channel, "", text) == 0 {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
@@ -0,0 +1,106 @@
+package http
+
+import (
+	"chatservice/locale"
+	"chatservice/telnet"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const defaultPageSize = 100 // Messages returned by /api/v1/messages when no limit is given
+const maxPageSize = 1000
+
+// Searches the message history. Query parameters:
+// since, until (RFC3339), from, channel, to, kind, after, before (message id cursors),
+// offset, limit and tail=true to page back from the newest message. Private messages
+// are only returned to a session of their sender or recipient, or to admins
+func getMessages(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	q, err := parseMessageQuery(r.URL.Query())
+	if err != nil {
+		writeError(w, lang, http.StatusBadRequest, codeInvalidQuery, err)
+		return
+	}
+	s, err := requestSession(r)
+	if err != nil {
+		writeError(w, lang, http.StatusUnauthorized, codeUnauthorized, err)
+		return
+	}
+	if s != nil {
+		q.Viewer = s.username
+	}
+	status, code, adminErr := checkAdmin(r)
+	q.Admin = adminErr == nil
+	if q.To != "" && q.To != q.Viewer && !q.Admin {
+		writeError(w, lang, status, code, adminErr)
+		return
+	}
+	writeJSON(w, http.StatusOK, telnet.QueryMessages(q))
+}
+
+// Turns query parameters into a message query
+func parseMessageQuery(values url.Values) (telnet.MessageQuery, error) {
+	q := telnet.MessageQuery{
+		From:    values.Get("from"),
+		Channel: values.Get("channel"),
+		To:      values.Get("to"),
+		Kind:    values.Get("kind"),
+		Limit:   defaultPageSize,
+		Tail:    values.Get("tail") == "true",
+	}
+	if q.Kind != "" && !telnet.ValidKind(q.Kind) && q.Kind != telnet.KindNotice {
+		return q, locale.Errorf("unknown message type: %s", q.Kind)
+	}
+	var err error
+	if q.Since, err = parseTime(values, "since"); err != nil {
+		return q, err
+	}
+	if q.Until, err = parseTime(values, "until"); err != nil {
+		return q, err
+	}
+	if q.After, err = parseID(values, "after"); err != nil {
+		return q, err
+	}
+	if q.Before, err = parseID(values, "before"); err != nil {
+		return q, err
+	}
+	if values.Has("offset") {
+		q.Offset, err = strconv.Atoi(values.Get("offset"))
+		if err != nil || q.Offset < 0 {
+			return q, locale.Errorf("invalid %s: %s", "offset", values.Get("offset"))
+		}
+	}
+	if values.Has("limit") {
+		q.Limit, err = strconv.Atoi(values.Get("limit"))
+		if err != nil || q.Limit < 1 || q.Limit > maxPageSize {
+			return q, locale.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	return q, nil
+}
+
+// Parses an RFC3339 time parameter. A missing parameter is the zero time
+func parseTime(values url.Values, name string) (time.Time, error) {
+	if !values.Has(name) {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, values.Get(name))
+	if err != nil {
+		return t, locale.Errorf("invalid %s: %s", name, values.Get(name))
+	}
+	return t, nil
+}
+
+// Parses a message id parameter. A missing parameter is 0
+func parseID(values url.Values, name string) (uint64, error) {
+	if !values.Has(name) {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(values.Get(name), 10, 64)
+	if err != nil {
+		return 0, locale.Errorf("invalid %s: %s", name, values.Get(name))
+	}
+	return id, nil
+}
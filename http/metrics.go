@@ -0,0 +1,97 @@
+package http
+
+import (
+	"bufio"
+	"chatservice/metrics"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Metrics for /metrics
+var (
+	requestDuration  = metrics.NewHistogram("http_request_duration_seconds", "Time taken to answer http requests, by handler, method and status code", metrics.DefBuckets, "handler", "method", "code")
+	requestsInFlight = metrics.NewGauge("http_requests_in_flight", "Http requests being answered, including open streams and websockets")
+	errorsTotal      = metrics.NewCounter("http_errors_total", "Error responses, by error code", "code")
+)
+
+func init() {
+	metrics.NewGaugeFunc("http_session_queued_frames", "Frames waiting for http sessions to poll their inbox", func() float64 {
+		sessionsMu.Lock()
+		list := make([]*session, 0, len(sessions))
+		for _, s := range sessions {
+			list = append(list, s)
+		}
+		sessionsMu.Unlock()
+		count := 0
+		for _, s := range list {
+			s.conn.mu.Lock()
+			count += len(s.conn.queue)
+			s.conn.mu.Unlock()
+		}
+		return float64(count)
+	})
+}
+
+// Registers a handler on the default mux, timing every request it answers
+func handle(pattern string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, instrument(pattern, handler))
+}
+
+// Middleware that records how long requests take. Requests are labelled with the
+// pattern they matched rather than their path so ids in paths do not add series
+func instrument(pattern string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		requestsInFlight.Inc()
+		defer requestsInFlight.Dec()
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+		requestDuration.Observe(time.Since(start).Seconds(), pattern, methodLabel(r.Method), strconv.Itoa(rec.status))
+	}
+}
+
+// Returns the label a method is counted under. Unusual methods share one label
+func methodLabel(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+		return method
+	}
+	return "OTHER"
+}
+
+// Remembers the status code written to a response. Passes flushes and hijacks through
+// so streams and websockets still work
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	rec.status = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("connection can not be hijacked")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Returns every metric in the Prometheus text format
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	metrics.Write(w)
+}
@@ -1,18 +1,37 @@
 package http
 
 import (
+	"chatservice/apikey"
+	"chatservice/ban"
 	"chatservice/config"
+	"chatservice/locale"
 	"chatservice/telnet"
-	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
 type submitPost struct {
 	Channel string
 	Message string
 	User    string
+	Type    string // Kind of message, "message" or "action". Defaults to message
+}
+
+type banPost struct {
+	Target   string // ip or CIDR
+	Duration string // How long the ban lasts, e.g. "1h". Empty bans forever
+	Reason   string
+}
+
+type editPost struct {
+	Id      uint64
+	Message string
 }
 
 var logfile string
@@ -20,53 +39,294 @@ var logfile string
 // Spin up handler and start server
 func InitHttpServer(cfg config.Config) {
 	logfile = cfg.LogFile
+	ApplyConfig(cfg)
 	//Spin up handlers and server
-	http.HandleFunc("/submitMessage", submitMessage)
-	http.HandleFunc("/getLogs", getLogs)
-	http.HandleFunc("/stats", getStats)
+	send, readLogs, stats := apikey.ScopeSend, apikey.ScopeReadLogs, apikey.ScopeStats
+	handle("/submitMessage", checkBan(requireScope(send, allow(http.MethodPost, submitMessage))))
+	handle("/editMessage", checkBan(requireScope(send, allow(http.MethodPost, editMessage))))
+	handle("/deleteMessage", checkBan(requireScope(send, allow(http.MethodPost, deleteMessage))))
+	handle("/thread", checkBan(requireScope(readLogs, allow(http.MethodGet, getThread))))
+	handle("/getLogs", checkBan(requireScope(readLogs, allow(http.MethodGet, getLogs))))
+	handle("/stats", checkBan(requireScope(stats, allow(http.MethodGet, getStats))))
+	handle("/bans", checkBan(requireAdmin(allow(http.MethodGet, getBans))))
+	handle("/addBan", checkBan(requireAdmin(allow(http.MethodPost, addBan))))
+	handle("/removeBan", checkBan(requireAdmin(allow(http.MethodPost, removeBan))))
+	channelScopes := map[string]string{http.MethodGet: stats, http.MethodPost: send, http.MethodPut: send}
+	handle("/api/v1/channels", checkBan(requireMethodScope(channelScopes, channelsAPI)))
+	handle("/api/v1/channels/", checkBan(requireMethodScope(channelScopes, channelsAPI)))
+	handle("/api/v1/messages", checkBan(requireScope(readLogs, allow(http.MethodGet, getMessages))))
+	handle("/api/v1/stream", checkBan(requireStreamScope(readLogs, allow(http.MethodGet, streamMessages))))
+	handle("/api/v1/ws", checkBan(requireStreamScope(send, allow(http.MethodGet, chatSocket))))
+	handle("/api/v1/sessions", checkBan(requireScope(send, sessionsAPI)))
+	handle("/api/v1/inbox", checkBan(requireScope(send, allow(http.MethodGet, getInbox))))
+	userScopes := map[string]string{http.MethodGet: stats}
+	handle("/api/v1/users", checkBan(requireMethodScope(userScopes, usersAPI)))
+	handle("/api/v1/users/", checkBan(requireMethodScope(userScopes, usersAPI)))
+	//Incoming webhooks are checked by the token in their url instead of an api key
+	handle("/api/v1/hooks/", checkBan(allow(http.MethodPost, incomingHook)))
+	handle("/metrics", checkBan(requireScope(stats, allow(http.MethodGet, getMetrics))))
 	go http.ListenAndServe(cfg.HttpIp+":"+cfg.HttpPort, nil)
 	log.Println("Created http server")
 }
 
-// Allows the http user to send in messages
+// Settings from the config that a reload can change while requests are handled
+type settings struct {
+	requireAPIKey  bool          // Refuse requests without an api key even when no keys are set
+	sessionTimeout time.Duration // Sessions that make no requests for this long are logged out
+}
+
+var currentSettings = settings{sessionTimeout: 5 * time.Minute}
+var settingsMu sync.Mutex
+
+// Returns the settings in use
+func getSettings() settings {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	return currentSettings
+}
+
+// Replaces the settings. Sessions pick up a new timeout on their next request
+func setSettings(s settings) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	currentSettings = s
+}
+
+// Applies the settings in the config that can change while the server is running
+func ApplyConfig(cfg config.Config) {
+	settingsMu.Lock()
+	defer settingsMu.Unlock()
+	if cfg.SessionTimeout > 0 {
+		currentSettings.sessionTimeout = cfg.SessionTimeout
+	}
+	currentSettings.requireAPIKey = cfg.RequireAPIKey
+}
+
+// Picks the language to answer a request in from its Accept-Language header
+func requestLang(w http.ResponseWriter, r *http.Request) string {
+	lang := locale.Match(r.Header.Get("Accept-Language"))
+	w.Header().Set("Content-Language", lang)
+	return lang
+}
+
+// Middleware that rejects requests from banned ips
+func checkBan(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if _, banned := ban.IsBanned(host); banned {
+			lang := requestLang(w, r)
+			writeError(w, lang, http.StatusForbidden, codeBanned, locale.Errorf("you are banned from this server"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Allows the http user to send in messages. Requests with a session are sent
+// under the name of the session, others are sent as "http"
 func submitMessage(w http.ResponseWriter, r *http.Request) {
-	var req submitPost
-	err := json.NewDecoder(r.Body).Decode(&req)
+	lang := requestLang(w, r)
+	from := "http"
+	s, err := requestSession(r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		log.Println("json decoding error: ", err)
+		writeError(w, lang, http.StatusUnauthorized, codeUnauthorized, err)
+		return
+	}
+	if s != nil {
+		from = s.username
+	}
+	var req submitPost
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		writeError(w, lang, http.StatusBadRequest, codeEmptyMessage, locale.Errorf("message can not be empty"))
+		return
+	}
+	if req.Type == "" {
+		req.Type = telnet.KindMessage
+	}
+	if !telnet.ValidKind(req.Type) {
+		writeError(w, lang, http.StatusBadRequest, codeInvalidType, locale.Errorf("unknown message type: %s", req.Type))
 		return
 	}
 
-	if req.Channel != "" {
-		if userList, ok := telnet.Channels[req.Channel]; ok {
-			telnet.HTTPSendChannelMessage(req.Message, req.Channel, userList)
-		} else {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("Channel does not exist"))
-			return
+	switch sendMessage(w, lang, from, req.Type, req.Channel, req.User, req.Message) {
+	case http.StatusOK:
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(locale.T(lang, "Message submitted successfully")))
+	case http.StatusAccepted:
+		w.WriteHeader(http.StatusAccepted)
+		w.Write([]byte(locale.T(lang, "Message saved to mailbox")))
+	}
+}
+
+// Sends a message into a channel, to a user or to everyone. Returns 200 once it is sent
+// or 202 if it was saved to the mailbox of an offline user. Otherwise writes the error
+// response and returns 0
+func sendMessage(w http.ResponseWriter, lang string, from string, kind string, channel string, user string, message string) int {
+	if channel != "" {
+		if !telnet.ChannelExists(channel) {
+			if err := telnet.CheckChannelName(channel); err != nil {
+				writeError(w, lang, http.StatusBadRequest, codeInvalidName, err)
+				return 0
+			}
+			writeError(w, lang, http.StatusNotFound, codeChannelNotFound, telnet.ErrNoChannel)
+			return 0
+		}
+		user = ""
+	} else if user != "" {
+		if _, ok := telnet.OnlineUser(user); !ok {
+			if telnet.Registered(user) {
+				err := telnet.SendKindAs(from, kind, "", user, message)
+				if err != nil {
+					writeError(w, lang, http.StatusInternalServerError, codeInternal, err)
+					return 0
+				}
+				return http.StatusAccepted
+			}
+			if err := telnet.CheckUsername(user); err != nil {
+				writeError(w, lang, http.StatusBadRequest, codeInvalidName, err)
+				return 0
+			}
+			writeError(w, lang, http.StatusNotFound, codeUserNotFound, telnet.ErrNoUser)
+			return 0
 		}
-	} else if req.User != "" {
-		if user, ok := telnet.Users[req.User]; ok {
-			telnet.HTTPSendUserMessage(req.Message, user)
-		} else {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("User does not exist"))
+	}
+	err := telnet.SendKindAs(from, kind, channel, user, message)
+	if err != nil {
+		writeError(w, lang, http.StatusInternalServerError, codeInternal, err)
+		return 0
+	}
+	return http.StatusOK
+}
+
+// Allows a logged in http user to edit a message they sent
+func editMessage(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	s, ok := requireSession(w, r, lang)
+	if !ok {
+		return
+	}
+	var req editPost
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+	if strings.TrimSpace(req.Message) == "" {
+		writeError(w, lang, http.StatusBadRequest, codeEmptyMessage, locale.Errorf("message can not be empty"))
+		return
+	}
+	err := telnet.EditMessage(req.Id, s.username, req.Message)
+	if err != nil {
+		writeError(w, lang, http.StatusBadRequest, codeInvalidID, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(locale.T(lang, "Message edited successfully")))
+}
+
+// Allows a logged in http user to delete a message they sent
+func deleteMessage(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	s, ok := requireSession(w, r, lang)
+	if !ok {
+		return
+	}
+	var req editPost
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+	err := telnet.DeleteMessage(req.Id, s.username)
+	if err != nil {
+		writeError(w, lang, http.StatusBadRequest, codeInvalidID, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(locale.T(lang, "Message deleted successfully")))
+}
+
+// Returns all messages in the thread of the message id passed as ?id=
+func getThread(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		writeError(w, lang, http.StatusBadRequest, codeInvalidID, locale.Errorf("invalid message id"))
+		return
+	}
+	//Private messages are only shown to a session of their sender or recipient
+	viewer := ""
+	if s, _ := requestSession(r); s != nil {
+		viewer = s.username
+	}
+	thread, err := telnet.Thread(id, viewer)
+	if err != nil {
+		writeError(w, lang, http.StatusNotFound, codeMessageNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, thread)
+}
+
+// Returns the ban list
+func getBans(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ban.List())
+}
+
+// Bans an ip or CIDR and disconnects users connected from it
+func addBan(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	var req banPost
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+	var duration time.Duration
+	if req.Duration != "" {
+		d, err := time.ParseDuration(req.Duration)
+		if err != nil || d < 0 {
+			writeError(w, lang, http.StatusBadRequest, codeInvalidDuration, locale.Errorf("invalid duration: %s", req.Duration))
 			return
 		}
-	} else {
-		telnet.HTTPSendAllMessage(req.Message)
+		duration = d
 	}
+	_, err := ban.Add(req.Target, duration, req.Reason, "http")
+	if err != nil {
+		writeError(w, lang, http.StatusBadRequest, codeInvalidTarget, err)
+		return
+	}
+	telnet.DisconnectBanned()
 	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("Message submitted successfully"))
+	w.Write([]byte(locale.T(lang, "Ban added successfully")))
+}
+
+// Removes a ban
+func removeBan(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	var req banPost
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+	err := ban.Remove(req.Target)
+	if err != nil {
+		writeError(w, lang, http.StatusBadRequest, codeInvalidTarget, err)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(locale.T(lang, "Ban removed successfully")))
 }
 
 // Allows the http user to get their messages
 func getLogs(w http.ResponseWriter, r *http.Request) {
 	contents, err := os.ReadFile(logfile)
+	if os.IsNotExist(err) {
+		//Nothing has been logged yet
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
 		log.Println("file reading error: ", err)
+		writeError(w, requestLang(w, r), http.StatusInternalServerError, codeInternal, locale.Errorf("unable to read the log"))
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -75,17 +335,16 @@ func getLogs(w http.ResponseWriter, r *http.Request) {
 
 // Returns stats for the chat service
 func getStats(w http.ResponseWriter, r *http.Request) {
+	conns := telnet.GetConnectionStats()
 	retMap := map[string]int{
-		"users":         len(telnet.Users),
-		"channels":      len(telnet.Channels),
-		"messages_sent": telnet.MessagesSent.C,
+		"users":                            len(telnet.ListUsers()),
+		"channels":                         len(telnet.ListChannels()),
+		"messages_sent":                    telnet.MessagesSent(),
+		"connections":                      conns.Connections,
+		"pending_logins":                   conns.PendingLogins,
+		"rejected_connections_max":         conns.RejectedMaxConns,
+		"rejected_connections_per_ip":      conns.RejectedPerIP,
+		"rejected_connections_max_pending": conns.RejectedPendingLogins,
 	}
-	ret, err := json.Marshal(retMap)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Println("json marshelling error: ", err)
-		return
-	}
-	w.WriteHeader(http.StatusOK)
-	w.Write(ret)
+	writeJSON(w, http.StatusOK, retMap)
 }
@@ -1,12 +1,24 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
+	"chatservice/apikey"
 	"chatservice/config"
+	"chatservice/incoming"
+	"chatservice/locale"
+	"chatservice/telnet"
+	"context"
+	"encoding/json"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 var cfg config.Config
@@ -23,33 +35,73 @@ func init() {
 	InitHttpServer(cfg)
 }
 
+// Returns the body of an error response
+func errorJSON(code string, message string) string {
+	return `{"error":{"code":"` + code + `","message":"` + message + `"}}`
+}
+
 func TestSubmitMessages(t *testing.T) {
 	//Expecting all these to "fail". This just verifies parsing of the json
 	//and logic, not the sending of a message into telnet
 	tests := []struct {
 		name     string
 		postBody string
+		status   int
 		expected string
 	}{
 		{
 			"send to all",
 			`{"message":"hello"}`,
+			http.StatusOK,
 			"Message submitted successfully",
 		},
 		{
 			"send to pm",
 			`{"user":"foo", "message":"hello"}`,
-			"User does not exist",
+			http.StatusNotFound,
+			errorJSON("user_not_found", "user does not exist"),
 		},
 		{
 			"send to channel",
 			`{"channel":"foo", "message":"hello"}`,
-			"Channel does not exist",
+			http.StatusNotFound,
+			errorJSON("channel_not_found", "channel does not exist"),
+		},
+		{
+			"invalid channel name",
+			`{"channel":"a|b", "message":"hello"}`,
+			http.StatusBadRequest,
+			errorJSON("invalid_name", "name can not contain '|'"),
+		},
+		{
+			"reserved user name",
+			`{"user":"http", "message":"hello"}`,
+			http.StatusBadRequest,
+			errorJSON("invalid_name", "name http is reserved"),
+		},
+		{
+			"unknown message type",
+			`{"message":"hello", "type":"shout"}`,
+			http.StatusBadRequest,
+			errorJSON("invalid_type", "unknown message type: shout"),
+		},
+		{
+			"empty message",
+			`{"message":"  "}`,
+			http.StatusBadRequest,
+			errorJSON("empty_message", "message can not be empty"),
+		},
+		{
+			"unknown field",
+			`{"message":"hello", "colour":"red"}`,
+			http.StatusBadRequest,
+			errorJSON("unknown_field", `json: unknown field \"colour\"`),
 		},
 		{
 			"json parse failure",
 			`{"foo:"foo"}`,
-			"invalid character 'f' after object key\n",
+			http.StatusBadRequest,
+			errorJSON("invalid_json", "invalid character 'f' after object key"),
 		},
 	}
 	for _, tt := range tests {
@@ -65,8 +117,77 @@ func TestSubmitMessages(t *testing.T) {
 		if err != nil {
 			t.Errorf("Error: %v", err)
 		}
-		if string(data) != tt.expected {
-			t.Errorf("Expected "+tt.expected+" but got %v", string(data))
+		if res.StatusCode != tt.status || string(data) != tt.expected {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, res.StatusCode, string(data))
+		}
+	}
+}
+
+func TestMethods(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		status  int
+		allowed string
+	}{
+		{"get submit", http.MethodGet, "/submitMessage", http.StatusMethodNotAllowed, http.MethodPost},
+		{"post logs", http.MethodPost, "/getLogs", http.StatusMethodNotAllowed, http.MethodGet},
+		{"delete stats", http.MethodDelete, "/stats", http.StatusMethodNotAllowed, http.MethodGet},
+		{"get stats", http.MethodGet, "/stats", http.StatusOK, ""},
+		{"post socket", http.MethodPost, "/api/v1/ws", http.StatusMethodNotAllowed, http.MethodGet},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, req)
+		res := w.Result()
+		if res.StatusCode != tt.status || res.Header.Get("Allow") != tt.allowed {
+			t.Errorf(tt.name+": expected %d %s but got %d %s", tt.status, tt.allowed, res.StatusCode, res.Header.Get("Allow"))
+		}
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	old := getSettings()
+	setSettings(settings{requireAPIKey: true, sessionTimeout: old.sessionTimeout})
+	defer setSettings(old)
+	if err := apikey.SetStatic([]string{"stats:statskey:stats", "root:rootkey:admin"}); err != nil {
+		t.Fatal("could not set api keys: ", err)
+	}
+	defer apikey.SetStatic(nil)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		key      string
+		status   int
+		expected string
+	}{
+		{"missing key", http.MethodGet, "/stats", "", http.StatusUnauthorized, errorJSON("unauthorized", "api key missing")},
+		{"wrong key", http.MethodGet, "/stats", "nokey", http.StatusUnauthorized, errorJSON("unauthorized", "invalid api key")},
+		{"missing scope", http.MethodGet, "/getLogs", "statskey", http.StatusForbidden, errorJSON("forbidden", "api key does not have the read-logs scope")},
+		{"scope by method", http.MethodDelete, "/api/v1/users/nobody", "statskey", http.StatusForbidden, errorJSON("forbidden", "api key does not have the admin scope")},
+		{"admin key", http.MethodDelete, "/api/v1/users/nobody", "rootkey", http.StatusNotFound, errorJSON("user_offline", "user is not online")},
+		{"stats key", http.MethodGet, "/api/v1/users", "statskey", http.StatusOK, `[]`},
+		{"key in query", http.MethodGet, "/api/v1/users?api_key=statskey", "", http.StatusUnauthorized, errorJSON("unauthorized", "api key missing")},
+		{"key in stream query", http.MethodGet, "/api/v1/stream?api_key=statskey", "", http.StatusForbidden, errorJSON("forbidden", "api key does not have the read-logs scope")},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, req)
+		res := w.Result()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if res.StatusCode != tt.status || string(data) != tt.expected {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, res.StatusCode, string(data))
 		}
 	}
 }
@@ -87,8 +208,40 @@ func TestGetLogs(t *testing.T) {
 	}
 }
 
+func TestGetMessages(t *testing.T) {
+	tests := []struct {
+		name     string
+		query    string
+		status   int
+		expected string
+	}{
+		{"all", "", http.StatusOK, `"text":"hello"`},
+		{"filtered", "?from=nobody&kind=action", http.StatusOK, `{"messages":[],"more":false}`},
+		{"paged", "?from=http&limit=1&tail=true&until=2100-01-01T00:00:00Z", http.StatusOK, `"text":"hello"}],"more":false}`},
+		{"invalid time", "?since=yesterday", http.StatusBadRequest, errorJSON("invalid_query", "invalid since: yesterday")},
+		{"invalid cursor", "?after=-1", http.StatusBadRequest, errorJSON("invalid_query", "invalid after: -1")},
+		{"invalid limit", "?limit=0", http.StatusBadRequest, errorJSON("invalid_query", "limit must be between 1 and 1000")},
+		{"invalid kind", "?kind=shout", http.StatusBadRequest, errorJSON("invalid_query", "unknown message type: shout")},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/messages"+tt.query, nil)
+		w := httptest.NewRecorder()
+		getMessages(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if res.StatusCode != tt.status || !bytes.Contains(data, []byte(tt.expected)) {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, res.StatusCode, string(data))
+		}
+	}
+}
+
 func TestGetStats(t *testing.T) {
-	expected := `{"channels":0,"messages_sent":1,"users":0}`
+	expected := `{"channels":0,"connections":0,"messages_sent":1,"pending_logins":0,` +
+		`"rejected_connections_max":0,"rejected_connections_max_pending":0,"rejected_connections_per_ip":0,"users":0}`
 	req := httptest.NewRequest(http.MethodGet, "/stats", nil)
 	w := httptest.NewRecorder()
 	getStats(w, req)
@@ -102,3 +255,780 @@ func TestGetStats(t *testing.T) {
 		t.Errorf("Expected "+expected+" but got %v", string(data))
 	}
 }
+
+func TestStreamMessages(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(streamMessages))
+	defer server.Close()
+
+	//Connect and read events from a stream in the background
+	open := func(query string, lastID string) (*bufio.Reader, func()) {
+		ctx, cancel := context.WithCancel(context.Background())
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal("could not open stream: ", err)
+		}
+		if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/event-stream" {
+			t.Fatalf("expected an event stream but got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+		}
+		return bufio.NewReader(res.Body), func() { cancel(); res.Body.Close() }
+	}
+	//Reads the next event and returns its id and data lines
+	next := func(r *bufio.Reader) (string, string) {
+		var id, data string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal("stream ended: ", err)
+			}
+			line = strings.TrimSuffix(line, "\n")
+			if line == "" && data != "" {
+				return id, data
+			}
+			if v, ok := strings.CutPrefix(line, "id: "); ok {
+				id = v
+			}
+			if v, ok := strings.CutPrefix(line, "data: "); ok {
+				data = v
+			}
+		}
+	}
+
+	stream, stop := open("", "")
+	telnet.SendAs("http", "", "", "streamed")
+	id, data := next(stream)
+	stop()
+	if !strings.Contains(data, `"text":"streamed"`) {
+		t.Errorf("expected the streamed message but got %s", data)
+	}
+
+	//Messages sent while disconnected are replayed after the last event id
+	telnet.SendAs("http", "", "", "missed")
+	stream, stop = open("", id)
+	defer stop()
+	_, data = next(stream)
+	if !strings.Contains(data, `"text":"missed"`) {
+		t.Errorf("expected the missed message but got %s", data)
+	}
+
+	res, err := http.Get(server.URL + "?channel=nochannel")
+	if err != nil {
+		t.Fatal("could not open stream: ", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for a missing channel but got %d", res.StatusCode)
+	}
+
+	//Private messages are only streamed to the session of their recipient
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/sessions", bytes.NewReader([]byte(`{"username":"streamer"}`)))
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	var login struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &login)
+	if login.Token == "" {
+		t.Fatal("expected to log in but got ", w.Body.String())
+	}
+	defer telnet.Logout("streamer")
+	res, err = http.Get(server.URL + "?user=streamer")
+	if err != nil {
+		t.Fatal("could not open stream: ", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401 for another user's messages but got %d", res.StatusCode)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ = http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"?user=streamer", nil)
+	req.Header.Set("Authorization", "Bearer "+login.Token)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil || res.StatusCode != http.StatusOK {
+		t.Fatal("could not open own stream: ", err)
+	}
+	defer res.Body.Close()
+	telnet.SendAs("http", "", "streamer", "for your eyes")
+	_, data = next(bufio.NewReader(res.Body))
+	if !strings.Contains(data, `"text":"for your eyes"`) {
+		t.Errorf("expected the private message but got %s", data)
+	}
+}
+
+func TestChatSocket(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(chatSocket))
+	defer server.Close()
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal("could not connect: ", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil || res.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("websocket handshake failed: ", err)
+	}
+
+	//Sends a line of input as a masked text frame
+	send := func(text string) {
+		frame := []byte{0x81, 0x80 | byte(len(text)), 0, 0, 0, 0}
+		conn.Write(append(frame, text...))
+	}
+	//Reads frames until one matches. Returns false if the socket was closed first
+	waitFor := func(match func(socketFrame) bool) bool {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for {
+			header := make([]byte, 2)
+			if _, err := io.ReadFull(reader, header); err != nil {
+				t.Fatal("could not read frame: ", err)
+			}
+			length := int(header[1] & 0x7F)
+			if length == 126 {
+				ext := make([]byte, 2)
+				io.ReadFull(reader, ext)
+				length = int(ext[0])<<8 | int(ext[1])
+			}
+			payload := make([]byte, length)
+			io.ReadFull(reader, payload)
+			if header[0]&0x0F == 0x8 {
+				return false
+			}
+			var f socketFrame
+			if err := json.Unmarshal(payload, &f); err != nil {
+				t.Fatal("frame is not json: ", string(payload))
+			}
+			if match(f) {
+				return true
+			}
+		}
+	}
+	textContains := func(text string) func(socketFrame) bool {
+		return func(f socketFrame) bool { return f.Type == "text" && strings.Contains(f.Text, text) }
+	}
+
+	if !waitFor(textContains("Enter username:")) {
+		t.Fatal("expected a username prompt")
+	}
+	send("wsuser")
+	if !waitFor(textContains("Welcome")) {
+		t.Fatal("expected to be logged in")
+	}
+	send("/listusers")
+	if !waitFor(textContains("wsuser")) {
+		t.Error("expected to be listed as a user")
+	}
+	send("hello from a socket")
+	ok := waitFor(func(f socketFrame) bool {
+		return f.Type == "message" && f.Message.From == "wsuser" && f.Message.Text == "hello from a socket"
+	})
+	if !ok {
+		t.Error("expected to receive the message as json")
+	}
+	send("/quit")
+	if waitFor(func(f socketFrame) bool { return false }) {
+		t.Error("expected the socket to be closed")
+	}
+}
+
+func TestPrivateMessageQueries(t *testing.T) {
+	if err := telnet.Register("pmvictim", "secret"); err != nil {
+		t.Fatal("could not register: ", err)
+	}
+	//Offline, so the message goes to the mailbox
+	if err := telnet.SendAs("pmsender", "", "pmvictim", "TOP SECRET"); err != nil {
+		t.Fatal("could not send pm: ", err)
+	}
+	if err := apikey.SetStatic([]string{"root:rootkey:admin"}); err != nil {
+		t.Fatal("could not set api keys: ", err)
+	}
+	defer apikey.SetStatic(nil)
+	//Logs in over http and returns the session token
+	login := func(username string) string {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/sessions", bytes.NewReader([]byte(`{"username":"`+username+`"}`)))
+		req.Header.Set("X-API-Key", "rootkey")
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, req)
+		var login struct{ Token string }
+		json.Unmarshal(w.Body.Bytes(), &login)
+		if login.Token == "" {
+			t.Fatal("expected to log in but got ", w.Body.String())
+		}
+		t.Cleanup(func() { telnet.Logout(username) })
+		return login.Token
+	}
+	sender := login("pmsender")
+	snoop := login("pmsnoop")
+
+	tests := []struct {
+		name   string
+		query  string
+		token  string
+		key    string
+		status int
+		shown  bool
+	}{
+		{"anonymous", "", "", "", http.StatusOK, false},
+		{"anonymous to", "?to=pmvictim", "", "", http.StatusUnauthorized, false},
+		{"other session", "", snoop, "", http.StatusOK, false},
+		{"other session to", "?to=pmvictim", snoop, "", http.StatusForbidden, false},
+		{"sender", "", sender, "", http.StatusOK, true},
+		{"admin to", "?to=pmvictim", "", "rootkey", http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/messages"+tt.query, nil)
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		w := httptest.NewRecorder()
+		getMessages(w, req)
+		if w.Code != tt.status || strings.Contains(w.Body.String(), "TOP SECRET") != tt.shown {
+			t.Errorf(tt.name+": expected %d shown %v but got %d %v", tt.status, tt.shown, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSessions(t *testing.T) {
+	//Sends a request with an optional session token
+	do := func(method string, path string, body string, token string) (int, string) {
+		req := httptest.NewRequest(method, path, bytes.NewReader([]byte(body)))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	status, body := do(http.MethodPost, "/api/v1/sessions", `{"username":"webby"}`, "")
+	if status != http.StatusCreated {
+		t.Fatalf("expected to log in but got %d %s", status, body)
+	}
+	var login struct{ Token, Username string }
+	json.Unmarshal([]byte(body), &login)
+	if login.Username != "webby" || login.Token == "" {
+		t.Fatal("expected a token but got ", body)
+	}
+	defer do(http.MethodDelete, "/api/v1/sessions", "", login.Token)
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		token    string
+		status   int
+		expected string
+	}{
+		{"name taken", http.MethodPost, "/api/v1/sessions", `{"username":"webby"}`, "", http.StatusConflict, `"code":"username_taken"`},
+		{"invalid name", http.MethodPost, "/api/v1/sessions", `{"username":"web by"}`, "", http.StatusBadRequest, `"code":"invalid_name"`},
+		{"inbox without session", http.MethodGet, "/api/v1/inbox", ``, "", http.StatusUnauthorized, `"code":"unauthorized"`},
+		{"inbox with bad token", http.MethodGet, "/api/v1/inbox", ``, "nope", http.StatusUnauthorized, `"code":"unauthorized"`},
+		{"send with bad token", http.MethodPost, "/submitMessage", `{"message":"hi"}`, "nope", http.StatusUnauthorized, `"code":"unauthorized"`},
+		{"listed as http", http.MethodGet, "/api/v1/users/webby", ``, "", http.StatusOK, `"online":true,"client":"http"`},
+		{"send as self", http.MethodPost, "/submitMessage", `{"message":"hi from webby"}`, login.Token, http.StatusOK, "Message submitted successfully"},
+		{"receive own message", http.MethodGet, "/api/v1/inbox?wait=1s", ``, login.Token, http.StatusOK, `"from":"webby","text":"hi from webby"`},
+		{"create channel", http.MethodPost, "/api/v1/channels", `{"name":"webchannel"}`, login.Token, http.StatusCreated, `"name":"webchannel","operators":["webby"]`},
+		{"join channel anonymously", http.MethodPut, "/api/v1/channels/webchannel/members/webby", ``, "", http.StatusUnauthorized, `"code":"unauthorized"`},
+		{"join channel as other user", http.MethodPut, "/api/v1/channels/webchannel/members/nobody", ``, login.Token, http.StatusForbidden, `"code":"forbidden"`},
+		{"join channel", http.MethodPut, "/api/v1/channels/webchannel/members/webby", ``, login.Token, http.StatusOK, `"members":["webby"]`},
+		{"send to channel", http.MethodPost, "/submitMessage", `{"channel":"webchannel", "message":"to the channel"}`, "", http.StatusOK, "Message submitted successfully"},
+		{"receive channel message", http.MethodGet, "/api/v1/inbox?wait=1s", ``, login.Token, http.StatusOK, `"from":"http","channel":"webchannel","text":"to the channel"`},
+		{"empty inbox", http.MethodGet, "/api/v1/inbox?wait=10ms", ``, login.Token, http.StatusOK, `[]`},
+		{"invalid wait", http.MethodGet, "/api/v1/inbox?wait=1h", ``, login.Token, http.StatusBadRequest, `"code":"invalid_duration"`},
+		{"close channel as user", http.MethodDelete, "/api/v1/channels/webchannel", ``, login.Token, http.StatusForbidden, `"code":"forbidden"`},
+	}
+	for _, tt := range tests {
+		status, body := do(tt.method, tt.path, tt.body, tt.token)
+		if status != tt.status || !strings.Contains(body, tt.expected) {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, status, body)
+		}
+	}
+
+	telnet.CloseChannel("webchannel", "tester")
+
+	//Logging out ends the session and frees the name
+	if status, body := do(http.MethodDelete, "/api/v1/sessions", "", login.Token); status != http.StatusNoContent {
+		t.Errorf("expected to log out but got %d %s", status, body)
+	}
+	if status, _ := do(http.MethodGet, "/api/v1/inbox", "", login.Token); status != http.StatusUnauthorized {
+		t.Errorf("expected the session to be gone but got %d", status)
+	}
+	if status, body := do(http.MethodGet, "/api/v1/users/webby", "", ""); status != http.StatusNotFound {
+		t.Errorf("expected the user to be gone but got %d %s", status, body)
+	}
+}
+
+func TestStaleSessionEnd(t *testing.T) {
+	//Logs in over http and returns the session
+	login := func() *session {
+		req := httptest.NewRequest(http.MethodPost, "/api/v1/sessions", bytes.NewReader([]byte(`{"username":"dup"}`)))
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, req)
+		var login struct{ Token string }
+		json.Unmarshal(w.Body.Bytes(), &login)
+		sessionsMu.Lock()
+		defer sessionsMu.Unlock()
+		s, ok := sessions[login.Token]
+		if !ok {
+			t.Fatal("expected to log in but got ", w.Body.String())
+		}
+		return s
+	}
+	stale := login()
+	if err := telnet.Kick("dup", ""); err != nil {
+		t.Fatal("could not kick: ", err)
+	}
+	fresh := login()
+	defer fresh.end()
+
+	//The kicked session expiring must not drop whoever has the name now
+	stale.end()
+	user, ok := telnet.OnlineUser("dup")
+	if !ok || user != fresh.user {
+		t.Error("expected the new dup to stay online")
+	}
+}
+
+func TestEditAndDeleteMessages(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/sessions", bytes.NewReader([]byte(`{"username":"editor"}`)))
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	var login struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &login)
+	if login.Token == "" {
+		t.Fatal("expected to log in but got ", w.Body.String())
+	}
+	defer telnet.Logout("editor")
+	//Sessions act as their user, so they may only change their own messages
+	if err := telnet.SendAs("http", "", "", "anonymous"); err != nil {
+		t.Fatal("could not send message: ", err)
+	}
+	if err := telnet.SendAs("editor", "", "", "hello"); err != nil {
+		t.Fatal("could not send message: ", err)
+	}
+	history := telnet.History()
+	other := strconv.FormatUint(history[len(history)-2].ID, 10)
+	own := strconv.FormatUint(history[len(history)-1].ID, 10)
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		postBody string
+		token    string
+		expected string
+	}{
+		{
+			"edit without session",
+			editMessage,
+			`{"id":` + own + `, "message":"hello again"}`,
+			"",
+			errorJSON("unauthorized", "log in first at /api/v1/sessions"),
+		},
+		{
+			"edit",
+			editMessage,
+			`{"id":` + own + `, "message":"hello again"}`,
+			login.Token,
+			"Message edited successfully",
+		},
+		{
+			"edit missing message",
+			editMessage,
+			`{"id":999, "message":"hello again"}`,
+			login.Token,
+			errorJSON("message_not_found", "message does not exist"),
+		},
+		{
+			"edit other message",
+			editMessage,
+			`{"id":` + other + `, "message":"mine now"}`,
+			login.Token,
+			errorJSON("not_author", "only the author or a channel operator can change this message"),
+		},
+		{
+			"delete without session",
+			deleteMessage,
+			`{"id":` + own + `}`,
+			"",
+			errorJSON("unauthorized", "log in first at /api/v1/sessions"),
+		},
+		{
+			"delete other message",
+			deleteMessage,
+			`{"id":` + other + `}`,
+			login.Token,
+			errorJSON("not_author", "only the author or a channel operator can change this message"),
+		},
+		{
+			"delete",
+			deleteMessage,
+			`{"id":` + own + `}`,
+			login.Token,
+			"Message deleted successfully",
+		},
+		{
+			"edit deleted message",
+			editMessage,
+			`{"id":` + own + `, "message":"hello again"}`,
+			login.Token,
+			errorJSON("message_deleted", "message was deleted"),
+		},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(tt.postBody)))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		tt.handler(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if string(data) != tt.expected {
+			t.Errorf(tt.name+": expected "+tt.expected+" but got %v", string(data))
+		}
+	}
+}
+
+func TestGetThread(t *testing.T) {
+	if err := telnet.Register("threadreader", "secret"); err != nil {
+		t.Fatal("could not register: ", err)
+	}
+	if err := telnet.SendAs("threadsender", "", "threadreader", "secret plans"); err != nil {
+		t.Fatal("could not send pm: ", err)
+	}
+	history := telnet.History()
+	pmID := history[len(history)-1].ID
+	tests := []struct {
+		name     string
+		query    string
+		status   int
+		expected string
+	}{
+		{"thread", "?id=1", http.StatusOK, `"id":1`},
+		{"invalid id", "?id=foo", http.StatusBadRequest, errorJSON("invalid_id", "invalid message id")},
+		{"missing message", "?id=999", http.StatusNotFound, errorJSON("message_not_found", "message does not exist")},
+		{"private message", "?id=" + strconv.FormatUint(pmID, 10), http.StatusNotFound, errorJSON("message_not_found", "message does not exist")},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/thread"+tt.query, nil)
+		w := httptest.NewRecorder()
+		getThread(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if res.StatusCode != tt.status || !bytes.Contains(data, []byte(tt.expected)) {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, res.StatusCode, string(data))
+		}
+	}
+}
+
+func TestBans(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  http.HandlerFunc
+		postBody string
+		status   int
+		expected string
+	}{
+		{"add ban", addBan, `{"target":"192.0.2.0/24", "duration":"1h", "reason":"spam"}`, http.StatusOK, "Ban added successfully"},
+		{"invalid target", addBan, `{"target":"foo"}`, http.StatusBadRequest, errorJSON("invalid_target", "invalid ip or network: foo")},
+		{"invalid duration", addBan, `{"target":"192.0.2.1", "duration":"soon"}`, http.StatusBadRequest, errorJSON("invalid_duration", "invalid duration: soon")},
+		{"list bans", getBans, ``, http.StatusOK, `"network":"192.0.2.0/24"`},
+		{"banned request", checkBan(getStats), ``, http.StatusForbidden, errorJSON("banned", "you are banned from this server")},
+		{"remove ban", removeBan, `{"target":"192.0.2.0/24"}`, http.StatusOK, "Ban removed successfully"},
+		{"unbanned request", checkBan(getStats), ``, http.StatusOK, `"users":0`},
+		{"remove missing ban", removeBan, `{"target":"192.0.2.0/24"}`, http.StatusNotFound, errorJSON("ban_not_found", "ban does not exist")},
+	}
+	for _, tt := range tests {
+		//httptest requests come from 192.0.2.1
+		req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(tt.postBody)))
+		w := httptest.NewRecorder()
+		tt.handler(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if res.StatusCode != tt.status || !bytes.Contains(data, []byte(tt.expected)) {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, res.StatusCode, string(data))
+		}
+	}
+}
+
+func TestBanAuth(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/api/v1/sessions", bytes.NewReader([]byte(`{"username":"notadmin"}`)))
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	var login struct{ Token string }
+	json.Unmarshal(w.Body.Bytes(), &login)
+	if login.Token == "" {
+		t.Fatal("expected to log in but got ", w.Body.String())
+	}
+	defer telnet.Logout("notadmin")
+	if err := apikey.SetStatic([]string{"stats:statskey:stats", "root:rootkey:admin"}); err != nil {
+		t.Fatal("could not set api keys: ", err)
+	}
+	defer apikey.SetStatic(nil)
+
+	//Bans need admin credentials even though keys are not required
+	tests := []struct {
+		name     string
+		path     string
+		key      string
+		token    string
+		status   int
+		expected string
+	}{
+		{"no credentials", "/bans", "", "", http.StatusUnauthorized, errorJSON("unauthorized", "admin credentials missing")},
+		{"no credentials add", "/addBan", "", "", http.StatusUnauthorized, errorJSON("unauthorized", "admin credentials missing")},
+		{"no credentials remove", "/removeBan", "", "", http.StatusUnauthorized, errorJSON("unauthorized", "admin credentials missing")},
+		{"wrong key", "/bans", "nokey", "", http.StatusUnauthorized, errorJSON("unauthorized", "invalid api key")},
+		{"stats key", "/bans", "statskey", "", http.StatusForbidden, errorJSON("forbidden", "api key does not have the admin scope")},
+		{"user session", "/bans", "", login.Token, http.StatusForbidden, errorJSON("forbidden", "permission denied")},
+		{"admin key", "/bans", "rootkey", "", http.StatusOK, `[]`},
+	}
+	for _, tt := range tests {
+		method := http.MethodPost
+		if tt.path == "/bans" {
+			method = http.MethodGet
+		}
+		req := httptest.NewRequest(method, tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, req)
+		if w.Code != tt.status || w.Body.String() != tt.expected {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, w.Code, w.Body.String())
+		}
+	}
+
+	//Once keys are set they are needed without REQUIRE_API_KEY
+	req = httptest.NewRequest(http.MethodGet, "/stats", nil)
+	w = httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a key to be needed but got %d %v", w.Code, w.Body.String())
+	}
+}
+
+func TestAcceptLanguage(t *testing.T) {
+	if err := locale.Load("../locales"); err != nil {
+		t.Fatal("could not load translations: ", err)
+	}
+	defer locale.Load("")
+	tests := []struct {
+		name     string
+		language string
+		postBody string
+		expected string
+	}{
+		{"spanish", "es-ES,es;q=0.9", `{"message":"hola"}`, "Mensaje enviado correctamente"},
+		{"spanish error", "es", `{"message":"hola", "type":"shout"}`, errorJSON("invalid_type", "tipo de mensaje desconocido: shout")},
+		{"unsupported", "fr", `{"message":"salut"}`, "Message submitted successfully"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/submitMessage", bytes.NewReader([]byte(tt.postBody)))
+		req.Header.Set("Accept-Language", tt.language)
+		w := httptest.NewRecorder()
+		submitMessage(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if string(data) != tt.expected {
+			t.Errorf(tt.name+": expected "+tt.expected+" but got %v", string(data))
+		}
+	}
+}
+
+func TestChannelsAPI(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		body     string
+		status   int
+		expected string
+	}{
+		{"create", http.MethodPost, "/api/v1/channels", `{"name":"apichannel", "topic":"api things"}`, http.StatusCreated, `{"name":"apichannel","topic":"api things","operators":[],"members":[]}`},
+		{"create taken", http.MethodPost, "/api/v1/channels", `{"name":"APIchannel"}`, http.StatusConflict, errorJSON("channel_exists", "channel already exists")},
+		{"create invalid", http.MethodPost, "/api/v1/channels", `{"name":"api channel"}`, http.StatusBadRequest, errorJSON("invalid_name", "name can not contain ' '")},
+		{"list", http.MethodGet, "/api/v1/channels", ``, http.StatusOK, `[{"name":"apichannel","topic":"api things","operators":[],"members":[]}]`},
+		{"get", http.MethodGet, "/api/v1/channels/apichannel", ``, http.StatusOK, `{"name":"apichannel","topic":"api things","operators":[],"members":[]}`},
+		{"get missing", http.MethodGet, "/api/v1/channels/nochannel", ``, http.StatusNotFound, errorJSON("channel_not_found", "channel does not exist")},
+		{"members", http.MethodGet, "/api/v1/channels/apichannel/members", ``, http.StatusOK, `[]`},
+		{"join without credentials", http.MethodPut, "/api/v1/channels/apichannel/members/nobody", ``, http.StatusUnauthorized, errorJSON("unauthorized", "admin credentials missing")},
+		{"leave offline user", http.MethodDelete, "/api/v1/channels/apichannel/members/nobody", ``, http.StatusNotFound, errorJSON("user_offline", "user is not online")},
+		{"wrong method", http.MethodPatch, "/api/v1/channels/apichannel", ``, http.StatusMethodNotAllowed, errorJSON("method_not_allowed", "method not allowed")},
+		{"unknown path", http.MethodGet, "/api/v1/channels/apichannel/owners", ``, http.StatusNotFound, errorJSON("not_found", "not found")},
+		{"delete", http.MethodDelete, "/api/v1/channels/apichannel", ``, http.StatusNoContent, ""},
+		{"delete missing", http.MethodDelete, "/api/v1/channels/apichannel", ``, http.StatusNotFound, errorJSON("channel_not_found", "channel does not exist")},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader([]byte(tt.body)))
+		w := httptest.NewRecorder()
+		channelsAPI(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if res.StatusCode != tt.status || string(data) != tt.expected {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, res.StatusCode, string(data))
+		}
+	}
+}
+
+func TestUsersAPI(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		status   int
+		expected string
+	}{
+		{"list", http.MethodGet, "/api/v1/users", http.StatusOK, `[]`},
+		{"get missing", http.MethodGet, "/api/v1/users/nobody", http.StatusNotFound, errorJSON("user_not_found", "user does not exist")},
+		{"delete offline", http.MethodDelete, "/api/v1/users/nobody", http.StatusNotFound, errorJSON("user_offline", "user is not online")},
+		{"wrong method", http.MethodPost, "/api/v1/users", http.StatusMethodNotAllowed, errorJSON("method_not_allowed", "method not allowed")},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+		usersAPI(w, req)
+		res := w.Result()
+		defer res.Body.Close()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if res.StatusCode != tt.status || string(data) != tt.expected {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, res.StatusCode, string(data))
+		}
+	}
+}
+
+func TestIncomingHooks(t *testing.T) {
+	if err := telnet.CreateChannel("hookchannel", "tester"); err != nil {
+		t.Fatal("could not create channel: ", err)
+	}
+	if err := telnet.Register("hookowner", "secret"); err != nil {
+		t.Fatal("could not register: ", err)
+	}
+	if err := incoming.SetStatic([]string{"alerts:hookchannel:t0ken", "lost:nochannel:l0st"}); err != nil {
+		t.Fatal("could not set incoming webhooks: ", err)
+	}
+	defer incoming.SetStatic(nil)
+	received := make(chan telnet.Event, 10)
+	unsubscribe := telnet.Subscribe(func(e telnet.Event) {
+		if e.Type == telnet.EventMessage && e.Channel == "hookchannel" {
+			received <- e
+		}
+	})
+	defer unsubscribe()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		expected    string
+		from        string
+		text        string
+	}{
+		{"slack payload", http.MethodPost, "/api/v1/hooks/t0ken", "application/json", `{"text":"build &lt;ok&gt;","channel":"#other","username":"ci-bot","icon_emoji":":ghost:"}`, http.StatusOK, "ok", "ci-bot", "build <ok>"},
+		{"form payload", http.MethodPost, "/api/v1/hooks/t0ken", "application/x-www-form-urlencoded", `payload=%7B%22text%22%3A%22deployed%22%7D`, http.StatusOK, "ok", "alerts", "deployed"},
+		{"unknown token", http.MethodPost, "/api/v1/hooks/nope", "application/json", `{"text":"hi"}`, http.StatusNotFound, errorJSON("not_found", "not found"), "", ""},
+		{"wrong method", http.MethodGet, "/api/v1/hooks/t0ken", "", ``, http.StatusMethodNotAllowed, errorJSON("method_not_allowed", "method not allowed"), "", ""},
+		{"empty text", http.MethodPost, "/api/v1/hooks/t0ken", "application/json", `{"text":" "}`, http.StatusBadRequest, errorJSON("empty_message", "message can not be empty"), "", ""},
+		{"invalid json", http.MethodPost, "/api/v1/hooks/t0ken", "application/json", `{"text"}`, http.StatusBadRequest, errorJSON("invalid_json", "invalid character '}' after object key"), "", ""},
+		{"reserved username", http.MethodPost, "/api/v1/hooks/t0ken", "application/json", `{"text":"hi","username":"http"}`, http.StatusBadRequest, errorJSON("invalid_name", "name http is reserved"), "", ""},
+		{"user's name", http.MethodPost, "/api/v1/hooks/t0ken", "application/json", `{"text":"hi","username":"hookowner"}`, http.StatusBadRequest, errorJSON("invalid_name", "name hookowner belongs to a user"), "", ""},
+		{"user's name in capitals", http.MethodPost, "/api/v1/hooks/t0ken", "application/json", `{"text":"hi","username":"HookOwner"}`, http.StatusBadRequest, errorJSON("invalid_name", "name HookOwner belongs to a user"), "", ""},
+		{"look-alike of user's name", http.MethodPost, "/api/v1/hooks/t0ken", "application/json", `{"text":"hi","username":"h00kowner"}`, http.StatusBadRequest, errorJSON("invalid_name", "name h00kowner belongs to a user"), "", ""},
+		{"missing channel", http.MethodPost, "/api/v1/hooks/l0st", "application/json", `{"text":"hi"}`, http.StatusNotFound, errorJSON("channel_not_found", "channel does not exist"), "", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			req.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		http.DefaultServeMux.ServeHTTP(w, req)
+		res := w.Result()
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			t.Errorf("Error: %v", err)
+		}
+		if res.StatusCode != tt.status || string(data) != tt.expected {
+			t.Errorf(tt.name+": expected %d "+tt.expected+" but got %d %v", tt.status, res.StatusCode, string(data))
+		}
+		if tt.text == "" {
+			continue
+		}
+		select {
+		case e := <-received:
+			if e.User != tt.from || e.Text != tt.text {
+				t.Errorf(tt.name+": expected message from %s: %s but got %s: %s", tt.from, tt.text, e.User, e.Text)
+			}
+		case <-time.After(time.Second):
+			t.Error(tt.name + ": message was not sent")
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	//A failed and a timed request to see in the output
+	for _, path := range []string{"/stats", "/nope"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/users"+path, nil)
+		http.DefaultServeMux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, req)
+	res := w.Result()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Errorf("Error: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || res.Header.Get("Content-Type") != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("expected 200 text/plain but got %d %s", res.StatusCode, res.Header.Get("Content-Type"))
+	}
+	for _, want := range []string{
+		"# TYPE http_request_duration_seconds histogram",
+		`http_request_duration_seconds_count{handler="/api/v1/users/",method="GET",code="404"}`,
+		`http_errors_total{code="user_not_found"}`,
+		`chat_messages_total{kind="message",target="channel"}`,
+		`chat_channel_messages_total{channel="hookchannel"} 2`,
+		`chat_channel_members{channel="hookchannel"} 0`,
+		"# TYPE chat_users_online gauge",
+		"http_requests_in_flight 1",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("metrics missing: %s", want)
+		}
+	}
+}
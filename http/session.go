@@ -0,0 +1,273 @@
+package http
+
+import (
+	"chatservice/locale"
+	"chatservice/telnet"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxQueued = 1000 // Frames kept for a session that is not polling. The oldest are dropped first
+const maxWait = time.Minute
+
+// A logged in http client. It is a chat user like any other, with a connection that
+// queues what it is sent until the client polls for it
+type session struct {
+	token    string
+	username string
+	user     *telnet.User
+	conn     *pollConn
+	timer    *time.Timer // Logs the session out once it expires
+}
+
+var sessions = map[string]*session{} // Map of tokens to sessions
+var sessionsMu sync.Mutex
+
+type loginPost struct {
+	Username string
+	Password string // Only needed for registered users
+}
+
+// The connection of an http session
+type pollConn struct {
+	addr   pollAddr
+	mu     sync.Mutex
+	queue  []socketFrame
+	ready  chan struct{} // Signalled when a frame is queued
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Address of the client that logged in
+type pollAddr string
+
+func (a pollAddr) Network() string { return "tcp" }
+func (a pollAddr) String() string  { return string(a) }
+
+// Routes /api/v1/sessions. POST logs in, DELETE logs out
+func sessionsAPI(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	switch r.Method {
+	case http.MethodPost:
+		login(w, r, lang)
+	case http.MethodDelete:
+		s, ok := requireSession(w, r, lang)
+		if !ok {
+			return
+		}
+		s.end()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, lang, "POST, DELETE")
+	}
+}
+
+// Logs in as a chat user and returns the token for later requests
+func login(w http.ResponseWriter, r *http.Request, lang string) {
+	var req loginPost
+	if !decodeBody(w, r, lang, &req) {
+		return
+	}
+	//Registered names are let through since they may predate the name rules
+	if !telnet.Registered(req.Username) {
+		if err := telnet.CheckUsername(req.Username); err != nil {
+			writeError(w, lang, http.StatusBadRequest, codeInvalidName, err)
+			return
+		}
+	}
+	conn := &pollConn{addr: pollAddr(r.RemoteAddr), ready: make(chan struct{}, 1), closed: make(chan struct{})}
+	user, err := telnet.Login(conn, req.Username, req.Password)
+	if err != nil {
+		//Anything else is a connection limit
+		writeError(w, lang, http.StatusServiceUnavailable, codeServerBusy, err)
+		return
+	}
+	token := make([]byte, 32)
+	_, err = rand.Read(token)
+	if err != nil {
+		user.Logout()
+		writeError(w, lang, http.StatusInternalServerError, codeInternal, err)
+		return
+	}
+	s := &session{token: hex.EncodeToString(token), username: user.Username(), user: user, conn: conn}
+	s.timer = time.AfterFunc(getSettings().sessionTimeout, s.end)
+	sessionsMu.Lock()
+	sessions[s.token] = s
+	sessionsMu.Unlock()
+	writeJSON(w, http.StatusCreated, map[string]string{"token": s.token, "username": s.username})
+}
+
+// Returns the session of a request with an "Authorization: Bearer <token>" header and
+// keeps it alive. Returns nil if there is no such header
+func requestSession(r *http.Request) (*session, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil, nil
+	}
+	sessionsMu.Lock()
+	s, ok := sessions[token]
+	sessionsMu.Unlock()
+	if !ok {
+		return nil, locale.Errorf("invalid or expired session")
+	}
+	//The user may have been kicked or dropped since the last request
+	select {
+	case <-s.conn.closed:
+		s.end()
+		return nil, locale.Errorf("invalid or expired session")
+	default:
+	}
+	s.timer.Reset(getSettings().sessionTimeout)
+	return s, nil
+}
+
+// Like requestSession but writes an error response if the request has no valid session
+func requireSession(w http.ResponseWriter, r *http.Request, lang string) (*session, bool) {
+	s, err := requestSession(r)
+	if err == nil && s == nil {
+		err = locale.Errorf("log in first at /api/v1/sessions")
+	}
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		writeError(w, lang, http.StatusUnauthorized, codeUnauthorized, err)
+		return nil, false
+	}
+	return s, true
+}
+
+// Logs the session out
+func (s *session) end() {
+	sessionsMu.Lock()
+	_, ok := sessions[s.token]
+	delete(sessions, s.token)
+	sessionsMu.Unlock()
+	if ok {
+		s.timer.Stop()
+		s.user.Logout()
+		s.conn.Close()
+	}
+}
+
+// Returns what was sent to the user since the last poll. Waits up to ?wait= (default
+// 30s, at most a minute) for something to arrive when nothing is queued
+func getInbox(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	s, ok := requireSession(w, r, lang)
+	if !ok {
+		return
+	}
+	wait := 30 * time.Second
+	if r.URL.Query().Has("wait") {
+		d, err := time.ParseDuration(r.URL.Query().Get("wait"))
+		if err != nil || d < 0 || d > maxWait {
+			writeError(w, lang, http.StatusBadRequest, codeInvalidDuration, locale.Errorf("invalid duration: %s", r.URL.Query().Get("wait")))
+			return
+		}
+		wait = d
+	}
+	writeJSON(w, http.StatusOK, s.conn.take(r, wait))
+}
+
+// Waits until a frame is queued, the wait passes or the request is cancelled, then
+// returns and clears the queue
+func (c *pollConn) take(r *http.Request, wait time.Duration) []socketFrame {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			frames := c.queue
+			c.queue = nil
+			c.mu.Unlock()
+			return frames
+		}
+		c.mu.Unlock()
+		select {
+		case <-c.ready:
+		case <-timer.C:
+			return []socketFrame{}
+		case <-c.closed:
+			return []socketFrame{}
+		case <-r.Context().Done():
+			return []socketFrame{}
+		}
+	}
+}
+
+// Adds a frame to the queue and wakes up a waiting poll
+func (c *pollConn) push(f socketFrame) error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+	}
+	c.mu.Lock()
+	c.queue = append(c.queue, f)
+	if len(c.queue) > maxQueued {
+		c.queue = c.queue[len(c.queue)-maxQueued:]
+	}
+	c.mu.Unlock()
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Http sessions send no input through the connection, reads wait until it is closed
+func (c *pollConn) Read(p []byte) (int, error) {
+	<-c.closed
+	return 0, io.EOF
+}
+
+// Queues server output as a text frame
+func (c *pollConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	err := c.push(socketFrame{Type: "text", Text: strings.TrimRight(string(p), "\r\n")})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Queues a chat message
+func (c *pollConn) WriteMessage(m telnet.Message) error {
+	return c.push(socketFrame{Type: "message", Message: &m})
+}
+
+// The client is checked by its polls so there is nothing to send
+func (c *pollConn) Ping() error {
+	select {
+	case <-c.closed:
+		return net.ErrClosed
+	default:
+		return nil
+	}
+}
+
+// Http sessions are marked as http in /listusers
+func (c *pollConn) Client() string {
+	return "http"
+}
+
+// Closes the connection, ending the users read go routine
+func (c *pollConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *pollConn) RemoteAddr() net.Addr { return c.addr }
+func (c *pollConn) LocalAddr() net.Addr  { return pollAddr("http") }
+
+// Sessions expire through their timer so deadlines are not used
+func (c *pollConn) SetDeadline(t time.Time) error      { return nil }
+func (c *pollConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *pollConn) SetWriteDeadline(t time.Time) error { return nil }
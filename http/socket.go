@@ -0,0 +1,119 @@
+package http
+
+import (
+	"bytes"
+	"chatservice/telnet"
+	"chatservice/websocket"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// A frame sent to WebSocket clients. Server output such as prompts and command
+// results is "text", chat messages are "message"
+type socketFrame struct {
+	Type    string          `json:"type"`
+	Text    string          `json:"text,omitempty"`
+	Message *telnet.Message `json:"message,omitempty"`
+}
+
+// Lets a WebSocket client use the chat like a telnet user. Each text frame from the
+// client is one line of input and everything sent back is a json socketFrame
+type socketConn struct {
+	ws      *websocket.Conn
+	pending []byte // Input not read yet
+}
+
+// Upgrades a request to a WebSocket and logs the client in as a chat user
+func chatSocket(w http.ResponseWriter, r *http.Request) {
+	ws, err := websocket.Upgrade(w, r)
+	if err != nil {
+		log.Printf("websocket upgrade failed for: %s. err: %s", r.RemoteAddr, err)
+		return
+	}
+	telnet.ServeConn(&socketConn{ws: ws})
+}
+
+// Reads input one line at a time. Every frame is a line of its own
+func (c *socketConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		_, data, err := c.ws.ReadMessage()
+		if err != nil {
+			return 0, err
+		}
+		c.pending = append(bytes.TrimRight(data, "\r\n"), '\n')
+	}
+	end := bytes.IndexByte(c.pending, '\n') + 1
+	n := copy(p, c.pending[:end])
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+// Sends server output as a text frame
+func (c *socketConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	err := c.writeFrame(socketFrame{Type: "text", Text: strings.TrimRight(string(p), "\r\n")})
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Sends a chat message as a message frame
+func (c *socketConn) WriteMessage(m telnet.Message) error {
+	return c.writeFrame(socketFrame{Type: "message", Message: &m})
+}
+
+// Encodes and sends a frame
+func (c *socketConn) writeFrame(f socketFrame) error {
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return c.ws.WriteMessage(websocket.OpText, data)
+}
+
+// Sends a WebSocket ping
+func (c *socketConn) Ping() error {
+	return c.ws.Ping()
+}
+
+// WebSocket users are marked as websocket in /listusers
+func (c *socketConn) Client() string {
+	return "websocket"
+}
+
+// Closes the WebSocket
+func (c *socketConn) Close() error {
+	return c.ws.Close()
+}
+
+// Returns the address of the client
+func (c *socketConn) RemoteAddr() net.Addr {
+	return c.ws.RemoteAddr()
+}
+
+// Returns the address of the server
+func (c *socketConn) LocalAddr() net.Addr {
+	return c.ws.LocalAddr()
+}
+
+// Sets the read and write deadlines
+func (c *socketConn) SetDeadline(t time.Time) error {
+	return c.ws.SetDeadline(t)
+}
+
+// Sets the read deadline used for login and idle timeouts
+func (c *socketConn) SetReadDeadline(t time.Time) error {
+	return c.ws.SetReadDeadline(t)
+}
+
+// Sets the write deadline
+func (c *socketConn) SetWriteDeadline(t time.Time) error {
+	return c.ws.SetWriteDeadline(t)
+}
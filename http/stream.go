@@ -0,0 +1,154 @@
+package http
+
+import (
+	"chatservice/locale"
+	"chatservice/telnet"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const streamBuffer = 256 // Messages held for a slow stream before it is closed
+
+var streamKeepAlive = 30 * time.Second // How often an idle stream gets a comment to keep proxies from closing it
+
+// Which messages a stream sends. With neither field set it sends every message that is not private
+type streamFilter struct {
+	channel string
+	user    string // Private messages to this user
+}
+
+// Checks if a message belongs in the stream
+func (f streamFilter) matches(m telnet.Message) bool {
+	switch {
+	case f.channel != "":
+		return m.Channel == f.channel
+	case f.user != "":
+		return m.To == f.user
+	default:
+		return m.To == ""
+	}
+}
+
+// Streams messages as Server-Sent Events. ?channel= streams a channel, ?user= the private
+// messages to a user, which needs that user's session or admin credentials, neither
+// streams everything else. Each event has the message id so a
+// client that reconnects with Last-Event-ID gets the messages it missed from the history
+func streamMessages(w http.ResponseWriter, r *http.Request) {
+	lang := requestLang(w, r)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, lang, http.StatusInternalServerError, codeInternal, locale.Errorf("streaming is not supported"))
+		return
+	}
+	filter := streamFilter{channel: r.URL.Query().Get("channel"), user: r.URL.Query().Get("user")}
+	if filter.channel != "" {
+		if !telnet.ChannelExists(filter.channel) {
+			writeError(w, lang, http.StatusNotFound, codeChannelNotFound, telnet.ErrNoChannel)
+			return
+		}
+	} else if filter.user != "" {
+		if err := telnet.CheckUsername(filter.user); err != nil {
+			writeError(w, lang, http.StatusBadRequest, codeInvalidName, err)
+			return
+		}
+		s, err := requestSession(r)
+		if err != nil {
+			writeError(w, lang, http.StatusUnauthorized, codeUnauthorized, err)
+			return
+		}
+		if s == nil || s.username != filter.user {
+			if status, code, err := checkAdmin(r); err != nil {
+				writeError(w, lang, status, code, err)
+				return
+			}
+		}
+	}
+	var lastID uint64
+	resume := r.Header.Get("Last-Event-ID")
+	if resume != "" {
+		id, err := strconv.ParseUint(resume, 10, 64)
+		if err != nil {
+			writeError(w, lang, http.StatusBadRequest, codeInvalidID, locale.Errorf("invalid message id"))
+			return
+		}
+		lastID = id
+	}
+
+	//Subscribe before reading the history so nothing sent in between is lost.
+	//A client too slow to keep up is disconnected and resumes from the history
+	messages := make(chan telnet.Message, streamBuffer)
+	lagged := make(chan struct{})
+	var lag sync.Once
+	unsubscribe := telnet.Subscribe(func(e telnet.Event) {
+		if e.Type != telnet.EventMessage {
+			return
+		}
+		m, ok := telnet.GetMessage(e.ID)
+		if !ok || !filter.matches(m) {
+			return
+		}
+		select {
+		case messages <- m:
+		default:
+			lag.Do(func() { close(lagged) })
+		}
+	})
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if resume != "" {
+		missed := telnet.QueryMessages(telnet.MessageQuery{After: lastID, Channel: filter.channel, To: filter.user})
+		for _, m := range missed.Messages {
+			if filter.matches(m) && writeEvent(w, m) != nil {
+				return
+			}
+			lastID = m.ID
+		}
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-lagged:
+			log.Printf("closing message stream for: %s. client is too slow", r.RemoteAddr)
+			return
+		case <-keepAlive.C:
+			_, err := w.Write([]byte(": keep-alive\n\n"))
+			if err != nil {
+				return
+			}
+		case m := <-messages:
+			if m.ID <= lastID {
+				continue
+			}
+			if writeEvent(w, m) != nil {
+				return
+			}
+			lastID = m.ID
+		}
+		flusher.Flush()
+	}
+}
+
+// Writes a message as a Server-Sent Event
+func writeEvent(w http.ResponseWriter, m telnet.Message) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		log.Println("json marshelling error: ", err)
+		return nil
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: message\ndata: %s\n\n", m.ID, data)
+	return err
+}
@@ -0,0 +1,163 @@
+package incoming
+
+import (
+	"chatservice/atomicfile"
+	"chatservice/locale"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An incoming webhook that posts into one channel. Only a hash of its token is kept
+type Hook struct {
+	Name    string    `json:"name"` // Sender of messages that do not set a username
+	Channel string    `json:"channel"`
+	Hash    string    `json:"hash"`
+	Created time.Time `json:"created"`
+	By      string    `json:"by,omitempty"`
+	Config  bool      `json:"-"` // Set in the config instead of the hook file. Can not be removed
+}
+
+var hooks = []Hook{}  // Hooks added with Add
+var static = []Hook{} // Hooks from the config
+var hookFile string
+var mu sync.Mutex
+
+var ErrNotFound = locale.Errorf("incoming webhook does not exist") // Returned when removing a hook that does not exist
+
+// Loads hooks from a json file. Hooks added later are saved to the same file
+func Load(filepath string) error {
+	loaded := []Hook{}
+	contents, err := os.ReadFile(filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 {
+		err = json.Unmarshal(contents, &loaded)
+		if err != nil {
+			return err
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	hooks = loaded
+	hookFile = filepath
+	log.Printf("loaded %d incoming webhooks", len(loaded))
+	return nil
+}
+
+// Replaces the hooks set in the config. Each entry is "name:channel:token"
+func SetStatic(entries []string) error {
+	loaded := []Hook{}
+	for _, entry := range entries {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return locale.Errorf("incoming webhooks must look like name:channel:token")
+		}
+		loaded = append(loaded, Hook{Name: parts[0], Channel: parts[1], Hash: hash(parts[2]), Config: true})
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	static = loaded
+	return nil
+}
+
+// Writes the hooks to the hook file if there is one. mu must be held
+func save() error {
+	if hookFile == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(hooks, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(hookFile, contents, 0600)
+}
+
+// Hashes a token for storing
+func hash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Creates a hook posting into a channel and returns its token. The token can not be shown again
+func Add(name string, channel string, by string) (string, error) {
+	if name == "" || channel == "" {
+		return "", locale.Errorf("incoming webhooks need a name and a channel")
+	}
+	random := make([]byte, 24)
+	_, err := rand.Read(random)
+	if err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(random)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, h := range all() {
+		if h.Name == name {
+			return "", locale.Errorf("incoming webhook already exists")
+		}
+	}
+	hooks = append(hooks, Hook{Name: name, Channel: channel, Hash: hash(token), Created: time.Now().UTC(), By: by})
+	err = save()
+	if err != nil {
+		hooks = hooks[:len(hooks)-1]
+		return "", err
+	}
+	log.Printf("incoming webhook: %s for channel: %s added by: %s", name, channel, by)
+	return token, nil
+}
+
+// Removes a hook by its name
+func Remove(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, h := range static {
+		if h.Name == name {
+			return locale.Errorf("incoming webhook is set in the config")
+		}
+	}
+	for i, h := range hooks {
+		if h.Name == name {
+			hooks = append(hooks[:i], hooks[i+1:]...)
+			log.Printf("incoming webhook removed: %s", name)
+			return save()
+		}
+	}
+	return ErrNotFound
+}
+
+// Returns all hooks, config hooks first
+func List() []Hook {
+	mu.Lock()
+	defer mu.Unlock()
+	return all()
+}
+
+// Returns a copy of all hooks. mu must be held
+func all() []Hook {
+	return append(append([]Hook{}, static...), hooks...)
+}
+
+// Finds the hook matching a token
+func Check(token string) (Hook, bool) {
+	if token == "" {
+		return Hook{}, false
+	}
+	h := []byte(hash(token))
+	mu.Lock()
+	defer mu.Unlock()
+	for _, hook := range all() {
+		if subtle.ConstantTimeCompare(h, []byte(hook.Hash)) == 1 {
+			return hook, true
+		}
+	}
+	return Hook{}, false
+}
@@ -0,0 +1,67 @@
+package incoming
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hooks.json")
+	require.NoError(t, Load(path))
+	defer Load("")
+	require.NoError(t, SetStatic([]string{"alerts:ops:t0ken"}))
+	defer SetStatic(nil)
+
+	_, err := Add("", "ops", "tester")
+	assert.EqualError(t, err, "incoming webhooks need a name and a channel")
+	_, err = Add("alerts", "ops", "tester")
+	assert.EqualError(t, err, "incoming webhook already exists")
+
+	token, err := Add("ci", "builds", "tester")
+	require.NoError(t, err)
+
+	tests := []struct {
+		token   string
+		name    string
+		channel string
+	}{
+		{"t0ken", "alerts", "ops"},
+		{token, "ci", "builds"},
+	}
+	for _, tt := range tests {
+		h, ok := Check(tt.token)
+		require.True(t, ok, tt.name)
+		assert.Equal(t, tt.name, h.Name)
+		assert.Equal(t, tt.channel, h.Channel)
+	}
+	_, ok := Check("wrong")
+	assert.False(t, ok)
+	_, ok = Check("")
+	assert.False(t, ok)
+
+	//Hooks are saved hashed and survive a reload
+	require.NoError(t, Load(path))
+	_, ok = Check(token)
+	assert.True(t, ok)
+	for _, h := range List() {
+		assert.NotEqual(t, token, h.Hash)
+	}
+
+	assert.EqualError(t, Remove("alerts"), "incoming webhook is set in the config")
+	assert.NoError(t, Remove("ci"))
+	assert.Equal(t, ErrNotFound, Remove("ci"))
+	_, ok = Check(token)
+	assert.False(t, ok)
+	assert.Len(t, List(), 1)
+}
+
+func TestSetStatic(t *testing.T) {
+	defer SetStatic(nil)
+	assert.EqualError(t, SetStatic([]string{"notoken"}), "incoming webhooks must look like name:channel:token")
+	assert.EqualError(t, SetStatic([]string{"a:ops:"}), "incoming webhooks must look like name:channel:token")
+	assert.NoError(t, SetStatic([]string{"a:ops:b", "c:dev:d"}))
+	assert.Len(t, List(), 2)
+}
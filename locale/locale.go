@@ -0,0 +1,198 @@
+package locale
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Language the server strings are written in. The english text is the key for every translation
+const English = "en"
+
+var catalogues = map[string]map[string]string{} // Map of languages to their translations
+var defaultLang = English                       // Language used when none is picked
+var mu sync.RWMutex
+
+// An error whose message can be translated. Format is the catalogue key
+type Error struct {
+	Format string
+	Args   []any
+}
+
+// Creates an error whose message can be translated
+func Errorf(format string, args ...any) error {
+	return &Error{Format: format, Args: args}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf(e.Format, e.Args...)
+}
+
+// Loads translations from a directory of json files named after their language, e.g. es.json.
+// Each file maps the english text to its translation
+func Load(dir string) error {
+	loaded := map[string]map[string]string{}
+	if dir != "" {
+		files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			contents, err := os.ReadFile(file)
+			if err != nil {
+				return err
+			}
+			catalogue := map[string]string{}
+			err = json.Unmarshal(contents, &catalogue)
+			if err != nil {
+				return errors.New("invalid translation file " + file + ": " + err.Error())
+			}
+			lang := normalize(strings.TrimSuffix(filepath.Base(file), ".json"))
+			loaded[lang] = catalogue
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	catalogues = loaded
+	log.Printf("loaded %d translations", len(loaded))
+	return nil
+}
+
+// Sets the language used when none is picked. Must be english or a loaded language
+func SetDefault(lang string) error {
+	lang = normalize(lang)
+	if lang == "" {
+		lang = English
+	}
+	if !Supported(lang) {
+		return errors.New("unknown language: " + lang)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	defaultLang = lang
+	return nil
+}
+
+// Returns the language used when none is picked
+func Default() string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return defaultLang
+}
+
+// Checks if there are translations for a language
+func Supported(lang string) bool {
+	lang = normalize(lang)
+	if lang == English {
+		return true
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	_, ok := catalogues[lang]
+	return ok
+}
+
+// Returns the supported language to use for a language tag. Regional tags like es-MX
+// fall back to their base language
+func Resolve(lang string) (string, bool) {
+	lang = normalize(lang)
+	if Supported(lang) {
+		return lang, true
+	}
+	if base, _, ok := strings.Cut(lang, "-"); ok && Supported(base) {
+		return base, true
+	}
+	return "", false
+}
+
+// Returns all languages that can be picked, sorted
+func Languages() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	langs := []string{English}
+	for lang := range catalogues {
+		if lang != English {
+			langs = append(langs, lang)
+		}
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+// Translates text into a language. An empty language is the default language.
+// Text without a translation is returned as is
+func T(lang string, text string) string {
+	mu.RLock()
+	defer mu.RUnlock()
+	lang = normalize(lang)
+	if lang == "" {
+		lang = defaultLang
+	}
+	if translated, ok := catalogues[lang][text]; ok && translated != "" {
+		return translated
+	}
+	return text
+}
+
+// Translates a format string into a language and fills it in with args
+func Tf(lang string, format string, args ...any) string {
+	return fmt.Sprintf(T(lang, format), args...)
+}
+
+// Translates the message of an error. Errors that are not an *Error are looked up by their text
+func TranslateError(lang string, err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return Tf(lang, e.Format, e.Args...)
+	}
+	return T(lang, err.Error())
+}
+
+// Picks the best supported language from an Accept-Language header. Returns the default
+// language if none of them are supported
+func Match(acceptLanguage string) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	choices := []choice{}
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if tag == "" || q <= 0 {
+			continue
+		}
+		choices = append(choices, choice{normalize(tag), q})
+	}
+	sort.SliceStable(choices, func(i, j int) bool {
+		return choices[i].q > choices[j].q
+	})
+	for _, c := range choices {
+		if c.lang == "*" {
+			break
+		}
+		if lang, ok := Resolve(c.lang); ok {
+			return lang
+		}
+	}
+	return Default()
+}
+
+// Lowercases a language tag and uses - as the separator, e.g. pt_BR becomes pt-br
+func normalize(lang string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(lang)), "_", "-")
+}
@@ -0,0 +1,89 @@
+package locale
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTranslate(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "es.json"), []byte(`{
+		"channel does not exist": "el canal no existe",
+		"Joined channel: %s": "Te uniste al canal: %s"
+	}`), 0600))
+	assert.NoError(t, Load(dir))
+	defer Load("")
+
+	assert.Equal(t, "el canal no existe", T("es", "channel does not exist"))
+	assert.Equal(t, "el canal no existe", T("ES", "channel does not exist"))
+	assert.Equal(t, "no translation", T("es", "no translation"))
+	assert.Equal(t, "channel does not exist", T("fr", "channel does not exist"))
+	assert.Equal(t, "Te uniste al canal: foo", Tf("es", "Joined channel: %s", "foo"))
+
+	//Errors
+	assert.Equal(t, "el canal no existe", TranslateError("es", errors.New("channel does not exist")))
+	err := Errorf("Joined channel: %s", "foo")
+	assert.EqualError(t, err, "Joined channel: foo")
+	assert.Equal(t, "Te uniste al canal: foo", TranslateError("es", err))
+
+	//Default language
+	assert.Equal(t, "channel does not exist", T("", "channel does not exist"))
+	assert.Error(t, SetDefault("fr"))
+	assert.NoError(t, SetDefault("es"))
+	assert.Equal(t, "el canal no existe", T("", "channel does not exist"))
+	assert.NoError(t, SetDefault(""))
+	assert.Equal(t, English, Default())
+}
+
+func TestMatch(t *testing.T) {
+	dir := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "es.json"), []byte(`{}`), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "pt-BR.json"), []byte(`{}`), 0600))
+	assert.NoError(t, Load(dir))
+	defer Load("")
+
+	assert.Equal(t, []string{"en", "es", "pt-br"}, Languages())
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"es", "es"},
+		{"es-MX,es;q=0.9", "es"},
+		{"fr-CH, fr;q=0.9, es;q=0.5", "es"},
+		{"de;q=0.2, pt-BR;q=0.8", "pt-br"},
+		{"es;q=0, en", "en"},
+		{"fr, *;q=0.5", "en"},
+		{"es;q=bad", "en"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, Match(tt.header), tt.header)
+	}
+	lang, ok := Resolve("es_AR")
+	assert.True(t, ok)
+	assert.Equal(t, "es", lang)
+	_, ok = Resolve("fr")
+	assert.False(t, ok)
+}
+
+// Checks that the shipped translations keep the format verbs of the english text
+func TestShippedTranslations(t *testing.T) {
+	files, err := filepath.Glob("../locales/*.json")
+	assert.NoError(t, err)
+	verbs := regexp.MustCompile(`%[a-z]`)
+	for _, file := range files {
+		contents, err := os.ReadFile(file)
+		assert.NoError(t, err)
+		catalogue := map[string]string{}
+		assert.NoError(t, json.Unmarshal(contents, &catalogue), file)
+		for key, translated := range catalogue {
+			assert.Equal(t, verbs.FindAllString(key, -1), verbs.FindAllString(translated, -1), file+": "+key)
+		}
+	}
+}
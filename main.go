@@ -1,9 +1,15 @@
 package main
 
 import (
+	"chatservice/apikey"
+	"chatservice/ban"
 	"chatservice/config"
 	"chatservice/http"
+	"chatservice/incoming"
+	"chatservice/locale"
+	"chatservice/plugin"
 	"chatservice/telnet"
+	"chatservice/webhook"
 	"log"
 	"os"
 	"os/signal"
@@ -11,9 +17,11 @@ import (
 	"syscall"
 )
 
+const configFile = "./config.env"
+
 func main() {
 	//Load config
-	cfg, err := config.LoadConfig("./config.env")
+	cfg, err := config.LoadConfig(configFile)
 	if err != nil {
 		log.Fatalf("Could not load config file. Err: %s", err)
 	}
@@ -26,10 +34,73 @@ func main() {
 
 	log.SetOutput(f)
 
+	//Load registered accounts and their mailboxes
+	if cfg.AccountsFile != "" {
+		err = telnet.LoadAccounts(cfg.AccountsFile)
+		if err != nil {
+			log.Fatalf("Could not load accounts file. Err: %s", err)
+		}
+	}
+	if cfg.PrefsFile != "" {
+		err = telnet.LoadPrefs(cfg.PrefsFile)
+		if err != nil {
+			log.Fatalf("Could not load preferences file. Err: %s", err)
+		}
+	}
+	err = telnet.LoadMailboxes(cfg.MailboxFile, cfg.MailboxLimit)
+	if err != nil {
+		log.Fatalf("Could not load mailbox file. Err: %s", err)
+	}
+
+	//Load banned ips
+	if cfg.BanFile != "" {
+		err = ban.Load(cfg.BanFile)
+		if err != nil {
+			log.Fatalf("Could not load ban file. Err: %s", err)
+		}
+	}
+
+	//Load api keys for the http server
+	err = loadAPIKeys(cfg)
+	if err != nil {
+		log.Fatalf("Could not load api keys. Err: %s", err)
+	}
+
+	//Load incoming webhooks
+	err = loadIncomingHooks(cfg)
+	if err != nil {
+		log.Fatalf("Could not load incoming webhooks. Err: %s", err)
+	}
+
+	//Load translations
+	err = loadLocales(cfg)
+	if err != nil {
+		log.Fatalf("Could not load translations. Err: %s", err)
+	}
+
+	//Load message history
+	if cfg.HistoryFile != "" {
+		err = telnet.LoadHistory(cfg.HistoryFile)
+		if err != nil {
+			log.Fatalf("Could not load history file. Err: %s", err)
+		}
+	}
+
 	// Create shut down channel and signal for clean closure
 	shutdown := make(chan os.Signal, 1)
 	signal.Notify(shutdown, syscall.SIGINT, syscall.SIGTERM)
 
+	//Let admins shut down and reload the server
+	telnet.Shutdown = func() {
+		select {
+		case shutdown <- syscall.SIGTERM:
+		default:
+		}
+	}
+	telnet.Reload = func() error {
+		return reloadConfig(configFile)
+	}
+
 	//Wait group to ensure telnet server is running before http server spins up
 	wg := sync.WaitGroup{}
 	wg.Add(1)
@@ -37,5 +108,90 @@ func main() {
 	go telnet.InitTelnetServer(cfg, shutdown, &wg)
 	wg.Wait()
 	go http.InitHttpServer(cfg)
+	//Start external plugins
+	if cfg.PluginFile != "" {
+		plugins, err := plugin.LoadConfig(cfg.PluginFile)
+		if err != nil {
+			log.Fatalf("Could not load plugin file. Err: %s", err)
+		}
+		host := plugin.Start(plugins)
+		defer host.Stop()
+	}
+	//Start outgoing webhooks
+	if cfg.WebhookFile != "" {
+		hooks, err := webhook.LoadConfig(cfg.WebhookFile)
+		if err != nil {
+			log.Fatalf("Could not load webhook file. Err: %s", err)
+		}
+		host := webhook.Start(hooks, cfg.WebhookLog)
+		defer host.Stop()
+	}
 	<-shutdown
 }
+
+// Reloads the config file and applies the settings that can change while running
+func reloadConfig(filepath string) error {
+	cfg, err := config.ReloadConfig(filepath)
+	if err != nil {
+		return err
+	}
+	telnet.ApplyConfig(cfg)
+	http.ApplyConfig(cfg)
+	if cfg.BanFile != "" {
+		err = ban.Load(cfg.BanFile)
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.AccountsFile != "" {
+		err = telnet.LoadAccounts(cfg.AccountsFile)
+		if err != nil {
+			return err
+		}
+	}
+	err = loadAPIKeys(cfg)
+	if err != nil {
+		return err
+	}
+	err = loadIncomingHooks(cfg)
+	if err != nil {
+		return err
+	}
+	err = loadLocales(cfg)
+	if err != nil {
+		return err
+	}
+	log.Printf("config reloaded")
+	return nil
+}
+
+// Loads the translation files and sets the default language
+func loadLocales(cfg config.Config) error {
+	err := locale.Load(cfg.LocaleDir)
+	if err != nil {
+		return err
+	}
+	return locale.SetDefault(cfg.DefaultLang)
+}
+
+// Loads the api keys saved by admins and the ones set in the config
+func loadAPIKeys(cfg config.Config) error {
+	if cfg.APIKeyFile != "" {
+		err := apikey.Load(cfg.APIKeyFile)
+		if err != nil {
+			return err
+		}
+	}
+	return apikey.SetStatic(cfg.APIKeys)
+}
+
+// Loads the incoming webhooks saved by admins and the ones set in the config
+func loadIncomingHooks(cfg config.Config) error {
+	if cfg.IncomingHookFile != "" {
+		err := incoming.Load(cfg.IncomingHookFile)
+		if err != nil {
+			return err
+		}
+	}
+	return incoming.SetStatic(cfg.IncomingHooks)
+}
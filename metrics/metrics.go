@@ -0,0 +1,343 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets in seconds for request latencies
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// A metric that can write itself in the Prometheus text format
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+var registry = map[string]collector{}
+var registryMu sync.Mutex
+
+// Adds a metric to the registry. Names must be unique
+func register(name string, c collector) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		panic("metric registered twice: " + name)
+	}
+	registry[name] = c
+}
+
+// Writes every metric in the Prometheus text exposition format, sorted by name
+func Write(w io.Writer) error {
+	registryMu.Lock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	collectors := make([]collector, 0, len(registry))
+	sort.Strings(names)
+	for _, name := range names {
+		collectors = append(collectors, registry[name])
+	}
+	registryMu.Unlock()
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Values of one set of labels
+type series struct {
+	labels []string
+	value  float64
+}
+
+// Labeled values shared by counters and gauges
+type family struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	mu     sync.Mutex
+	values map[string]*series
+}
+
+// Creates a family and registers it. Metrics without labels start at 0
+func newFamily(name string, help string, kind string, labels []string) *family {
+	f := &family{name: name, help: help, kind: kind, labels: labels, values: map[string]*series{}}
+	if len(labels) == 0 {
+		f.values[""] = &series{}
+	}
+	register(name, f)
+	return f
+}
+
+// Returns the series for label values, creating it. f.mu must be held
+func (f *family) get(values []string) *series {
+	if len(values) != len(f.labels) {
+		panic("metric " + f.name + " needs " + strconv.Itoa(len(f.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+	s, ok := f.values[key]
+	if !ok {
+		s = &series{labels: append([]string{}, values...)}
+		f.values[key] = s
+	}
+	return s
+}
+
+// Adds to the value for label values
+func (f *family) add(v float64, values []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.get(values).value += v
+}
+
+// Returns the value for label values
+func (f *family) Value(values ...string) float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.get(values).value
+}
+
+// Returns the sum of the values for every set of labels
+func (f *family) Sum() float64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := 0.0
+	for _, s := range f.values {
+		sum += s.value
+	}
+	return sum
+}
+
+// Removes the value for label values, e.g. when a channel is closed
+func (f *family) Delete(values ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.values, strings.Join(values, "\xff"))
+}
+
+func (f *family) write(w *bufio.Writer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	writeHeader(w, f.name, f.help, f.kind)
+	keys := make([]string, 0, len(f.values))
+	for key := range f.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := f.values[key]
+		writeSample(w, f.name, f.labels, s.labels, s.value)
+	}
+}
+
+// A value that only goes up, such as messages sent
+type Counter struct {
+	*family
+}
+
+// Creates and registers a counter with the given label names
+func NewCounter(name string, help string, labels ...string) *Counter {
+	return &Counter{newFamily(name, help, "counter", labels)}
+}
+
+// Adds one for label values
+func (c *Counter) Inc(values ...string) {
+	c.add(1, values)
+}
+
+// Adds v for label values. v can not be negative
+func (c *Counter) Add(v float64, values ...string) {
+	if v < 0 {
+		panic("counter " + c.name + " can not go down")
+	}
+	c.add(v, values)
+}
+
+// A value that goes up and down, such as open connections
+type Gauge struct {
+	*family
+}
+
+// Creates and registers a gauge with the given label names
+func NewGauge(name string, help string, labels ...string) *Gauge {
+	return &Gauge{newFamily(name, help, "gauge", labels)}
+}
+
+// Sets the value for label values
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.get(values).value = v
+}
+
+// Adds one for label values
+func (g *Gauge) Inc(values ...string) {
+	g.add(1, values)
+}
+
+// Takes one away for label values
+func (g *Gauge) Dec(values ...string) {
+	g.add(-1, values)
+}
+
+// A metric read from a function when metrics are written
+type funcMetric struct {
+	name  string
+	help  string
+	kind  string
+	label string
+	f     func() map[string]float64
+}
+
+// Registers a gauge whose value is read from f
+func NewGaugeFunc(name string, help string, f func() float64) {
+	register(name, &funcMetric{name: name, help: help, kind: "gauge", f: func() map[string]float64 {
+		return map[string]float64{"": f()}
+	}})
+}
+
+// Registers a counter whose value is read from f. f must never return less than before
+func NewCounterFunc(name string, help string, f func() float64) {
+	register(name, &funcMetric{name: name, help: help, kind: "counter", f: func() map[string]float64 {
+		return map[string]float64{"": f()}
+	}})
+}
+
+// Registers a gauge with one label whose values are read from f, e.g. members per channel
+func NewGaugeMapFunc(name string, help string, label string, f func() map[string]float64) {
+	register(name, &funcMetric{name: name, help: help, kind: "gauge", label: label, f: f})
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, m.name, m.help, m.kind)
+	values := m.f()
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if m.label == "" {
+			writeSample(w, m.name, nil, nil, values[key])
+		} else {
+			writeSample(w, m.name, []string{m.label}, []string{key}, values[key])
+		}
+	}
+}
+
+// Counts observations such as request latencies into buckets
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	mu      sync.Mutex
+	values  map[string]*histSeries
+}
+
+// Observations of one set of labels
+type histSeries struct {
+	labels []string
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Creates and registers a histogram with upper bounds for its buckets, smallest first
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{name: name, help: help, labels: labels, buckets: buckets, values: map[string]*histSeries{}}
+	register(name, h)
+	return h
+}
+
+// Records an observation for label values
+func (h *Histogram) Observe(v float64, values ...string) {
+	if len(values) != len(h.labels) {
+		panic("metric " + h.name + " needs " + strconv.Itoa(len(h.labels)) + " label values")
+	}
+	key := strings.Join(values, "\xff")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.values[key]
+	if !ok {
+		s = &histSeries{labels: append([]string{}, values...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = s
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			s.counts[i]++
+			break
+		}
+	}
+	s.count++
+	s.sum += v
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	writeHeader(w, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	labels := append(append([]string{}, h.labels...), "le")
+	for _, key := range keys {
+		s := h.values[key]
+		cumulative := uint64(0)
+		for i, bound := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", labels, append(append([]string{}, s.labels...), formatValue(bound)), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", labels, append(append([]string{}, s.labels...), "+Inf"), float64(s.count))
+		writeSample(w, h.name+"_sum", h.labels, s.labels, s.sum)
+		writeSample(w, h.name+"_count", h.labels, s.labels, float64(s.count))
+	}
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+// Writes the HELP and TYPE lines of a metric
+func writeHeader(w *bufio.Writer, name string, help string, kind string) {
+	w.WriteString("# HELP " + name + " " + helpEscaper.Replace(help) + "\n")
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+// Writes one sample line, name{label="value",...} value
+func writeSample(w *bufio.Writer, name string, labels []string, values []string, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			w.WriteString(label + `="` + labelEscaper.Replace(values[i]) + `"`)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteString(" " + formatValue(v) + "\n")
+}
+
+// Formats a value the way Prometheus reads it
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	logins := NewCounter("test_logins_total", "Logins by result", "client", "result")
+	logins.Inc("telnet", "ok")
+	logins.Inc("telnet", "ok")
+	logins.Add(3, "http", `bad "password"`)
+	sent := NewCounter("test_sent_total", "Messages sent\nby anyone")
+	queued := NewGauge("test_queued", "Queued frames", "queue")
+	queued.Inc("a")
+	queued.Inc("a")
+	queued.Dec("a")
+	queued.Set(7, "b")
+	NewGaugeFunc("test_open", "Open things", func() float64 { return 2 })
+	NewGaugeMapFunc("test_members", "Members per channel", "channel", func() map[string]float64 {
+		return map[string]float64{"foo": 1, "bar": 3}
+	})
+	latency := NewHistogram("test_latency_seconds", "Latency", []float64{0.1, 1}, "path")
+	latency.Observe(0.05, "/a")
+	latency.Observe(0.5, "/a")
+	latency.Observe(5, "/a")
+
+	assert.Equal(t, 2.0, logins.Value("telnet", "ok"))
+	assert.Equal(t, 5.0, logins.Sum())
+	assert.Equal(t, 0.0, sent.Sum())
+	assert.Panics(t, func() { logins.Inc("telnet") })
+	assert.Panics(t, func() { sent.Add(-1) })
+	assert.Panics(t, func() { NewCounter("test_sent_total", "again") })
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf))
+	for _, want := range []string{
+		"# HELP test_logins_total Logins by result\n# TYPE test_logins_total counter\n" +
+			`test_logins_total{client="http",result="bad \"password\""} 3` + "\n" +
+			`test_logins_total{client="telnet",result="ok"} 2` + "\n",
+		"# HELP test_sent_total Messages sent\\nby anyone\n# TYPE test_sent_total counter\ntest_sent_total 0\n",
+		"# TYPE test_queued gauge\n" + `test_queued{queue="a"} 1` + "\n" + `test_queued{queue="b"} 7` + "\n",
+		"# TYPE test_open gauge\ntest_open 2\n",
+		`test_members{channel="bar"} 3` + "\n" + `test_members{channel="foo"} 1` + "\n",
+		"# TYPE test_latency_seconds histogram\n" +
+			`test_latency_seconds_bucket{path="/a",le="0.1"} 1` + "\n" +
+			`test_latency_seconds_bucket{path="/a",le="1"} 2` + "\n" +
+			`test_latency_seconds_bucket{path="/a",le="+Inf"} 3` + "\n" +
+			`test_latency_seconds_sum{path="/a"} 5.55` + "\n" +
+			`test_latency_seconds_count{path="/a"} 3` + "\n",
+	} {
+		assert.Contains(t, buf.String(), want)
+	}
+
+	logins.Delete("http", `bad "password"`)
+	assert.Equal(t, 2.0, logins.Sum())
+}
+
+func TestFormatValue(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{1.5, "1.5"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+		{math.NaN(), "NaN"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, formatValue(tt.v))
+	}
+}
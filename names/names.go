@@ -0,0 +1,103 @@
+package names
+
+import (
+	"chatservice/locale"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Rules a username or channel name must follow
+type Rules struct {
+	MinLength int      // Shortest name in characters. Names can never be empty
+	MaxLength int      // Longest name in characters. 0 means no limit
+	ASCIIOnly bool     // Only allow a-z, A-Z and 0-9 besides the allowed punctuation
+	Reserved  []string // Names nobody can take. Names that look like them are refused too
+}
+
+// Punctuation allowed in names. Anything else, like spaces or "|", would break the message format
+const punctuation = "_-."
+
+// Letters from other scripts that look like latin letters, mapped to the latin letter
+var confusables = map[rune]rune{
+	'а': 'a', 'в': 'b', 'е': 'e', 'к': 'k', 'м': 'm', 'н': 'h', 'о': 'o', 'р': 'p', 'с': 'c',
+	'т': 't', 'у': 'y', 'х': 'x', 'ѕ': 's', 'і': 'i', 'ј': 'j', 'ԁ': 'd', 'ԛ': 'q', 'ԝ': 'w',
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O', 'Р': 'P', 'С': 'C',
+	'Т': 'T', 'Х': 'X', 'Ѕ': 'S', 'І': 'l', 'Ј': 'J',
+	'α': 'a', 'ε': 'e', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u',
+	'χ': 'x', 'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'l', 'Κ': 'K', 'Μ': 'M',
+	'Ν': 'N', 'Ο': 'O', 'Ρ': 'P', 'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+	'ı': 'i', 'ɡ': 'g', 'ɑ': 'a', 'ℓ': 'l',
+	'I': 'l', '1': 'l', '0': 'O',
+}
+
+// Checks a name against the rules. Does not check if the name is taken
+func (r Rules) Check(name string) error {
+	length := utf8.RuneCountInString(name)
+	if length == 0 {
+		return locale.Errorf("name can not be empty")
+	}
+	if length < r.MinLength {
+		return locale.Errorf("name must be at least %d characters", r.MinLength)
+	}
+	if r.MaxLength > 0 && length > r.MaxLength {
+		return locale.Errorf("name must be at most %d characters", r.MaxLength)
+	}
+	for _, c := range name {
+		if !r.allowed(c) {
+			return locale.Errorf("name can not contain %q", c)
+		}
+	}
+	if mixesScripts(name) {
+		return locale.Errorf("name can not mix letters from different alphabets")
+	}
+	for _, reserved := range r.Reserved {
+		if Same(name, reserved) {
+			return locale.Errorf("name %s is reserved", name)
+		}
+	}
+	return nil
+}
+
+// Checks if a character can be used in a name
+func (r Rules) allowed(c rune) bool {
+	if strings.ContainsRune(punctuation, c) {
+		return true
+	}
+	if r.ASCIIOnly {
+		return c < utf8.RuneSelf && (unicode.IsLetter(c) || unicode.IsDigit(c))
+	}
+	return unicode.IsLetter(c) || unicode.IsDigit(c) || unicode.Is(unicode.Mn, c)
+}
+
+// Checks if a name uses letters from more than one of the alphabets whose letters look alike
+func mixesScripts(name string) bool {
+	scripts := 0
+	for _, script := range []*unicode.RangeTable{unicode.Latin, unicode.Cyrillic, unicode.Greek} {
+		if strings.IndexFunc(name, func(c rune) bool { return unicode.Is(script, c) }) >= 0 {
+			scripts++
+		}
+	}
+	return scripts > 1
+}
+
+// Returns the form of a name used to compare it with other names. Names with the same
+// skeleton differ only in characters that look alike, e.g. "bob", "b0b" and "ｂｏｂ"
+func Skeleton(name string) string {
+	var b strings.Builder
+	for _, c := range name {
+		if latin, ok := confusables[c]; ok {
+			c = latin
+		} else if c >= 'Ａ' && c <= 'ｚ' { //Fullwidth latin letters
+			c = c - 'Ａ' + 'A'
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return strings.ReplaceAll(b.String(), "rn", "m")
+}
+
+// Checks if two names would be mistaken for each other because they only differ in case or
+// in characters that look alike
+func Same(a string, b string) bool {
+	return strings.EqualFold(a, b) || Skeleton(a) == Skeleton(b)
+}
@@ -0,0 +1,60 @@
+package names
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheck(t *testing.T) {
+	rules := Rules{MinLength: 2, MaxLength: 8, Reserved: []string{"http"}}
+	tests := []struct {
+		name string
+		err  string
+	}{
+		{"alice", ""},
+		{"bob_2.0-", ""},
+		{"żółw", ""},
+		{"", "name can not be empty"},
+		{"a", "name must be at least 2 characters"},
+		{"abcdefghi", "name must be at most 8 characters"},
+		{"a b", `name can not contain ' '`},
+		{"a|b", `name can not contain '|'`},
+		{"a\tb", `name can not contain '\t'`},
+		{"HTTP", "name HTTP is reserved"},
+		{"h11p", ""},
+		{"ht7p", ""},
+		{"раypal", "name can not mix letters from different alphabets"},
+	}
+	for _, tt := range tests {
+		err := rules.Check(tt.name)
+		if tt.err == "" {
+			assert.NoError(t, err, tt.name)
+		} else {
+			assert.EqualError(t, err, tt.err, tt.name)
+		}
+	}
+	ascii := Rules{ASCIIOnly: true}
+	assert.NoError(t, ascii.Check("alice"))
+	assert.EqualError(t, ascii.Check("żółw"), `name can not contain 'ż'`)
+}
+
+func TestSame(t *testing.T) {
+	tests := []struct {
+		a    string
+		b    string
+		same bool
+	}{
+		{"alice", "ALICE", true},
+		{"bob", "b0b", true},
+		{"bill", "biII", true},
+		{"modern", "modem", true},
+		{"alice", "аlice", true}, //Cyrillic а
+		{"ｂｏｂ", "bob", true},
+		{"alice", "alicia", false},
+		{"bill", "bili", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.same, Same(tt.a, tt.b), tt.a+" "+tt.b)
+	}
+}
@@ -0,0 +1,309 @@
+package plugin
+
+import (
+	"bufio"
+	"chatservice/metrics"
+	"chatservice/telnet"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Permissions a plugin can be granted
+const (
+	PermSend  = "send"
+	PermKick  = "kick"
+	PermTopic = "topic"
+)
+
+const (
+	queueSize     = 256              // Events buffered per plugin before they are dropped
+	minBackoff    = time.Second      // Wait before the first restart of a crashed plugin
+	maxBackoff    = 30 * time.Second // Longest wait between restarts
+	stableRuntime = time.Minute      // Run time after which a plugin is considered healthy again
+	maxActionSize = 1024 * 1024      // Longest action line a plugin can send
+)
+
+// Metrics for /metrics
+var (
+	queueDepth    = metrics.NewGauge("chat_plugin_queue_depth", "Events waiting to be written to each plugin", "plugin")
+	eventsDropped = metrics.NewCounter("chat_plugin_events_dropped_total", "Events dropped because a plugin was too far behind", "plugin")
+)
+
+// Config for a single plugin as read from the plugin file
+type Config struct {
+	Name        string   `json:"name"`
+	Command     string   `json:"command"`
+	Args        []string `json:"args"`
+	Env         []string `json:"env"`
+	Permissions []string `json:"permissions"`
+	Events      []string `json:"events"` // Event types to send, empty means all
+}
+
+// Action sent by a plugin on its stdout
+type Action struct {
+	Action  string `json:"action"`
+	Channel string `json:"channel"`
+	User    string `json:"user"`
+	Text    string `json:"text"`
+	Reason  string `json:"reason"`
+	Topic   string `json:"topic"`
+}
+
+// A running plugin process
+type Plugin struct {
+	cfg    Config
+	events chan telnet.Event
+	stop   chan bool
+	done   chan bool
+
+	mu  sync.Mutex
+	cmd *exec.Cmd
+}
+
+// Manages all configured plugins
+type Host struct {
+	plugins     []*Plugin
+	unsubscribe func()
+}
+
+// Reads the plugin file. It is a json list of plugin configs
+func LoadConfig(filepath string) ([]Config, error) {
+	contents, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []Config
+	err = json.Unmarshal(contents, &cfgs)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cfgs {
+		if c.Name == "" {
+			return nil, errors.New("plugin name missing")
+		}
+		if c.Command == "" {
+			return nil, errors.New("plugin command missing for: " + c.Name)
+		}
+	}
+	return cfgs, nil
+}
+
+// Starts all plugins and subscribes them to server events
+func Start(cfgs []Config) *Host {
+	h := &Host{}
+	for _, c := range cfgs {
+		p := &Plugin{
+			cfg:    c,
+			events: make(chan telnet.Event, queueSize),
+			stop:   make(chan bool),
+			done:   make(chan bool),
+		}
+		h.plugins = append(h.plugins, p)
+		go p.run()
+	}
+	h.unsubscribe = telnet.Subscribe(h.dispatch)
+	log.Printf("started %d plugins", len(h.plugins))
+	return h
+}
+
+// Stops all plugins and waits for them to exit
+func (h *Host) Stop() {
+	h.unsubscribe()
+	for _, p := range h.plugins {
+		close(p.stop)
+		p.kill()
+	}
+	for _, p := range h.plugins {
+		<-p.done
+	}
+}
+
+// Queues an event for every plugin that wants it. Drops the event if a plugin is too far behind
+func (h *Host) dispatch(e telnet.Event) {
+	for _, p := range h.plugins {
+		if !p.wants(e.Type) {
+			continue
+		}
+		select {
+		case p.events <- e:
+		default:
+			eventsDropped.Inc(p.cfg.Name)
+			log.Printf("plugin: %s event queue full, dropping %s event", p.cfg.Name, e.Type)
+		}
+		queueDepth.Set(float64(len(p.events)), p.cfg.Name)
+	}
+}
+
+// Checks if the plugin subscribed to an event type
+func (p *Plugin) wants(eventType string) bool {
+	if len(p.cfg.Events) == 0 {
+		return true
+	}
+	for _, t := range p.cfg.Events {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the plugin was granted a permission
+func (p *Plugin) allowed(perm string) bool {
+	for _, granted := range p.cfg.Permissions {
+		if granted == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// Keeps the plugin process running, restarting it with backoff when it crashes
+func (p *Plugin) run() {
+	defer close(p.done)
+	backoff := minBackoff
+	for {
+		started := time.Now()
+		err := p.runOnce()
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+		if time.Since(started) > stableRuntime {
+			backoff = minBackoff
+		}
+		log.Printf("plugin: %s exited. err: %v. restarting in %v", p.cfg.Name, err, backoff)
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Runs the plugin process until it exits
+func (p *Plugin) runOnce() error {
+	cmd := exec.Command(p.cfg.Command, p.cfg.Args...)
+	cmd.Env = append(os.Environ(), p.cfg.Env...)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.cmd = cmd
+	p.mu.Unlock()
+	//Stop may have been called before the process was tracked
+	select {
+	case <-p.stop:
+		p.kill()
+	default:
+	}
+	log.Printf("plugin: %s started. pid: %d", p.cfg.Name, cmd.Process.Pid)
+
+	//Write events until the process exits
+	exited := make(chan bool)
+	go p.writeEvents(stdin, exited)
+	p.readActions(stdout)
+	//Reading stops at EOF or a bad line. Kill the process so a plugin blocked writing
+	//to an undrained stdout can not hang Wait
+	p.kill()
+	err = cmd.Wait()
+	close(exited)
+
+	p.mu.Lock()
+	p.cmd = nil
+	p.mu.Unlock()
+	return err
+}
+
+// Kills the plugin process if it is running
+func (p *Plugin) kill() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd != nil && p.cmd.Process != nil {
+		p.cmd.Process.Kill()
+	}
+}
+
+// Writes queued events to the plugin as line delimited json
+func (p *Plugin) writeEvents(stdin io.WriteCloser, exited <-chan bool) {
+	defer stdin.Close()
+	enc := json.NewEncoder(stdin)
+	for {
+		select {
+		case <-exited:
+			return
+		case e := <-p.events:
+			queueDepth.Set(float64(len(p.events)), p.cfg.Name)
+			err := enc.Encode(e)
+			if err != nil {
+				log.Printf("plugin: %s unable to write event. err: %s", p.cfg.Name, err)
+				return
+			}
+		}
+	}
+}
+
+// Reads line delimited json actions from the plugin until its stdout closes or it
+// sends a line longer than maxActionSize
+func (p *Plugin) readActions(stdout io.Reader) {
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxActionSize)
+	for scanner.Scan() {
+		var a Action
+		err := json.Unmarshal(scanner.Bytes(), &a)
+		if err != nil {
+			log.Printf("plugin: %s sent invalid action. err: %s", p.cfg.Name, err)
+			continue
+		}
+		err = p.handleAction(a)
+		if err != nil {
+			log.Printf("plugin: %s action %s failed. err: %s", p.cfg.Name, a.Action, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("plugin: %s unable to read actions. err: %s", p.cfg.Name, err)
+	}
+}
+
+// Performs an action if the plugin has permission for it
+func (p *Plugin) handleAction(a Action) error {
+	switch a.Action {
+	case "send":
+		if !p.allowed(PermSend) {
+			return errors.New("permission denied")
+		}
+		return telnet.SendAs(p.cfg.Name, a.Channel, a.User, a.Text)
+	case "kick":
+		if !p.allowed(PermKick) {
+			return errors.New("permission denied")
+		}
+		return telnet.Kick(a.User, a.Reason)
+	case "topic":
+		if !p.allowed(PermTopic) {
+			return errors.New("permission denied")
+		}
+		return telnet.SetTopic(a.Channel, a.Topic, p.cfg.Name)
+	default:
+		return errors.New("unknown action")
+	}
+}
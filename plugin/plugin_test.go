@@ -0,0 +1,144 @@
+package plugin
+
+import (
+	"bufio"
+	"chatservice/telnet"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Runs as the plugin process when the test binary is launched by a plugin host
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	//Crash on the first start to exercise restarts
+	marker := os.Getenv("CRASH_MARKER")
+	if marker != "" {
+		if _, err := os.Stat(marker); err != nil {
+			os.WriteFile(marker, []byte("crashed"), 0666)
+			os.Exit(1)
+		}
+	}
+	//Send a line too long to read on the first start, then hang without reading events
+	marker = os.Getenv("LONG_LINE_MARKER")
+	if marker != "" {
+		if _, err := os.Stat(marker); err != nil {
+			os.WriteFile(marker, []byte("sent"), 0666)
+			fmt.Println(`{"action":"send","text":"` + strings.Repeat("a", 2*maxActionSize) + `"}`)
+			select {}
+		}
+	}
+	//Reply pong to every ping
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		var e telnet.Event
+		json.Unmarshal(scanner.Bytes(), &e)
+		if e.Type == telnet.EventMessage && e.Text == "ping" {
+			fmt.Println(`{"action":"send","text":"pong"}`)
+		}
+	}
+	os.Exit(0)
+}
+
+func helperConfig(name string, env ...string) Config {
+	return Config{
+		Name:        name,
+		Command:     os.Args[0],
+		Args:        []string{"-test.run=TestHelperProcess"},
+		Env:         append([]string{"GO_WANT_HELPER_PROCESS=1"}, env...),
+		Permissions: []string{PermSend},
+		Events:      []string{telnet.EventMessage},
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "plugins.json")
+	os.WriteFile(path, []byte(`[{"name":"foo","command":"/bin/cat","permissions":["send"]}]`), 0666)
+
+	cfgs, err := LoadConfig(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", cfgs[0].Name)
+	assert.Equal(t, []string{"send"}, cfgs[0].Permissions)
+
+	os.WriteFile(path, []byte(`[{"name":"foo"}]`), 0666)
+	_, err = LoadConfig(path)
+	assert.Error(t, err)
+}
+
+func TestPluginRoundTrip(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "crashed")
+	host := Start([]Config{helperConfig("pongbot", "CRASH_MARKER="+marker)})
+	defer host.Stop()
+
+	pongs := make(chan telnet.Event, 10)
+	unsubscribe := telnet.Subscribe(func(e telnet.Event) {
+		if e.User == "pongbot" {
+			pongs <- e
+		}
+	})
+	defer unsubscribe()
+
+	//Keep pinging until the restarted plugin answers
+	timeout := time.After(10 * time.Second)
+	for {
+		telnet.SendAs("tester", "", "", "ping")
+		select {
+		case e := <-pongs:
+			assert.Equal(t, "pong", e.Text)
+			_, err := os.Stat(marker)
+			assert.NoError(t, err, "plugin should have crashed and restarted")
+			return
+		case <-time.After(200 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("plugin never replied")
+		}
+	}
+}
+
+func TestLongActionLine(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "sent")
+	host := Start([]Config{helperConfig("longbot", "LONG_LINE_MARKER="+marker)})
+	defer host.Stop()
+
+	pongs := make(chan telnet.Event, 10)
+	unsubscribe := telnet.Subscribe(func(e telnet.Event) {
+		if e.User == "longbot" {
+			pongs <- e
+		}
+	})
+	defer unsubscribe()
+
+	//The plugin that sent the long line is killed and restarted
+	timeout := time.After(10 * time.Second)
+	for {
+		telnet.SendAs("tester", "", "", "ping")
+		select {
+		case e := <-pongs:
+			assert.Equal(t, "pong", e.Text)
+			_, err := os.Stat(marker)
+			assert.NoError(t, err, "plugin should have sent the long line first")
+			return
+		case <-time.After(200 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("plugin was not restarted")
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	p := &Plugin{cfg: Config{Name: "limited", Permissions: []string{PermSend}}}
+
+	assert.NoError(t, p.handleAction(Action{Action: "send", Text: "hello"}))
+	assert.EqualError(t, p.handleAction(Action{Action: "kick", User: "foo"}), "permission denied")
+	assert.EqualError(t, p.handleAction(Action{Action: "topic", Channel: "foo"}), "permission denied")
+	assert.EqualError(t, p.handleAction(Action{Action: "dance"}), "unknown action")
+}
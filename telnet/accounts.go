@@ -0,0 +1,147 @@
+package telnet
+
+import (
+	"chatservice/atomicfile"
+	"chatservice/names"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const hashRounds = 10000 // Rounds of sha256 applied to passwords
+
+// A registered user. Registered users log in with a password
+type Account struct {
+	Username string    `json:"username"`
+	Salt     string    `json:"salt"`
+	Hash     string    `json:"hash"`
+	Created  time.Time `json:"created"`
+	Admin    bool      `json:"admin,omitempty"` // Server admin
+}
+
+var accounts = map[string]*Account{}
+var accountsFile string
+var accountsMu sync.Mutex
+
+// Loads registered accounts from a json file. New accounts are saved to the same file
+func LoadAccounts(filepath string) error {
+	loaded := map[string]*Account{}
+	contents, err := os.ReadFile(filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 {
+		err = json.Unmarshal(contents, &loaded)
+		if err != nil {
+			return err
+		}
+	}
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	accounts = loaded
+	accountsFile = filepath
+	log.Printf("loaded %d accounts", len(loaded))
+	return nil
+}
+
+// Writes all accounts to the accounts file if there is one. accountsMu must be held
+func saveAccounts() error {
+	if accountsFile == "" {
+		return nil
+	}
+	contents, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.Write(accountsFile, contents, 0600)
+}
+
+// Checks if a username belongs to a registered account
+func Registered(username string) bool {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	_, ok := accounts[username]
+	return ok
+}
+
+// Checks if a registered account has a name that looks like the username
+func registeredLike(username string) bool {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	for name := range accounts {
+		if names.Same(name, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// Creates an account for a username
+func Register(username string, password string) error {
+	if password == "" {
+		return errors.New("password missing")
+	}
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return err
+	}
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	if _, ok := accounts[username]; ok {
+		return errors.New("user is already registered")
+	}
+	accounts[username] = &Account{
+		Username: username,
+		Salt:     hex.EncodeToString(salt),
+		Hash:     hashPassword(salt, password),
+		Created:  time.Now().UTC(),
+	}
+	err = saveAccounts()
+	if err != nil {
+		delete(accounts, username)
+		return err
+	}
+	log.Printf("registered account: %s", username)
+	return nil
+}
+
+// Checks if an account is marked as a server admin
+func accountIsAdmin(username string) bool {
+	accountsMu.Lock()
+	defer accountsMu.Unlock()
+	account, ok := accounts[username]
+	return ok && account.Admin
+}
+
+// Checks a password against the account for a username
+func CheckPassword(username string, password string) bool {
+	accountsMu.Lock()
+	account, ok := accounts[username]
+	accountsMu.Unlock()
+	if !ok {
+		return false
+	}
+	salt, err := hex.DecodeString(account.Salt)
+	if err != nil {
+		return false
+	}
+	hash := hashPassword(salt, password)
+	return subtle.ConstantTimeCompare([]byte(hash), []byte(account.Hash)) == 1
+}
+
+// Hashes a password with a salt
+func hashPassword(salt []byte, password string) string {
+	sum := sha256.Sum256(append(salt, []byte(password)...))
+	for i := 1; i < hashRounds; i++ {
+		sum = sha256.Sum256(sum[:])
+	}
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,349 @@
+package telnet
+
+import (
+	"chatservice/apikey"
+	"chatservice/ban"
+	"chatservice/incoming"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Holds the admin command options for printing
+var adminMenu = map[string]string{
+	"kick":         "/admin kick <user> [reason]",
+	"ban":          "/admin ban <ip|cidr|user> [duration] [reason]",
+	"unban":        "/admin unban <ip|cidr>",
+	"closechannel": "/admin closechannel <channel>",
+	"broadcast":    "/admin broadcast <text>",
+	"shutdown":     "/admin shutdown",
+	"reload":       "/admin reload",
+	"apikey":       "/admin apikey <add <name> <scope+scope>|remove <name>|list>",
+	"hook":         "/admin hook <add <name> <channel>|remove <name>|list>",
+}
+
+var adminNames = map[string]bool{} // Usernames made admins by the config
+var adminMu sync.Mutex
+var auditLog string // File admin commands are recorded to. Empty records them to the main log
+var auditMu sync.Mutex
+
+// Stops the server. Set by main
+var Shutdown = func() {
+	log.Printf("shutdown requested but not supported")
+}
+
+// Reloads the config file. Set by main
+var Reload = func() error {
+	return errors.New("reload is not supported")
+}
+
+// Replaces the usernames that are admins through the config
+func setAdmins(names []string) {
+	adminMu.Lock()
+	defer adminMu.Unlock()
+	adminNames = map[string]bool{}
+	for _, name := range names {
+		adminNames[name] = true
+	}
+}
+
+// Sets the file admin commands are recorded to. Empty records them to the main log
+func setAuditLog(path string) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	auditLog = path
+}
+
+// Checks if a user is a server admin. Admins must be logged in to a registered
+// account that is listed in the config or marked as admin in the account store
+func isAdmin(u *User) bool {
+	if !u.registered {
+		return false
+	}
+	adminMu.Lock()
+	listed := adminNames[u.username]
+	adminMu.Unlock()
+	return listed || accountIsAdmin(u.username)
+}
+
+// Checks if an online user is a server admin
+func IsAdmin(username string) bool {
+	u, ok := OnlineUser(username)
+	return ok && isAdmin(u)
+}
+
+// Runs an /admin command and records it in the audit log
+func (u *User) adminHandler(args string) error {
+	cmd, rest, _ := strings.Cut(strings.TrimSpace(args), " ")
+	if !isAdmin(u) {
+		audit(u.username, cmd, rest, "denied")
+		return errors.New("permission denied")
+	}
+	err := u.runAdmin(cmd, rest)
+	result := "ok"
+	if err != nil {
+		result = "error: " + err.Error()
+	}
+	audit(u.username, cmd, rest, result)
+	return err
+}
+
+// Switch statement for the /admin commands
+func (u *User) runAdmin(cmd string, args string) error {
+	switch cmd {
+	case "kick":
+		return u.adminKick(args)
+	case "ban":
+		return u.adminBan(args)
+	case "unban":
+		return u.adminUnban(args)
+	case "closechannel":
+		return u.adminCloseChannel(args)
+	case "broadcast":
+		return u.adminBroadcast(args)
+	case "shutdown":
+		return u.adminShutdown()
+	case "reload":
+		return u.adminReload()
+	case "apikey":
+		return u.adminAPIKey(args)
+	case "hook":
+		return u.adminHook(args)
+	case "help", "":
+		return u.printAdminMenu()
+	default:
+		return errors.New("unknown admin command")
+	}
+}
+
+// Appends a line describing an admin command to the audit log
+func audit(admin string, cmd string, args string, result string) {
+	line := time.Now().UTC().Format(time.RFC3339) + " admin=" + admin + " command=" + cmd +
+		" args=" + strconv.Quote(args) + " result=" + strconv.Quote(result) + "\n"
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if auditLog == "" {
+		log.Printf("audit: %s", strings.TrimSpace(line))
+		return
+	}
+	f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("unable to open audit log. err: %s. audit: %s", err, line)
+		return
+	}
+	defer f.Close()
+	_, err = f.WriteString(line)
+	if err != nil {
+		log.Printf("unable to write audit log. err: %s. audit: %s", err, line)
+	}
+}
+
+// Print the admin menu to the user
+func (u *User) printAdminMenu() error {
+	_, err := u.conn.Write([]byte("/**************" + u.t("Admin Menu") + "**************/\n"))
+	if err != nil {
+		return err
+	}
+	for _, v := range adminMenu {
+		_, err = u.conn.Write([]byte(v + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = u.conn.Write([]byte("/**************************************/\n"))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Disconnects a user from the server
+func (u *User) adminKick(args string) error {
+	username, reason, _ := strings.Cut(args, " ")
+	if username == "" {
+		return errors.New("usage: /admin kick <user> [reason]")
+	}
+	err := Kick(username, reason)
+	if err != nil {
+		return err
+	}
+	err = u.tell("Kicked user: %s", username)
+	return err
+}
+
+// Bans an ip, network or the ip of a connected user and disconnects everyone it covers
+func (u *User) adminBan(args string) error {
+	target, rest, _ := strings.Cut(args, " ")
+	if target == "" {
+		return errors.New("usage: /admin ban <ip|cidr|user> [duration] [reason]")
+	}
+	if user, ok := OnlineUser(target); ok {
+		target = remoteIP(user.conn)
+	}
+	//An optional duration comes before the reason
+	var duration time.Duration
+	first, reason, _ := strings.Cut(rest, " ")
+	if d, err := time.ParseDuration(first); err == nil && d > 0 {
+		duration = d
+	} else {
+		reason = rest
+	}
+	b, err := ban.Add(target, duration, reason, u.username)
+	if err != nil {
+		return err
+	}
+	DisconnectBanned()
+	err = u.tell("Banned: %s", b.Network)
+	return err
+}
+
+// Removes a ban
+func (u *User) adminUnban(args string) error {
+	if args == "" {
+		return errors.New("usage: /admin unban <ip|cidr>")
+	}
+	err := ban.Remove(args)
+	if err != nil {
+		return err
+	}
+	err = u.tell("Unbanned: %s", args)
+	return err
+}
+
+// Closes a channel
+func (u *User) adminCloseChannel(args string) error {
+	if args == "" {
+		return errors.New("usage: /admin closechannel <channel>")
+	}
+	err := CloseChannel(args, u.username)
+	if err != nil {
+		return err
+	}
+	err = u.tell("Closed channel: %s", args)
+	return err
+}
+
+// Sends a system notice to all users
+func (u *User) adminBroadcast(args string) error {
+	if args == "" {
+		return errors.New("usage: /admin broadcast <text>")
+	}
+	sendAllMessage(newMessage(u.username, KindNotice, args))
+	return nil
+}
+
+// Stops the server
+func (u *User) adminShutdown() error {
+	log.Printf("shutdown requested by admin: %s", u.username)
+	sendAllMessage(newMessage(u.username, KindNotice, "server is shutting down"))
+	Shutdown()
+	return nil
+}
+
+// Reloads the config file
+func (u *User) adminReload() error {
+	err := Reload()
+	if err != nil {
+		return err
+	}
+	return u.tell("Config reloaded")
+}
+
+// Adds, removes or lists the api keys of the http server
+func (u *User) adminAPIKey(args string) error {
+	action, rest, _ := strings.Cut(args, " ")
+	name, scopes, _ := strings.Cut(rest, " ")
+	switch {
+	case action == "add" && name != "" && scopes != "":
+		secret, err := apikey.Add(name, strings.Split(scopes, "+"), u.username)
+		if err != nil {
+			return err
+		}
+		return u.tell("Added API key: %s. It will not be shown again: %s", name, secret)
+	case action == "remove" && name != "":
+		err := apikey.Remove(name)
+		if err != nil {
+			return err
+		}
+		return u.tell("Removed API key: %s", name)
+	case action == "list":
+		return u.listAPIKeys()
+	default:
+		return errors.New("usage: /admin apikey <add <name> <scope+scope>|remove <name>|list>")
+	}
+}
+
+// Prints every api key with its scopes. Keys from the config are marked
+func (u *User) listAPIKeys() error {
+	list := apikey.List()
+	if len(list) == 0 {
+		return u.tell("There are no API keys")
+	}
+	for _, k := range list {
+		line := k.Name + ": " + strings.Join(k.Scopes, "+")
+		if k.Config {
+			line += " (config)"
+		}
+		_, err := u.conn.Write([]byte(line + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Adds, removes or lists the incoming webhooks of the http server
+func (u *User) adminHook(args string) error {
+	action, rest, _ := strings.Cut(args, " ")
+	name, channel, _ := strings.Cut(rest, " ")
+	switch {
+	case action == "add" && name != "" && channel != "":
+		//The name is who messages are from so it follows the username rules
+		err := CheckUsername(name)
+		if err != nil {
+			return err
+		}
+		err = CheckChannelName(channel)
+		if err != nil {
+			return err
+		}
+		token, err := incoming.Add(name, channel, u.username)
+		if err != nil {
+			return err
+		}
+		return u.tell("Added incoming webhook: %s. Post to /api/v1/hooks/%s. It will not be shown again", name, token)
+	case action == "remove" && name != "":
+		err := incoming.Remove(name)
+		if err != nil {
+			return err
+		}
+		return u.tell("Removed incoming webhook: %s", name)
+	case action == "list":
+		return u.listHooks()
+	default:
+		return errors.New("usage: /admin hook <add <name> <channel>|remove <name>|list>")
+	}
+}
+
+// Prints every incoming webhook with its channel. Hooks from the config are marked
+func (u *User) listHooks() error {
+	list := incoming.List()
+	if len(list) == 0 {
+		return u.tell("There are no incoming webhooks")
+	}
+	for _, h := range list {
+		line := h.Name + ": " + h.Channel
+		if h.Config {
+			line += " (config)"
+		}
+		_, err := u.conn.Write([]byte(line + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
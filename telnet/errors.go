@@ -0,0 +1,19 @@
+package telnet
+
+import "errors"
+
+// Errors callers need to tell apart, e.g. to pick an http status code
+var (
+	ErrNoChannel      = errors.New("channel does not exist")
+	ErrChannelExists  = errors.New("channel already exists")
+	ErrNoUser         = errors.New("user does not exist")
+	ErrUsernameTaken  = errors.New("user already exists, please pick another user name")
+	ErrUserOffline    = errors.New("user is not online")
+	ErrNotMember      = errors.New("user is not in the channel")
+	ErrNoMessage      = errors.New("message does not exist")
+	ErrMessageDeleted = errors.New("message was deleted")
+	ErrNotAuthor      = errors.New("only the author or a channel operator can change this message")
+	ErrMailboxFull    = errors.New("mailbox is full")
+	ErrBadPassword    = errors.New("incorrect password")
+	ErrBanned         = errors.New("you are banned from this server")
+)
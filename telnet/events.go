@@ -0,0 +1,349 @@
+package telnet
+
+import (
+	"chatservice/ban"
+	"chatservice/locale"
+	"log"
+	"sync"
+	"time"
+)
+
+// Event types published to subscribers
+const (
+	EventMessage    = "message"
+	EventConnect    = "connect"
+	EventDisconnect = "disconnect"
+	EventJoin       = "join"
+	EventLeave      = "leave"
+	EventCreate     = "create"
+	EventTopic      = "topic"
+	EventClose      = "close"
+	EventEdit       = "edit"
+	EventDelete     = "delete"
+)
+
+// Something that happened on the server. Sent to subscribers such as plugins
+type Event struct {
+	Type    string `json:"type"`
+	Time    string `json:"time"`
+	ID      uint64 `json:"id,omitempty"`
+	Parent  uint64 `json:"parent,omitempty"`
+	Kind    string `json:"kind,omitempty"`
+	User    string `json:"user,omitempty"`
+	Channel string `json:"channel,omitempty"`
+	To      string `json:"to,omitempty"`
+	Text    string `json:"text,omitempty"`
+}
+
+var Topics = map[string]string{} // Map of channel names to their topic
+
+var subscribers = map[int]func(Event){}
+var subscribersMu sync.Mutex
+var nextSubscriber int
+
+// Registers a handler that is called for every event. Handlers are called from the
+// goroutine that caused the event so they must not block. Returns a function to unsubscribe
+func Subscribe(handler func(Event)) func() {
+	subscribersMu.Lock()
+	defer subscribersMu.Unlock()
+	id := nextSubscriber
+	nextSubscriber++
+	subscribers[id] = handler
+	return func() {
+		subscribersMu.Lock()
+		defer subscribersMu.Unlock()
+		delete(subscribers, id)
+	}
+}
+
+// Sends an event to all subscribers
+func emitEvent(e Event) {
+	e.Time = time.Now().UTC().Format(time.RFC3339)
+	subscribersMu.Lock()
+	handlers := make([]func(Event), 0, len(subscribers))
+	for _, h := range subscribers {
+		handlers = append(handlers, h)
+	}
+	subscribersMu.Unlock()
+	for _, h := range handlers {
+		h(e)
+	}
+}
+
+// A copy of the state of a channel
+type ChannelInfo struct {
+	Name      string
+	Topic     string
+	Operators []string
+	Members   []string
+}
+
+// Returns a connected user
+func OnlineUser(username string) (*User, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	user, ok := Users[username]
+	return user, ok
+}
+
+// Returns the connected users
+func onlineUsers() []*User {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	users := make([]*User, 0, len(Users))
+	for _, user := range Users {
+		users = append(users, user)
+	}
+	return users
+}
+
+// Returns the names of the connected users
+func ListUsers() []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	names := make([]string, 0, len(Users))
+	for name := range Users {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Returns the names of all channels
+func ListChannels() []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	names := make([]string, 0, len(Channels))
+	for name := range Channels {
+		names = append(names, name)
+	}
+	return names
+}
+
+// Checks if a channel exists
+func ChannelExists(channel string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	_, ok := Channels[channel]
+	return ok
+}
+
+// Returns the topic, operators and members of a channel
+func GetChannel(channel string) (ChannelInfo, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	userList, ok := Channels[channel]
+	if !ok {
+		return ChannelInfo{}, false
+	}
+	info := ChannelInfo{Name: channel, Topic: Topics[channel], Operators: append([]string{}, Operators[channel]...), Members: []string{}}
+	for _, user := range userList {
+		info.Members = append(info.Members, user.username)
+	}
+	return info, true
+}
+
+// Returns a copy of the users in a channel, safe to use without the lock
+func channelMembers(channel string) ([]*User, bool) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	userList, ok := Channels[channel]
+	return append([]*User{}, userList...), ok
+}
+
+// Sends a message on behalf of a non telnet sender such as a plugin.
+// A channel sends into that channel, a user sends a pm, neither sends to all users
+func SendAs(from string, channel string, to string, msg string) error {
+	return SendKindAs(from, KindMessage, channel, to, msg)
+}
+
+// Sends a message or action on behalf of a non telnet sender. See SendAs
+func SendKindAs(from string, kind string, channel string, to string, msg string) error {
+	if channel != "" {
+		userList, ok := channelMembers(channel)
+		if !ok {
+			return ErrNoChannel
+		}
+		m := newMessage(from, kind, msg)
+		m.Channel = channel
+		sendChannelMessage(m, userList)
+	} else if to != "" {
+		user, ok := OnlineUser(to)
+		if !ok {
+			return sendOfflineMessage(newMessage(from, kind, msg), to)
+		}
+		sendUserMessage(newMessage(from, kind, msg), user)
+	} else {
+		sendAllMessage(newMessage(from, kind, msg))
+	}
+	return nil
+}
+
+// Logs a user out without telling them, e.g. when their http session ends
+func Logout(username string) error {
+	user, ok := OnlineUser(username)
+	if !ok {
+		return ErrNoUser
+	}
+	user.Logout()
+	return nil
+}
+
+// Disconnects a user from the server
+func Kick(username string, reason string) error {
+	user, ok := OnlineUser(username)
+	if !ok {
+		return ErrNoUser
+	}
+	msg := user.t("You have been kicked from the chat")
+	if reason != "" {
+		msg = locale.Tf(user.lang(), "You have been kicked from the chat. reason: %s", sanitize(reason))
+	}
+	_, err := user.conn.Write([]byte(msg + "\n"))
+	if err != nil {
+		log.Printf("error writing to connection %v. error %s", user.conn.RemoteAddr(), err)
+	}
+	user.drop("kicked. reason: " + reason)
+	return nil
+}
+
+// Disconnects every user connected from a banned ip
+func DisconnectBanned() {
+	for _, user := range onlineUsers() {
+		if _, banned := ban.IsBanned(remoteIP(user.conn)); banned {
+			user.conn.Write([]byte(user.t("You have been banned from this server") + "\n"))
+			user.drop("banned")
+		}
+	}
+}
+
+// Creates a channel. The user creating it becomes its operator. Channels created
+// without a user, by is empty, have no operator
+func CreateChannel(channel string, by string) error {
+	err := CheckChannelName(channel)
+	if err != nil {
+		return err
+	}
+	stateMu.Lock()
+	err = channelTaken(channel)
+	if err != nil {
+		stateMu.Unlock()
+		return err
+	}
+	Channels[channel] = []*User{}
+	Operators[channel] = []string{}
+	if by != "" {
+		Operators[channel] = append(Operators[channel], by)
+	}
+	stateMu.Unlock()
+	log.Printf("channel: %s created by: %s", channel, by)
+	emitEvent(Event{Type: EventCreate, User: by, Channel: channel})
+	return nil
+}
+
+// Adds a connected user to a channel. Returns false if they were already in it
+func JoinChannel(username string, channel string) (bool, error) {
+	stateMu.Lock()
+	user, ok := Users[username]
+	if !ok {
+		stateMu.Unlock()
+		return false, ErrUserOffline
+	}
+	if _, ok := Channels[channel]; !ok {
+		stateMu.Unlock()
+		return false, ErrNoChannel
+	}
+	for _, c := range user.channels {
+		if c == channel {
+			stateMu.Unlock()
+			return false, nil
+		}
+	}
+	Channels[channel] = append(Channels[channel], user)
+	user.channels = append(user.channels, channel)
+	stateMu.Unlock()
+	emitEvent(Event{Type: EventJoin, User: username, Channel: channel})
+	return true, nil
+}
+
+// Takes a connected user out of a channel
+func LeaveChannel(username string, channel string) error {
+	stateMu.Lock()
+	user, ok := Users[username]
+	if !ok {
+		stateMu.Unlock()
+		return ErrUserOffline
+	}
+	userList, ok := Channels[channel]
+	if !ok {
+		stateMu.Unlock()
+		return ErrNoChannel
+	}
+	member := false
+	for i, c := range user.channels {
+		if c == channel {
+			user.channels = append(user.channels[:i], user.channels[i+1:]...)
+			member = true
+			break
+		}
+	}
+	if !member {
+		stateMu.Unlock()
+		return ErrNotMember
+	}
+	for i, u := range userList {
+		if u == user {
+			Channels[channel] = append(userList[:i], userList[i+1:]...)
+			break
+		}
+	}
+	stateMu.Unlock()
+	emitEvent(Event{Type: EventLeave, User: username, Channel: channel})
+	return nil
+}
+
+// Removes a channel, taking all of its members out of it
+func CloseChannel(channel string, by string) error {
+	stateMu.Lock()
+	userList, ok := Channels[channel]
+	if !ok {
+		stateMu.Unlock()
+		return ErrNoChannel
+	}
+	for _, user := range userList {
+		for i, c := range user.channels {
+			if c == channel {
+				user.channels = append(user.channels[:i], user.channels[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(Channels, channel)
+	delete(Operators, channel)
+	delete(Topics, channel)
+	stateMu.Unlock()
+	for _, user := range userList {
+		err := user.tell("Channel: %s was closed", channel)
+		if err != nil {
+			log.Printf("error writing to connection %v. error %s", user.conn.RemoteAddr(), err)
+		}
+	}
+	channelMessages.Delete(channel)
+	log.Printf("channel: %s closed by: %s", channel, by)
+	emitEvent(Event{Type: EventClose, User: by, Channel: channel})
+	return nil
+}
+
+// Sets the topic of a channel
+func SetTopic(channel string, topic string, by string) error {
+	topic = sanitize(topic)
+	stateMu.Lock()
+	if _, ok := Channels[channel]; !ok {
+		stateMu.Unlock()
+		return ErrNoChannel
+	}
+	Topics[channel] = topic
+	stateMu.Unlock()
+	log.Printf("topic for channel: %s set to: %s by: %s", channel, topic, by)
+	emitEvent(Event{Type: EventTopic, User: by, Channel: channel, Text: topic})
+	return nil
+}
@@ -0,0 +1,310 @@
+package telnet
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const maxHistory = 1000 // Number of messages kept in memory
+
+var history = []Message{}
+var historyFile *os.File
+var historyMu sync.Mutex
+var nextMessageID uint64 = 1
+var seenBy = map[uint64]map[string]bool{}   // Map of message ids to the users that were shown the message
+var historySize int64                       // Length of the history file, where the next line is written
+var historyLines = map[uint64]historyLine{} // Map of the ids of messages in memory to their latest line
+var archive = []historyLine{}               // Lines of the messages only kept in the history file, oldest first
+
+// Where the latest line of a message is in the history file
+type historyLine struct {
+	ID     uint64
+	Offset int64
+	Size   int
+}
+
+// Loads previous messages from a history file and appends new messages to it.
+// The file holds one json encoded message per line. A later line with the same id
+// as an earlier one is an edit or delete and replaces it
+func LoadHistory(filepath string) error {
+	f, err := os.OpenFile(filepath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return err
+	}
+	loaded, lines, size, err := readHistory(f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	maxID := uint64(0)
+	for _, m := range loaded {
+		if m.ID > maxID {
+			maxID = m.ID
+		}
+	}
+	//Older messages stay in the file and are read back by their line when searched
+	split := 0
+	if len(loaded) > maxHistory {
+		split = len(loaded) - maxHistory
+	}
+	kept := map[uint64]historyLine{}
+	for _, line := range lines[split:] {
+		kept[line.ID] = line
+	}
+	loaded = loaded[split:]
+
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if historyFile != nil {
+		historyFile.Close()
+	}
+	history = loaded
+	historyFile = f
+	historySize = size
+	historyLines = kept
+	archive = lines[:split]
+	if maxID >= nextMessageID {
+		nextMessageID = maxID + 1
+	}
+	log.Printf("loaded %d messages from history", len(loaded))
+	return nil
+}
+
+// Reads every message in a history file with edits and deletes applied, oldest first.
+// Also returns where the latest line of each message is and the length of the file
+func readHistory(r io.Reader) ([]Message, []historyLine, int64, error) {
+	loaded := []Message{}
+	lines := []historyLine{}
+	index := map[uint64]int{}
+	reader := bufio.NewReader(r)
+	offset := int64(0)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if len(data) > 0 {
+			line := historyLine{Offset: offset, Size: len(data)}
+			offset += int64(len(data))
+			var m Message
+			if decodeErr := json.Unmarshal(data, &m); decodeErr != nil {
+				log.Printf("skipping invalid history line: %s", decodeErr)
+			} else if i, ok := index[m.ID]; ok && m.ID != 0 {
+				line.ID = m.ID
+				loaded[i] = m
+				lines[i] = line
+			} else {
+				line.ID = m.ID
+				index[m.ID] = len(loaded)
+				loaded = append(loaded, m)
+				lines = append(lines, line)
+			}
+		}
+		if err == io.EOF {
+			return loaded, lines, offset, nil
+		}
+		if err != nil {
+			return nil, nil, 0, err
+		}
+	}
+}
+
+// Gives a message an id and adds it to the history
+func recordMessage(m Message) Message {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	m.ID = nextMessageID
+	nextMessageID++
+	history = append(history, m)
+	if len(history) > maxHistory {
+		old := history[0].ID
+		delete(seenBy, old)
+		if line, ok := historyLines[old]; ok {
+			archive = append(archive, line)
+			delete(historyLines, old)
+		}
+		history = history[1:]
+	}
+	writeHistory(m)
+	return m
+}
+
+// Writes a message to the history file if there is one. historyMu must be held
+func writeHistory(m Message) {
+	if historyFile == nil {
+		return
+	}
+	line, err := json.Marshal(m)
+	if err != nil {
+		log.Printf("unable to encode message for history. err: %s", err)
+		return
+	}
+	n, err := historyFile.Write(append(line, '\n'))
+	offset := historySize
+	historySize += int64(n)
+	if err != nil {
+		log.Printf("unable to write history. err: %s", err)
+		return
+	}
+	historyLines[m.ID] = historyLine{ID: m.ID, Offset: offset, Size: n}
+}
+
+// Returns a copy of the message history, oldest first
+func History() []Message {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	return append([]Message{}, history...)
+}
+
+// Returns a message from the history by its id
+func GetMessage(id uint64) (Message, bool) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	i := findMessage(id)
+	if i < 0 {
+		return Message{}, false
+	}
+	return history[i], true
+}
+
+// Finds the index of a message in the history. historyMu must be held
+func findMessage(id uint64) int {
+	for i := len(history) - 1; i >= 0; i-- {
+		if history[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns every message in the thread a message belongs to, starting with the
+// message that began the thread followed by all replies in the order they were sent.
+// Only channel messages have threads. A private message is returned on its own and
+// only to its sender or recipient, viewer is the user asking
+func Thread(id uint64, viewer string) ([]Message, error) {
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	i := findMessage(id)
+	if i < 0 {
+		return nil, ErrNoMessage
+	}
+	if m := history[i]; m.To != "" {
+		if viewer == "" || (viewer != m.From && viewer != m.To) {
+			return nil, ErrNoMessage
+		}
+		return []Message{m}, nil
+	}
+	//Walk up to the root of the thread
+	root := history[i]
+	for root.Parent != 0 {
+		p := findMessage(root.Parent)
+		if p < 0 || history[p].To != "" {
+			break
+		}
+		root = history[p]
+	}
+	//Replies always come after their parent so one pass collects the thread
+	inThread := map[uint64]bool{root.ID: true}
+	thread := []Message{}
+	for _, m := range history {
+		if m.To != "" {
+			continue
+		}
+		if m.ID == root.ID || inThread[m.Parent] {
+			inThread[m.ID] = true
+			thread = append(thread, m)
+		}
+	}
+	return thread, nil
+}
+
+// Remembers that a user was shown a message so they are told about edits and deletes
+func markSeen(id uint64, username string) {
+	if id == 0 {
+		return
+	}
+	historyMu.Lock()
+	defer historyMu.Unlock()
+	if seenBy[id] == nil {
+		seenBy[id] = map[string]bool{}
+	}
+	seenBy[id][username] = true
+}
+
+// Checks if a user may edit or delete a message. Authors can change their own
+// messages and channel operators can change messages in their channel
+func canModify(m Message, username string) bool {
+	if m.From == username {
+		return true
+	}
+	if m.Channel == "" {
+		return false
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for _, op := range Operators[m.Channel] {
+		if op == username {
+			return true
+		}
+	}
+	return false
+}
+
+// Replaces the text of a message and tells everyone who saw it
+func EditMessage(id uint64, by string, text string) error {
+	text = sanitize(text)
+	if text == "" {
+		return errors.New("message text missing")
+	}
+	return modifyMessage(id, by, func(m *Message) {
+		m.Text = text
+		m.Edited = true
+	}, Message{Kind: KindEdit, ID: id, From: by, Text: text})
+}
+
+// Removes the text of a message and tells everyone who saw it
+func DeleteMessage(id uint64, by string) error {
+	return modifyMessage(id, by, func(m *Message) {
+		m.Text = ""
+		m.Deleted = true
+	}, Message{Kind: KindDelete, ID: id, From: by})
+}
+
+// Applies a change to a message in the history, persists it and sends a notice to the users that saw it
+func modifyMessage(id uint64, by string, change func(*Message), notice Message) error {
+	historyMu.Lock()
+	i := findMessage(id)
+	if i < 0 {
+		historyMu.Unlock()
+		return ErrNoMessage
+	}
+	if history[i].Deleted {
+		historyMu.Unlock()
+		return ErrMessageDeleted
+	}
+	if !canModify(history[i], by) {
+		historyMu.Unlock()
+		return ErrNotAuthor
+	}
+	change(&history[i])
+	writeHistory(history[i])
+	recipients := []string{}
+	for username := range seenBy[id] {
+		recipients = append(recipients, username)
+	}
+	notice.Channel = history[i].Channel
+	historyMu.Unlock()
+
+	notice.Time = time.Now().UTC()
+	for _, username := range recipients {
+		if user, ok := OnlineUser(username); ok {
+			user.deliver(notice)
+		}
+	}
+	log.Printf("message %d changed by: %s. change: %s", id, by, notice.Kind)
+	emitEvent(Event{Type: notice.Kind, ID: id, User: by, Channel: notice.Channel, Text: notice.Text})
+	return nil
+}
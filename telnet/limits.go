@@ -0,0 +1,121 @@
+package telnet
+
+import (
+	"chatservice/locale"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Limits on connections. 0 means unlimited. Guarded by connMu
+var maxConnections int
+var maxConnectionsPerIP int
+var maxPendingLogins int
+
+// Counts of open connections and rejected connections
+type ConnectionStats struct {
+	Connections           int
+	PendingLogins         int
+	RejectedMaxConns      int
+	RejectedPerIP         int
+	RejectedPendingLogins int
+}
+
+var connStats = ConnectionStats{}
+var connsPerIP = map[string]int{}
+var connMu sync.Mutex
+
+// A connection counted against the limits. Closing it frees its slot
+type trackedConn struct {
+	net.Conn
+	ip        string
+	closeOnce sync.Once
+	loginOnce sync.Once
+}
+
+// Replaces the connection limits
+func setLimits(connections int, perIP int, pendingLogins int) {
+	connMu.Lock()
+	defer connMu.Unlock()
+	maxConnections = connections
+	maxConnectionsPerIP = perIP
+	maxPendingLogins = pendingLogins
+}
+
+// Returns a copy of the connection counters
+func GetConnectionStats() ConnectionStats {
+	connMu.Lock()
+	defer connMu.Unlock()
+	return connStats
+}
+
+// Checks a new connection against the limits. Returns the connection to use, or a
+// message to send the client if it was rejected
+func admitConnection(conn net.Conn) (net.Conn, string) {
+	ip := remoteIP(conn)
+	connMu.Lock()
+	defer connMu.Unlock()
+	if maxConnections > 0 && connStats.Connections >= maxConnections {
+		connStats.RejectedMaxConns++
+		connectionsRejected.Inc("max_connections")
+		return nil, "server is full, try again later\n"
+	}
+	if maxConnectionsPerIP > 0 && connsPerIP[ip] >= maxConnectionsPerIP {
+		connStats.RejectedPerIP++
+		connectionsRejected.Inc("max_connections_per_ip")
+		return nil, "too many connections from your address\n"
+	}
+	if maxPendingLogins > 0 && connStats.PendingLogins >= maxPendingLogins {
+		connStats.RejectedPendingLogins++
+		connectionsRejected.Inc("max_pending_logins")
+		return nil, "too many logins in progress, try again later\n"
+	}
+	connStats.Connections++
+	connStats.PendingLogins++
+	connsPerIP[ip]++
+	connectionsTotal.Inc(clientOf(conn))
+	return &trackedConn{Conn: conn, ip: ip}, ""
+}
+
+// Marks a connection as logged in so it no longer counts as a pending login
+func loginComplete(conn net.Conn) {
+	if tc, ok := conn.(*trackedConn); ok {
+		tc.loginOnce.Do(func() {
+			connMu.Lock()
+			connStats.PendingLogins--
+			connMu.Unlock()
+		})
+	}
+}
+
+// Closes the connection and frees its slot
+func (tc *trackedConn) Close() error {
+	loginComplete(tc)
+	tc.closeOnce.Do(func() {
+		connMu.Lock()
+		connStats.Connections--
+		connsPerIP[tc.ip]--
+		if connsPerIP[tc.ip] <= 0 {
+			delete(connsPerIP, tc.ip)
+		}
+		connMu.Unlock()
+	})
+	return tc.Conn.Close()
+}
+
+// Returns the ip address of the remote end of a connection
+func remoteIP(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
+
+// Writes the reason a connection was rejected and closes it
+func rejectConnection(conn net.Conn, reason string) {
+	log.Printf("rejected connection from: %v. reason: %s", conn.RemoteAddr(), strings.TrimSpace(reason))
+	conn.Write([]byte(locale.T("", strings.TrimSpace(reason)) + "\n"))
+	conn.Close()
+}
@@ -0,0 +1,184 @@
+package telnet
+
+import (
+	"chatservice/atomicfile"
+	"chatservice/locale"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultMailboxLimit = 50 // Messages kept per mailbox when no limit is configured
+
+// A private message waiting in the mailbox of an offline user
+type Mail struct {
+	Message Message `json:"message"`
+	Read    bool    `json:"read"`
+}
+
+var mailboxes = map[string][]Mail{} // Map of usernames to their mailbox
+var mailboxFile string
+var mailboxLimit = defaultMailboxLimit
+var mailboxMu sync.Mutex
+
+// Loads mailboxes from a json file and sets how many messages each mailbox holds.
+// Changes to mailboxes are saved to the same file. An empty path keeps mailboxes in memory only
+func LoadMailboxes(filepath string, limit int) error {
+	loaded := map[string][]Mail{}
+	if filepath != "" {
+		contents, err := os.ReadFile(filepath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if len(contents) > 0 {
+			err = json.Unmarshal(contents, &loaded)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	mailboxMu.Lock()
+	defer mailboxMu.Unlock()
+	mailboxes = loaded
+	mailboxFile = filepath
+	if limit > 0 {
+		mailboxLimit = limit
+	}
+	return nil
+}
+
+// Writes all mailboxes to the mailbox file if there is one. mailboxMu must be held
+func saveMailboxes() {
+	if mailboxFile == "" {
+		return
+	}
+	contents, err := json.Marshal(mailboxes)
+	if err != nil {
+		log.Printf("unable to encode mailboxes. err: %s", err)
+		return
+	}
+	err = atomicfile.Write(mailboxFile, contents, 0600)
+	if err != nil {
+		log.Printf("unable to save mailboxes. err: %s", err)
+	}
+}
+
+// Checks if a mailbox has room for another message. Read messages can be dropped to make room
+func mailboxFull(username string) bool {
+	mailboxMu.Lock()
+	defer mailboxMu.Unlock()
+	if len(mailboxes[username]) < mailboxLimit {
+		return false
+	}
+	for _, mail := range mailboxes[username] {
+		if mail.Read {
+			return false
+		}
+	}
+	return true
+}
+
+// Puts a message in the mailbox of its recipient, dropping the oldest read message if it is full
+func queueMail(m Message) error {
+	mailboxMu.Lock()
+	defer mailboxMu.Unlock()
+	box := mailboxes[m.To]
+	if len(box) >= mailboxLimit {
+		for i, mail := range box {
+			if mail.Read {
+				box = append(box[:i], box[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(box) >= mailboxLimit {
+		return ErrMailboxFull
+	}
+	mailboxes[m.To] = append(box, Mail{Message: m})
+	saveMailboxes()
+	return nil
+}
+
+// Returns a copy of a users mailbox and marks everything in it as read
+func readMail(username string) []Mail {
+	mailboxMu.Lock()
+	defer mailboxMu.Unlock()
+	box := append([]Mail{}, mailboxes[username]...)
+	for i := range mailboxes[username] {
+		mailboxes[username][i].Read = true
+	}
+	saveMailboxes()
+	return box
+}
+
+// Empties a users mailbox
+func clearMail(username string) {
+	mailboxMu.Lock()
+	defer mailboxMu.Unlock()
+	delete(mailboxes, username)
+	saveMailboxes()
+}
+
+// Describes the unread messages in a users mailbox in a language, e.g. "3 messages from alice (2), bob (1)".
+// Returns an empty string if there are none
+func mailSummary(username string, lang string) string {
+	mailboxMu.Lock()
+	defer mailboxMu.Unlock()
+	unread := 0
+	senders := map[string]int{}
+	for _, mail := range mailboxes[username] {
+		if !mail.Read {
+			unread++
+			senders[mail.Message.From]++
+		}
+	}
+	if unread == 0 {
+		return ""
+	}
+	names := []string{}
+	for name := range senders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	from := ""
+	for i, name := range names {
+		if i > 0 {
+			from += ", "
+		}
+		from += name + " (" + strconv.Itoa(senders[name]) + ")"
+	}
+	if unread == 1 {
+		return locale.Tf(lang, "1 message from %s", from)
+	}
+	return locale.Tf(lang, "%d messages from %s", unread, from)
+}
+
+// Sends a private message to a registered user that is not connected by putting it in their mailbox
+func sendOfflineMessage(m Message, to string) error {
+	if !Registered(to) {
+		return ErrNoUser
+	}
+	//Mail from ignored senders is dropped without telling them
+	if getPrefs(to).ignores(m.From) {
+		log.Printf("dropped mail from: %s to: %s. sender is ignored", m.From, to)
+		return nil
+	}
+	if mailboxFull(to) {
+		return ErrMailboxFull
+	}
+	m.Time = time.Now().UTC()
+	m.To = to
+	m = recordMessage(m)
+	err := queueMail(m)
+	if err != nil {
+		return err
+	}
+	messagesTotal.Inc(m.Kind, "mailbox")
+	log.Printf("%s sent to mailbox: %s", m.Kind, m)
+	emitEvent(Event{Type: EventMessage, ID: m.ID, Kind: m.Kind, User: m.From, To: m.To, Text: m.Text})
+	return nil
+}
@@ -0,0 +1,114 @@
+package telnet
+
+import (
+	"chatservice/locale"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const maxQuote = 60 // Longest parent snippet quoted in a reply
+
+// Kinds of messages
+const (
+	KindMessage = "message" // Regular chat message
+	KindAction  = "action"  // Emote sent with /me
+	KindEdit    = "edit"    // Notice that an earlier message was edited
+	KindDelete  = "delete"  // Notice that an earlier message was deleted
+	KindNotice  = "notice"  // System notice broadcast by an admin
+)
+
+// A chat message sent to all users, a channel or a single user
+type Message struct {
+	ID      uint64    `json:"id"`
+	Time    time.Time `json:"time"` // Always UTC
+	Kind    string    `json:"kind"`
+	From    string    `json:"from"`
+	Channel string    `json:"channel,omitempty"`
+	To      string    `json:"to,omitempty"`
+	Text    string    `json:"text"`
+	Parent  uint64    `json:"parent,omitempty"` // Id of the message this replies to
+	Quote   string    `json:"quote,omitempty"`  // Snippet of the parent shown with the reply
+	Edited  bool      `json:"edited,omitempty"`
+	Deleted bool      `json:"deleted,omitempty"`
+}
+
+// Creates a message of the given kind. Channel or recipient are filled in when it is sent
+func newMessage(from string, kind string, text string) Message {
+	return Message{
+		Kind: kind,
+		From: sanitize(from),
+		Text: sanitize(text),
+	}
+}
+
+// Splits a "/me" prefix off of message text, returning the kind of message it is
+func parseEmote(text string) (string, string) {
+	if action, ok := strings.CutPrefix(text, "/me "); ok {
+		return KindAction, action
+	}
+	return KindMessage, text
+}
+
+// Creates the quoted snippet of a message shown above replies to it
+func quote(m Message) string {
+	text := m.Text
+	if m.Deleted {
+		text = "(deleted)"
+	}
+	if runes := []rune(text); len(runes) > maxQuote {
+		text = string(runes[:maxQuote]) + "..."
+	}
+	return m.From + ": " + text
+}
+
+// Checks if a message kind is known
+func ValidKind(kind string) bool {
+	return kind == KindMessage || kind == KindAction
+}
+
+// Formats the message for display in a terminal using the servers local time
+func (m Message) String() string {
+	return m.Render(time.Local, TimeFormatDefault, locale.English)
+}
+
+// Formats the message for display in a terminal with the time shown in a timezone and time format.
+// Server text such as edit notices is translated into lang
+func (m Message) Render(loc *time.Location, format string, lang string) string {
+	//Messages loaded from an old history file may not have been sanitized
+	m.From, m.Channel, m.Text, m.Quote = sanitize(m.From), sanitize(m.Channel), sanitize(m.Text), sanitize(m.Quote)
+	out := ""
+	if m.Parent != 0 {
+		out += "> " + m.Quote + "\n"
+	}
+	if m.ID != 0 && m.Kind != KindEdit && m.Kind != KindDelete {
+		out += "[" + strconv.FormatUint(m.ID, 10) + "] "
+	}
+	out += formatTime(m.Time, loc, format, lang) + "|"
+	switch m.Kind {
+	case KindAction:
+		if m.Channel != "" {
+			out += m.Channel + "|"
+		}
+		out += "* " + m.From + " " + m.Text
+	case KindEdit:
+		return out + "* " + locale.Tf(lang, "%s edited message %d: %s", m.From, m.ID, m.Text)
+	case KindNotice:
+		return out + "*** " + m.Text
+	case KindDelete:
+		return out + "* " + locale.Tf(lang, "%s deleted message %d", m.From, m.ID)
+	default:
+		out += m.From + "|"
+		if m.Channel != "" {
+			out += m.Channel + "|"
+		}
+		out += m.Text
+	}
+	if m.Deleted {
+		return out + locale.T(lang, "(deleted)")
+	}
+	if m.Edited {
+		out += " " + locale.T(lang, "(edited)")
+	}
+	return out
+}
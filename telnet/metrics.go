@@ -0,0 +1,76 @@
+package telnet
+
+import (
+	"chatservice/metrics"
+	"net"
+)
+
+// Metrics for /metrics. Gauges that can be read from the server state are in init
+var (
+	connectionsTotal    = metrics.NewCounter("chat_connections_total", "Connections accepted, by client", "client")
+	connectionsRejected = metrics.NewCounter("chat_connections_rejected_total", "Connections refused, by reason", "reason")
+	loginsTotal         = metrics.NewCounter("chat_logins_total", "Login attempts, by client and result", "client", "result")
+	messagesTotal       = metrics.NewCounter("chat_messages_total", "Messages sent, by kind and target", "kind", "target")
+	channelMessages     = metrics.NewCounter("chat_channel_messages_total", "Messages sent into each open channel", "channel")
+	commandsTotal       = metrics.NewCounter("chat_commands_total", "Commands run, by command", "command")
+	errorsTotal         = metrics.NewCounter("chat_errors_total", "Failed commands and connection writes, by kind", "kind")
+)
+
+func init() {
+	metrics.NewGaugeFunc("chat_connections_open", "Connections open, including ones logging in", func() float64 {
+		return float64(GetConnectionStats().Connections)
+	})
+	metrics.NewGaugeFunc("chat_pending_logins", "Connections that have not finished logging in", func() float64 {
+		return float64(GetConnectionStats().PendingLogins)
+	})
+	metrics.NewGaugeFunc("chat_users_online", "Users logged in", func() float64 {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		return float64(len(Users))
+	})
+	metrics.NewGaugeFunc("chat_channels_open", "Channels open", func() float64 {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		return float64(len(Channels))
+	})
+	metrics.NewGaugeMapFunc("chat_channel_members", "Users in each channel", "channel", func() map[string]float64 {
+		stateMu.Lock()
+		defer stateMu.Unlock()
+		members := map[string]float64{}
+		for channel, users := range Channels {
+			members[channel] = float64(len(users))
+		}
+		return members
+	})
+	metrics.NewGaugeFunc("chat_mailbox_messages", "Messages kept for registered users while they are offline", func() float64 {
+		mailboxMu.Lock()
+		defer mailboxMu.Unlock()
+		count := 0
+		for _, box := range mailboxes {
+			count += len(box)
+		}
+		return float64(count)
+	})
+}
+
+// Returns the number of messages sent since the server started
+func MessagesSent() int {
+	return int(messagesTotal.Sum())
+}
+
+// Returns how a connection is connected, ClientTelnet or the client of its MessageConn
+func clientOf(conn net.Conn) string {
+	if mc, ok := messageConn(conn); ok {
+		return mc.Client()
+	}
+	return ClientTelnet
+}
+
+// Returns the label a command is counted under. Unknown commands share one label so
+// typos do not each add a series
+func commandLabel(cmd string) string {
+	if _, ok := helpMenu[cmd]; ok || cmd == "/unmute" {
+		return cmd
+	}
+	return "unknown"
+}
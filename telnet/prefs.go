@@ -0,0 +1,191 @@
+package telnet
+
+import (
+	"chatservice/atomicfile"
+	"chatservice/locale"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notification levels for a channel
+const (
+	NotifyAll      = "all"      // Show every message
+	NotifyMentions = "mentions" // Only show messages that mention the user with @username
+	NotifyNone     = "none"     // Show no messages
+)
+
+// Settings a user keeps between sessions. Only saved for registered users
+type Prefs struct {
+	Ignored    []string                `json:"ignored,omitempty"`    // Usernames, or "http", whose messages are hidden
+	Channels   map[string]ChannelPrefs `json:"channels,omitempty"`   // Map of channel names to their settings
+	Timezone   string                  `json:"timezone,omitempty"`   // IANA timezone timestamps are shown in. Empty is the servers local time
+	TimeFormat string                  `json:"timeformat,omitempty"` // One of the TimeFormat constants. Empty is TimeFormatDefault
+	Lang       string                  `json:"lang,omitempty"`       // Language server messages are shown in. Empty is the server default
+}
+
+// Notification settings for one channel
+type ChannelPrefs struct {
+	Notify string `json:"notify,omitempty"` // Empty means NotifyAll
+	Muted  bool   `json:"muted,omitempty"`
+}
+
+var preferences = map[string]Prefs{} // Map of usernames to their saved preferences
+var prefsFile string
+var prefsMu sync.Mutex
+
+// Loads saved preferences from a json file. Changes are saved to the same file
+func LoadPrefs(filepath string) error {
+	loaded := map[string]Prefs{}
+	contents, err := os.ReadFile(filepath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(contents) > 0 {
+		err = json.Unmarshal(contents, &loaded)
+		if err != nil {
+			return err
+		}
+	}
+	prefsMu.Lock()
+	defer prefsMu.Unlock()
+	preferences = loaded
+	prefsFile = filepath
+	return nil
+}
+
+// Returns the saved preferences of a user
+func getPrefs(username string) Prefs {
+	prefsMu.Lock()
+	defer prefsMu.Unlock()
+	return preferences[username].clone()
+}
+
+// Saves the preferences of a user
+func putPrefs(username string, p Prefs) {
+	prefsMu.Lock()
+	defer prefsMu.Unlock()
+	preferences[username] = p.clone()
+	if prefsFile == "" {
+		return
+	}
+	contents, err := json.MarshalIndent(preferences, "", "  ")
+	if err != nil {
+		log.Printf("unable to encode preferences. err: %s", err)
+		return
+	}
+	err = atomicfile.Write(prefsFile, contents, 0600)
+	if err != nil {
+		log.Printf("unable to save preferences. err: %s", err)
+	}
+}
+
+// Returns a deep copy of the preferences
+func (p Prefs) clone() Prefs {
+	p.Ignored = append([]string{}, p.Ignored...)
+	channels := map[string]ChannelPrefs{}
+	for name, cp := range p.Channels {
+		channels[name] = cp
+	}
+	p.Channels = channels
+	return p
+}
+
+// Checks if a notify level is known
+func validNotify(level string) bool {
+	return level == NotifyAll || level == NotifyMentions || level == NotifyNone
+}
+
+// Checks if a channel message should be shown to a user based on their channel settings
+func (p Prefs) shows(m Message, username string) bool {
+	if m.Channel == "" || (m.Kind != KindMessage && m.Kind != KindAction) {
+		return true
+	}
+	cp := p.Channels[m.Channel]
+	if cp.Muted {
+		return false
+	}
+	switch cp.Notify {
+	case NotifyNone:
+		return false
+	case NotifyMentions:
+		return strings.Contains(strings.ToLower(m.Text), "@"+strings.ToLower(username))
+	default:
+		return true
+	}
+}
+
+// Describes the settings of a channel for /listmychannels in a language
+func (cp ChannelPrefs) describe(lang string) string {
+	notify := cp.Notify
+	if notify == "" {
+		notify = NotifyAll
+	}
+	out := locale.Tf(lang, "notify: %s", notify)
+	if cp.Muted {
+		out += ", " + locale.T(lang, "muted")
+	}
+	return out
+}
+
+// Checks if a user ignores messages from a sender
+func (p Prefs) ignores(sender string) bool {
+	for _, ignored := range p.Ignored {
+		if ignored == sender {
+			return true
+		}
+	}
+	return false
+}
+
+// Formats a message with the timezone and time format the user picked
+func (p Prefs) format(m Message) string {
+	loc, err := loadLocation(p.Timezone)
+	if err != nil {
+		loc = time.Local
+	}
+	return m.Render(loc, p.TimeFormat, p.Lang)
+}
+
+// Returns a copy of the users preferences
+func (u *User) getPrefs() Prefs {
+	u.prefsMu.Lock()
+	defer u.prefsMu.Unlock()
+	return u.prefs.clone()
+}
+
+// Counts a channel message that was hidden by the users channel settings
+func (u *User) countHidden(channel string) {
+	u.prefsMu.Lock()
+	defer u.prefsMu.Unlock()
+	if u.hidden == nil {
+		u.hidden = map[string]int{}
+	}
+	u.hidden[channel]++
+}
+
+// Returns how many messages were hidden in a channel since the last call and resets the count
+func (u *User) takeHidden(channel string) int {
+	u.prefsMu.Lock()
+	defer u.prefsMu.Unlock()
+	n := u.hidden[channel]
+	delete(u.hidden, channel)
+	return n
+}
+
+// Changes the users preferences and saves them if the user is registered
+func (u *User) updatePrefs(change func(*Prefs)) {
+	u.prefsMu.Lock()
+	if u.prefs.Channels == nil {
+		u.prefs.Channels = map[string]ChannelPrefs{}
+	}
+	change(&u.prefs)
+	p := u.prefs.clone()
+	u.prefsMu.Unlock()
+	if u.registered {
+		putPrefs(u.username, p)
+	}
+}
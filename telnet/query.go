@@ -0,0 +1,162 @@
+package telnet
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// Filters and pagination for searching the message history. Zero values match everything
+type MessageQuery struct {
+	Since   time.Time // Only messages sent at or after this time
+	Until   time.Time // Only messages sent before this time
+	From    string    // Sender
+	Channel string
+	To      string // Recipient of a private message
+	Kind    string
+	After   uint64 // Cursor, only messages with a larger id
+	Before  uint64 // Cursor, only messages with a smaller id
+	Offset  int    // Matches to skip
+	Limit   int    // Most messages to return. 0 returns all matches
+	Tail    bool   // Take the newest matches instead of the oldest
+	Viewer  string // Private messages only match if the viewer sent or received them
+	Admin   bool   // Private messages match whoever sent them
+}
+
+// One page of messages found by a query, oldest first
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	More     bool      `json:"more"`           // There are matches past this page
+	Next     uint64    `json:"next,omitempty"` // Cursor for the next page. Pass as After, or as Before when Tail is set
+}
+
+// Searches the message history. Messages that no longer fit in memory are read back
+// from the history file, only as far as it takes to fill the page
+func QueryMessages(q MessageQuery) MessagePage {
+	historyMu.Lock()
+	recent := append([]Message{}, history...)
+	older := archive[:len(archive):len(archive)]
+	f := historyFile
+	historyMu.Unlock()
+
+	//The archive is in id order, so the cursors narrow it without reading the file
+	low := sort.Search(len(older), func(i int) bool { return older[i].ID > q.After })
+	high := len(older)
+	if q.Before != 0 {
+		high = sort.Search(len(older), func(i int) bool { return older[i].ID >= q.Before })
+	}
+	if low > high {
+		low = high
+	}
+	older = older[low:high]
+
+	//Enough matches to fill the page and tell if there are more. 0 collects them all
+	want := 0
+	if q.Limit > 0 {
+		want = q.Offset + q.Limit + 1
+	}
+	matches := []Message{}
+	full := func() bool {
+		return want > 0 && len(matches) >= want
+	}
+	check := func(m Message) {
+		if q.matches(m) {
+			matches = append(matches, m)
+		}
+	}
+	checkLine := func(line historyLine) {
+		m, err := readHistoryLine(f, line)
+		if err != nil {
+			log.Printf("unable to read message %d from history. err: %s", line.ID, err)
+			return
+		}
+		check(m)
+	}
+	if q.Tail {
+		//Collect from the newest message back, then put the matches in order
+		for i := len(recent) - 1; i >= 0 && !full(); i-- {
+			check(recent[i])
+		}
+		for i := len(older) - 1; i >= 0 && !full(); i-- {
+			checkLine(older[i])
+		}
+		for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+			matches[i], matches[j] = matches[j], matches[i]
+		}
+	} else {
+		for i := 0; i < len(older) && !full(); i++ {
+			checkLine(older[i])
+		}
+		for i := 0; i < len(recent) && !full(); i++ {
+			check(recent[i])
+		}
+	}
+	if q.Tail {
+		//Count the offset and limit back from the newest match
+		end := len(matches) - q.Offset
+		if end < 0 {
+			end = 0
+		}
+		start := 0
+		if q.Limit > 0 && end-q.Limit > 0 {
+			start = end - q.Limit
+		}
+		page := MessagePage{Messages: matches[start:end], More: start > 0}
+		if page.More {
+			page.Next = matches[start].ID
+		}
+		return page
+	}
+	start := q.Offset
+	if start > len(matches) {
+		start = len(matches)
+	}
+	end := len(matches)
+	if q.Limit > 0 && start+q.Limit < end {
+		end = start + q.Limit
+	}
+	page := MessagePage{Messages: matches[start:end], More: end < len(matches)}
+	if page.More {
+		page.Next = matches[end-1].ID
+	}
+	return page
+}
+
+// Checks if a message passes the filters of a query
+func (q MessageQuery) matches(m Message) bool {
+	switch {
+	case !q.Since.IsZero() && m.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !m.Time.Before(q.Until):
+		return false
+	case q.From != "" && m.From != q.From:
+		return false
+	case q.Channel != "" && m.Channel != q.Channel:
+		return false
+	case q.To != "" && m.To != q.To:
+		return false
+	case q.Kind != "" && m.Kind != q.Kind:
+		return false
+	case q.After != 0 && m.ID <= q.After:
+		return false
+	case q.Before != 0 && m.ID >= q.Before:
+		return false
+	case m.To != "" && !q.Admin && (q.Viewer == "" || (m.From != q.Viewer && m.To != q.Viewer)):
+		return false
+	}
+	return true
+}
+
+// Reads a message back from its line in the history file
+func readHistoryLine(f *os.File, line historyLine) (Message, error) {
+	data := make([]byte, line.Size)
+	_, err := f.ReadAt(data, line.Offset)
+	if err != nil {
+		return Message{}, err
+	}
+	var m Message
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
@@ -0,0 +1,94 @@
+package telnet
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Removes control characters and terminal escape sequences from text sent by users so the
+// server is the only thing that can format a terminal. Line breaks become spaces so nobody
+// can start a line that looks like it came from the server
+func sanitize(text string) string {
+	runes := []rune(strings.ToValidUTF8(text, ""))
+	var b strings.Builder
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\x1b':
+			i = skipEscape(runes, i)
+		case r == '\u009b': //8-bit CSI
+			i = skipCSI(runes, i+1)
+		case r == '\u0090' || r == '\u0098' || r == '\u009d' || r == '\u009e' || r == '\u009f': //8-bit DCS, SOS, OSC, PM, APC
+			i = skipString(runes, i+1)
+		case r == '\n' || r == '\r':
+			b.WriteByte(' ')
+		case r == '\t':
+			b.WriteRune(r)
+		case unicode.IsControl(r) || isBidiControl(r):
+			//Dropped
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// Returns the index of the last rune of the escape sequence starting at runes[i]
+func skipEscape(runes []rune, i int) int {
+	if i+1 >= len(runes) {
+		return i
+	}
+	switch next := runes[i+1]; {
+	case next == '[':
+		return skipCSI(runes, i+2)
+	case next == ']' || next == 'P' || next == 'X' || next == '^' || next == '_':
+		return skipString(runes, i+2)
+	case next >= 0x20 && next <= 0x2f: //Intermediate bytes followed by a final byte, e.g. ESC ( B
+		j := i + 1
+		for j < len(runes) && runes[j] >= 0x20 && runes[j] <= 0x2f {
+			j++
+		}
+		if j < len(runes) && runes[j] >= 0x30 && runes[j] <= 0x7e {
+			return j
+		}
+		return j - 1
+	case next >= 0x30 && next <= 0x7e:
+		return i + 1
+	default:
+		return i
+	}
+}
+
+// Returns the index of the last rune of a control sequence whose parameters start at runes[j]
+func skipCSI(runes []rune, j int) int {
+	for j < len(runes) && runes[j] >= 0x30 && runes[j] <= 0x3f {
+		j++
+	}
+	for j < len(runes) && runes[j] >= 0x20 && runes[j] <= 0x2f {
+		j++
+	}
+	if j < len(runes) && runes[j] >= 0x40 && runes[j] <= 0x7e {
+		return j
+	}
+	return j - 1
+}
+
+// Returns the index of the terminator of a control string, such as an OSC title, starting at
+// runes[j]. Unterminated strings run to the end of the text
+func skipString(runes []rune, j int) int {
+	for ; j < len(runes); j++ {
+		if runes[j] == '\a' || runes[j] == '\u009c' {
+			return j
+		}
+		if runes[j] == '\x1b' && j+1 < len(runes) && runes[j+1] == '\\' {
+			return j + 1
+		}
+	}
+	return len(runes) - 1
+}
+
+// Checks for characters that reorder the text around them, which can make a line read
+// differently than it was sent
+func isBidiControl(r rune) bool {
+	return (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
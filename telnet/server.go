@@ -2,47 +2,79 @@ package telnet
 
 import (
 	"bufio"
+	"chatservice/ban"
 	"chatservice/config"
+	"chatservice/locale"
 	"log"
 	"net"
 	"os"
 	"strings"
 	"sync"
+	"time"
 )
 
 // Holds the help menu options for printing
 var helpMenu = map[string]string{
-	"/quit":           "quit chat\n",
-	"/listchannels":   "list all channels\n",
-	"/listusers":      "list all active users\n",
-	"/create":         "create a new channels\n",
-	"/join":           "join a channels\n",
-	"/leave":          "leave a channels\n",
-	"/ignoreuser":     "ignore messsages from a user\n",
-	"/unignoreuser":   "receive messages from ignored user\n",
-	"/pm":             "send private message to user\n",
-	"/sendchannel":    "send message into channel\n",
-	"/listmychannels": "list channels you're subscribed to\n",
-	"/help":           "display help menu\n",
+	"/quit":           "quit chat",
+	"/listchannels":   "list all channels",
+	"/listusers":      "list all active users",
+	"/create":         "create a new channels",
+	"/join":           "join a channels",
+	"/leave":          "leave a channels",
+	"/ignoreuser":     "ignore messsages from a user",
+	"/unignoreuser":   "receive messages from ignored user",
+	"/pm":             "send private message to user",
+	"/sendchannel":    "send message into channel",
+	"/listmychannels": "list channels you're subscribed to",
+	"/me":             "send an action, e.g. /me waves. works in pms and channels too",
+	"/edit":           "edit your message, /edit <id> <text>",
+	"/delete":         "delete your message, /delete <id>",
+	"/reply":          "reply to a channel message, /reply <id> <text>",
+	"/thread":         "show a message thread, /thread <id>",
+	"/register":       "register your username with a password",
+	"/inbox":          "show messages sent while you were away, /inbox clear empties it",
+	"/admin":          "server admin commands, /admin help lists them",
+	"/listignored":    "list users you are ignoring",
+	"/mute":           "hide all messages from a channel, /mute <channel>. /unmute undoes it",
+	"/notify":         "choose channel messages to show, /notify <channel> all|mentions|none",
+	"/timezone":       "show timestamps in a timezone, /timezone Europe/London",
+	"/timeformat":     "choose timestamp format, /timeformat default|us|iso8601|relative",
+	"/lang":           "choose the language of server messages, /lang es",
+	"/help":           "display help menu",
 }
 
-var Channels = map[string][]*User{} // Map to store channel names and the users in the channel
-var Users = map[string]*User{}      // Map of all users. (map instead of slice for simpler lookups and deletes)
+var Channels = map[string][]*User{}   // Map to store channel names and the users in the channel
+var Users = map[string]*User{}        // Map of all users. (map instead of slice for simpler lookups and deletes)
+var Operators = map[string][]string{} // Map of channel names to the usernames of the channels operators
+var stateMu sync.Mutex                // Guards Users, Channels, Operators, Topics and the channels of each user
 
-// Thread safe counter for stats
-type Counter struct {
-	mu sync.Mutex
-	C  int
+// Timeouts from the config. 0 disables each of them
+type timeouts struct {
+	login     time.Duration // Time allowed to finish logging in
+	idle      time.Duration // Time a user can go without sending input
+	keepAlive time.Duration // Time between keepalive probes
 }
 
-// Counter of messages sent
-var MessagesSent = Counter{
-	sync.Mutex{},
-	0,
+var currentTimeouts timeouts
+var timeoutsMu sync.Mutex // A reload can change the timeouts while users are connected
+
+// Returns the timeouts in use
+func getTimeouts() timeouts {
+	timeoutsMu.Lock()
+	defer timeoutsMu.Unlock()
+	return currentTimeouts
+}
+
+// Replaces the timeouts. Users already connected keep their keepalive interval
+func setTimeouts(t timeouts) {
+	timeoutsMu.Lock()
+	defer timeoutsMu.Unlock()
+	currentTimeouts = t
 }
 
 // Inits the telnet server
 func InitTelnetServer(cfg config.Config, shutdown <-chan os.Signal, wg *sync.WaitGroup) {
+	ApplyConfig(cfg)
 
 	listener, err := net.Listen("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
 	if err != nil {
@@ -60,57 +92,202 @@ func InitTelnetServer(cfg config.Config, shutdown <-chan os.Signal, wg *sync.Wai
 			if err != nil {
 				log.Fatalf("could not accept new connection %v", err)
 			}
-
-			go CreateUser(conn)
+			//Let the OS detect dead peers too
+			if tcpConn, ok := conn.(*net.TCPConn); ok {
+				if interval := getTimeouts().keepAlive; interval > 0 {
+					tcpConn.SetKeepAlive(true)
+					tcpConn.SetKeepAlivePeriod(interval)
+				}
+			}
+			go ServeConn(conn)
 		}
 	}
 }
 
+// A connection that is not a telnet client, such as a WebSocket. Chat messages are
+// handed to it whole instead of as formatted text
+type MessageConn interface {
+	net.Conn
+	WriteMessage(m Message) error
+	Ping() error    // Sent in place of telnet NOPs to keep the connection alive
+	Client() string // Kind of client, shown next to the user in /listusers
+}
+
+// Checks a new connection against the bans and connection limits and logs it in.
+// Used for telnet connections and connections accepted by other servers
+func ServeConn(conn net.Conn) {
+	if _, banned := ban.IsBanned(remoteIP(conn)); banned {
+		connectionsRejected.Inc("banned")
+		rejectConnection(conn, "you are banned from this server\n")
+		return
+	}
+	tracked, reason := admitConnection(conn)
+	if tracked == nil {
+		rejectConnection(conn, reason)
+		return
+	}
+	CreateUser(tracked)
+}
+
+// Returns the connection as a MessageConn if it is one
+func messageConn(conn net.Conn) (MessageConn, bool) {
+	if tc, ok := conn.(*trackedConn); ok {
+		conn = tc.Conn
+	}
+	mc, ok := conn.(MessageConn)
+	return mc, ok
+}
+
+// Applies the settings in the config that can change while the server is running
+func ApplyConfig(cfg config.Config) {
+	setTimeouts(timeouts{login: cfg.LoginTimeout, idle: cfg.IdleTimeout, keepAlive: cfg.KeepAliveInterval})
+	setLimits(cfg.MaxConnections, cfg.MaxConnectionsPerIP, cfg.MaxPendingLogins)
+	setAuditLog(cfg.AuditLog)
+	setAdmins(cfg.Admins)
+	setNameRules(cfg)
+}
+
 // Called when a user connects to the server to create an account
 func CreateUser(conn net.Conn) {
 	log.Printf("creating new user. conn: %v", conn.RemoteAddr())
+	if login := getTimeouts().login; login > 0 {
+		conn.SetReadDeadline(time.Now().Add(login))
+	}
 
 	for {
 		//Get user name
-		username, err := ReadInput(conn, "Enter username: ")
+		username, err := ReadInput(conn, locale.T("", "Enter username: "))
 		if err != nil {
-			log.Fatalf("error reading input. err: %s", err)
+			closeLogin(conn, err)
+			return
 		}
 
-		//If user name alrady exists, get a new one
-		if _, ok := Users[username]; ok {
-			conn.Write([]byte("user already exists, please pick another user name\n"))
+		//If user name is invalid or alrady exists, get a new one
+		if err := ValidUsername(username); err != nil {
+			loginsTotal.Inc(clientOf(conn), "invalid_name")
+			conn.Write([]byte(locale.TranslateError("", err) + "\n"))
 		} else {
-			//Create new user
-			user := &User{
-				username:    username,
-				conn:        conn,
-				messageChan: make(chan string),
-				channels:    []string{},
-				ignored:     []*User{},
-				closeChan:   make(chan bool),
+			//Registered users must log in with their password
+			registered := Registered(username)
+			if registered {
+				password, err := ReadInput(conn, locale.T("", "Enter password: "))
+				if err != nil {
+					closeLogin(conn, err)
+					return
+				}
+				if !CheckPassword(username, password) {
+					log.Printf("failed login for user: %s from: %v", username, conn.RemoteAddr())
+					loginsTotal.Inc(clientOf(conn), "bad_password")
+					conn.Write([]byte(locale.T("", "incorrect password") + "\n"))
+					continue
+				}
 			}
-			Users[username] = user
-
-			log.Printf("new user created. conn: %v, username: %s", user.conn.RemoteAddr(), user.username)
-
-			//Start go routines for user
-			go user.ReadFromCLI()
-			go user.ReceiveMessage()
-			err := PrintHelpMenu(user.conn)
+			user := startUser(conn, username, registered)
+			err := PrintHelpMenu(user.conn, user.lang())
 			if err != nil {
 				log.Fatalf("unable to print help menu. err:%s", err)
 			}
 
-			_, err = user.conn.Write([]byte("Welcome to the chat serivce\n"))
+			_, err = user.conn.Write([]byte(user.t("Welcome to the chat serivce") + "\n"))
 			if err != nil {
 				log.Fatalf("unable to write welcome message. err:%s", err)
 			}
+			if registered {
+				err = user.deliverMail()
+				if err != nil {
+					log.Printf("unable to deliver mail to user: %s. err: %s", username, err)
+				}
+			}
 			break
 		}
 	}
 }
 
+// Logs in a connection with credentials sent up front instead of prompting for them,
+// such as an http session. The connection is checked like ServeConn and closed if
+// the login fails
+func Login(conn net.Conn, username string, password string) (*User, error) {
+	if _, banned := ban.IsBanned(remoteIP(conn)); banned {
+		connectionsRejected.Inc("banned")
+		conn.Close()
+		return nil, ErrBanned
+	}
+	tracked, reason := admitConnection(conn)
+	if tracked == nil {
+		conn.Close()
+		return nil, locale.Errorf(strings.TrimSpace(reason))
+	}
+	username = sanitize(username)
+	err := ValidUsername(username)
+	if err != nil {
+		loginsTotal.Inc(clientOf(conn), "invalid_name")
+		tracked.Close()
+		return nil, err
+	}
+	registered := Registered(username)
+	if registered && !CheckPassword(username, password) {
+		log.Printf("failed login for user: %s from: %v", username, conn.RemoteAddr())
+		loginsTotal.Inc(clientOf(conn), "bad_password")
+		tracked.Close()
+		return nil, ErrBadPassword
+	}
+	user := startUser(tracked, username, registered)
+	if registered {
+		err = user.deliverMail()
+		if err != nil {
+			log.Printf("unable to deliver mail to user: %s. err: %s", username, err)
+		}
+	}
+	return user, nil
+}
+
+// Creates a user for a connection that logged in and starts its go routines
+func startUser(conn net.Conn, username string, registered bool) *User {
+	user := &User{
+		username:    username,
+		conn:        conn,
+		messageChan: make(chan Message),
+		channels:    []string{},
+		closeChan:   make(chan bool),
+		registered:  registered,
+	}
+	if registered {
+		user.prefs = getPrefs(username)
+	}
+	stateMu.Lock()
+	Users[username] = user
+	stateMu.Unlock()
+	conn.SetReadDeadline(time.Time{})
+	loginComplete(conn)
+	loginsTotal.Inc(user.Client(), "ok")
+
+	log.Printf("new user created. conn: %v, username: %s", user.conn.RemoteAddr(), user.username)
+	emitEvent(Event{Type: EventConnect, User: user.username})
+
+	//Start go routines for user
+	go user.ReadFromCLI()
+	go user.ReceiveMessage()
+	if interval := getTimeouts().keepAlive; interval > 0 {
+		go user.keepAlive(interval)
+	}
+	return user
+}
+
+// Closes a connection that failed to log in
+func closeLogin(conn net.Conn, err error) {
+	if isTimeout(err) {
+		conn.Write([]byte("\n" + locale.T("", "login timed out") + "\n"))
+	}
+	log.Printf("login failed for conn: %v. err: %s", conn.RemoteAddr(), err)
+	conn.Close()
+}
+
+// Checks if an error was caused by a connection deadline passing
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
 // Used to prompt user for input as well as just reading what they submit through the cli
 func ReadInput(conn net.Conn, msg string) (string, error) {
 	conn.Write([]byte(msg))
@@ -119,18 +296,18 @@ func ReadInput(conn net.Conn, msg string) (string, error) {
 		log.Printf("readinput: could not read input from stdin: %v from client %v", err, conn.RemoteAddr().String())
 		return "", err
 	}
-	s = strings.Trim(s, "\r\n")
+	s = sanitize(strings.Trim(s, "\r\n"))
 	return s, nil
 }
 
-// Print the help menu to the user
-func PrintHelpMenu(conn net.Conn) error {
-	_, err := conn.Write([]byte("/**************Help Menu***************/\n"))
+// Print the help menu to the user in a language
+func PrintHelpMenu(conn net.Conn, lang string) error {
+	_, err := conn.Write([]byte("/**************" + locale.T(lang, "Help Menu") + "***************/\n"))
 	if err != nil {
 		return err
 	}
 	for k, v := range helpMenu {
-		_, err = conn.Write([]byte(k + " | " + v))
+		_, err = conn.Write([]byte(k + " | " + locale.T(lang, v) + "\n"))
 		if err != nil {
 			return err
 		}
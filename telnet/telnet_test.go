@@ -2,11 +2,19 @@ package telnet
 
 import (
 	"bytes"
+	"chatservice/ban"
 	"chatservice/config"
+	"chatservice/locale"
+	"io"
 	"net"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 var cfg config.Config
@@ -105,6 +113,13 @@ func TestInitTelNetServer(t *testing.T) {
 			},
 			[]byte("Left channel: foochannel"),
 		},
+		{
+			"emote",
+			[][]byte{
+				[]byte("/me waves\n"),
+			},
+			[]byte("* foouser waves"),
+		},
 		{
 			"help menu",
 			[][]byte{
@@ -120,7 +135,7 @@ func TestInitTelNetServer(t *testing.T) {
 			time.Sleep(time.Second / 10)
 		}
 		//Verify its what is expected
-		out := make([]byte, 1024)
+		out := make([]byte, 4096)
 		if _, err := conn.Read(out); err == nil {
 			if !bytes.Contains(out, tt.want) {
 				t.Error(tt.name+" test failed. got: "+string(out)+" want: ", string(tt.want))
@@ -195,6 +210,19 @@ func TestInitTelNetServer(t *testing.T) {
 			[]byte(""),
 			[]byte("fooMessage"),
 		},
+		{
+			"emote in channel",
+			[][]byte{
+				[]byte("/sendchannel\n"),
+				[]byte("foochannel\n"),
+				[]byte("/me dances\n"),
+			},
+			[][]byte{
+				[]byte("\n"),
+			},
+			[]byte(""),
+			[]byte("foochannel|* foouser dances"),
+		},
 		{
 			"ignore from all",
 			[][]byte{
@@ -246,14 +274,14 @@ func TestInitTelNetServer(t *testing.T) {
 			time.Sleep(time.Second / 10)
 		}
 		//First user expectations
-		out := make([]byte, 1024)
+		out := make([]byte, 4096)
 		if _, err := conn.Read(out); err == nil {
 			if !bytes.Contains(out, tt.u1Response) {
 				t.Error(tt.name+" test failed. got: "+string(out)+" want: ", string(tt.u1Response))
 			}
 		}
 		//Second user expectations
-		out = make([]byte, 1024)
+		out = make([]byte, 4096)
 		if _, err := conn2.Read(out); err == nil {
 			if !bytes.Contains(out, tt.u2Response) {
 				t.Error(tt.name+" test failed. got: "+string(out)+" want: ", string(tt.u2Response))
@@ -261,29 +289,99 @@ func TestInitTelNetServer(t *testing.T) {
 		}
 	}
 
+	//Edit and delete tests
+	var lastID uint64
+	for _, m := range History() {
+		if m.From == "foouser" && m.Channel == "foochannel" {
+			lastID = m.ID
+		}
+	}
+	id := strconv.FormatUint(lastID, 10)
+	tests3 := []struct {
+		name       string
+		conn       net.Conn
+		action     []byte
+		u1Response []byte
+		u2Response []byte
+	}{
+		{
+			"edit",
+			conn,
+			[]byte("/edit " + id + " fixedMessage\n"),
+			[]byte("Edited message: " + id),
+			[]byte("edited message " + id + ": fixedMessage"),
+		},
+		{
+			"reply",
+			conn2,
+			[]byte("/reply " + id + " soundsGood\n"),
+			[]byte("> foouser: fixedMessage"),
+			[]byte("soundsGood"),
+		},
+		{
+			"thread",
+			conn,
+			[]byte("/thread " + id + "\n"),
+			[]byte("|baruser|foochannel|soundsGood"),
+			[]byte(""),
+		},
+		{
+			"delete not allowed",
+			conn2,
+			[]byte("/delete " + id + "\n"),
+			[]byte(""),
+			[]byte("only the author or a channel operator"),
+		},
+		{
+			"delete",
+			conn,
+			[]byte("/delete " + id + "\n"),
+			[]byte("Deleted message: " + id),
+			[]byte("deleted message " + id),
+		},
+	}
+	for _, tt := range tests3 {
+		tt.conn.Write(tt.action)
+		time.Sleep(time.Second / 10)
+		for _, expect := range []struct {
+			conn net.Conn
+			want []byte
+		}{{conn, tt.u1Response}, {conn2, tt.u2Response}} {
+			if len(expect.want) == 0 {
+				continue
+			}
+			out := make([]byte, 4096)
+			if _, err := expect.conn.Read(out); err == nil {
+				if !bytes.Contains(out, expect.want) {
+					t.Error(tt.name+" test failed. got: "+string(out)+" want: ", string(expect.want))
+				}
+			}
+		}
+	}
+
 	//HTTP tests
-	HTTPSendChannelMessage("hello", "foochannel", Channels["foochannel"])
+	SendKindAs("http", KindMessage, "foochannel", "", "hello")
 	time.Sleep(time.Second / 10)
-	out := make([]byte, 1024)
+	out := make([]byte, 4096)
 	if _, err := conn.Read(out); err == nil {
 		if !bytes.Contains(out, []byte("http")) {
-			t.Error("HTTPSendChannelMessage test failed. got: " + string(out) + " want: ")
+			t.Error("http channel message test failed. got: " + string(out) + " want: ")
 		}
 	}
-	HTTPSendUserMessage("hello", Users["foouser"])
+	SendKindAs("http", KindMessage, "", "foouser", "hello")
 	time.Sleep(time.Second / 10)
-	out = make([]byte, 1024)
+	out = make([]byte, 4096)
 	if _, err := conn.Read(out); err == nil {
 		if !bytes.Contains(out, []byte("http")) {
-			t.Error("HTTPSendChannelMessage test failed. got: " + string(out) + " want: ")
+			t.Error("http pm test failed. got: " + string(out) + " want: ")
 		}
 	}
-	HTTPSendAllMessage("hello")
+	SendKindAs("http", KindMessage, "", "", "hello")
 	time.Sleep(time.Second / 10)
-	out = make([]byte, 1024)
+	out = make([]byte, 4096)
 	if _, err := conn.Read(out); err == nil {
 		if !bytes.Contains(out, []byte("http")) {
-			t.Error("HTTPSendChannelMessage test failed. got: " + string(out) + " want: ")
+			t.Error("http message to all test failed. got: " + string(out) + " want: ")
 		}
 	}
 
@@ -291,3 +389,1114 @@ func TestInitTelNetServer(t *testing.T) {
 	conn.Write([]byte("/quit\n"))
 	conn2.Write([]byte("/quit\n"))
 }
+
+func TestMessageString(t *testing.T) {
+	sent := time.Date(2023, 7, 17, 10, 12, 51, 0, time.Local)
+	tests := []struct {
+		name string
+		msg  Message
+		want string
+	}{
+		{"broadcast", Message{Time: sent, Kind: KindMessage, From: "foo", Text: "hi"}, "17/07/2023 10:12:51|foo|hi"},
+		{"channel", Message{Time: sent, Kind: KindMessage, From: "foo", Channel: "bar", Text: "hi"}, "17/07/2023 10:12:51|foo|bar|hi"},
+		{"action", Message{Time: sent, Kind: KindAction, From: "foo", Text: "waves"}, "17/07/2023 10:12:51|* foo waves"},
+		{"channel action", Message{Time: sent, Kind: KindAction, From: "foo", Channel: "bar", Text: "waves"}, "17/07/2023 10:12:51|bar|* foo waves"},
+	}
+	for _, tt := range tests {
+		if got := tt.msg.String(); got != tt.want {
+			t.Error(tt.name + " test failed. got: " + got + " want: " + tt.want)
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	path := t.TempDir() + "/history.txt"
+	if err := LoadHistory(path); err != nil {
+		t.Fatal("could not load history: ", err)
+	}
+	SendAs("historian", "", "", "remember me")
+	SendKindAs("http", KindAction, "", "", "waves")
+
+	//Reload from disk and check both kinds were stored
+	if err := LoadHistory(path); err != nil {
+		t.Fatal("could not reload history: ", err)
+	}
+	h := History()
+	if len(h) != 2 {
+		t.Fatalf("expected 2 messages in history, got %d", len(h))
+	}
+	if h[0].Kind != KindMessage || h[0].Text != "remember me" {
+		t.Error("first history message wrong: ", h[0])
+	}
+	if h[1].Kind != KindAction || h[1].From != "http" {
+		t.Error("second history message wrong: ", h[1])
+	}
+
+	//Edits and deletes are persisted and only allowed for the author
+	if err := EditMessage(h[0].ID, "historian", "changed"); err != nil {
+		t.Error("could not edit message: ", err)
+	}
+	if err := DeleteMessage(h[1].ID, "historian"); err == nil {
+		t.Error("expected delete by someone other than the author to fail")
+	}
+	if err := DeleteMessage(h[1].ID, "http"); err != nil {
+		t.Error("could not delete message: ", err)
+	}
+	if err := LoadHistory(path); err != nil {
+		t.Fatal("could not reload history: ", err)
+	}
+	h = History()
+	if len(h) != 2 || h[0].Text != "changed" || !h[0].Edited || !h[1].Deleted {
+		t.Error("edits not persisted: ", h)
+	}
+}
+
+func TestQueryMessages(t *testing.T) {
+	if err := LoadHistory(t.TempDir() + "/history.txt"); err != nil {
+		t.Fatal("could not load history: ", err)
+	}
+	if err := CreateChannel("querychan", "tester"); err != nil {
+		t.Fatal("could not create channel: ", err)
+	}
+	defer CloseChannel("querychan", "tester")
+	SendAs("alice", "", "", "one")
+	SendAs("bob", "querychan", "", "two")
+	SendKindAs("http", KindAction, "", "", "three")
+	SendAs("alice", "querychan", "", "four")
+	h := History()
+	if len(h) != 4 {
+		t.Fatalf("expected 4 messages in history, got %d", len(h))
+	}
+
+	tests := []struct {
+		name     string
+		query    MessageQuery
+		expected []string
+		next     uint64
+	}{
+		{"all", MessageQuery{}, []string{"one", "two", "three", "four"}, 0},
+		{"sender", MessageQuery{From: "alice"}, []string{"one", "four"}, 0},
+		{"channel", MessageQuery{Channel: "querychan"}, []string{"two", "four"}, 0},
+		{"kind", MessageQuery{Kind: KindAction}, []string{"three"}, 0},
+		{"time range", MessageQuery{Since: h[1].Time, Until: h[3].Time.Add(time.Second)}, []string{"two", "three", "four"}, 0},
+		{"empty range", MessageQuery{Until: h[0].Time}, []string{}, 0},
+		{"limit", MessageQuery{Limit: 2}, []string{"one", "two"}, h[1].ID},
+		{"after cursor", MessageQuery{After: h[1].ID, Limit: 2}, []string{"three", "four"}, 0},
+		{"offset", MessageQuery{Offset: 3}, []string{"four"}, 0},
+		{"tail", MessageQuery{Limit: 1, Tail: true}, []string{"four"}, h[3].ID},
+		{"before cursor", MessageQuery{Before: h[3].ID, Limit: 2, Tail: true}, []string{"two", "three"}, h[1].ID},
+	}
+	for _, tt := range tests {
+		page := QueryMessages(tt.query)
+		texts := []string{}
+		for _, m := range page.Messages {
+			texts = append(texts, m.Text)
+		}
+		if strings.Join(texts, ",") != strings.Join(tt.expected, ",") || page.Next != tt.next || page.More != (tt.next != 0) {
+			t.Errorf("%s: expected %v next %d but got %v next %d more %v", tt.name, tt.expected, tt.next, texts, page.Next, page.More)
+		}
+	}
+}
+
+func TestQueryArchivedMessages(t *testing.T) {
+	path := t.TempDir() + "/history.txt"
+	if err := LoadHistory(path); err != nil {
+		t.Fatal("could not load history: ", err)
+	}
+	SendAs("archivist", "", "", "first")
+	first := History()[0].ID
+	if err := EditMessage(first, "archivist", "first edited"); err != nil {
+		t.Fatal("could not edit: ", err)
+	}
+	SendAs("archivist", "", "", "second")
+	//Push both out of memory
+	for i := 0; i < maxHistory; i++ {
+		SendAs("filler", "", "", "filler")
+	}
+
+	check := func(name string) {
+		tests := []struct {
+			name     string
+			query    MessageQuery
+			expected []string
+			more     bool
+		}{
+			{"oldest", MessageQuery{Limit: 2}, []string{"first edited", "second"}, true},
+			{"sender", MessageQuery{From: "archivist"}, []string{"first edited", "second"}, false},
+			{"after cursor", MessageQuery{After: first, Limit: 1}, []string{"second"}, true},
+			{"before cursor", MessageQuery{Before: first + 1, Limit: 5, Tail: true}, []string{"first edited"}, false},
+			{"tail", MessageQuery{Limit: 1, Tail: true}, []string{"filler"}, true},
+		}
+		for _, tt := range tests {
+			page := QueryMessages(tt.query)
+			texts := []string{}
+			for _, m := range page.Messages {
+				texts = append(texts, m.Text)
+			}
+			if strings.Join(texts, ",") != strings.Join(tt.expected, ",") || page.More != tt.more {
+				t.Errorf("%s %s: expected %v more %v but got %v more %v", name, tt.name, tt.expected, tt.more, texts, page.More)
+			}
+		}
+	}
+	check("recorded")
+	if err := LoadHistory(path); err != nil {
+		t.Fatal("could not reload history: ", err)
+	}
+	check("reloaded")
+}
+
+// A MessageConn that keeps the messages it is sent
+type testMessageConn struct {
+	net.Conn
+	messages chan Message
+}
+
+func (c *testMessageConn) WriteMessage(m Message) error {
+	c.messages <- m
+	return nil
+}
+func (c *testMessageConn) Ping() error    { return nil }
+func (c *testMessageConn) Client() string { return "test" }
+
+func TestLogin(t *testing.T) {
+	if err := Register("loginuser", "secret"); err != nil {
+		t.Fatal("could not register: ", err)
+	}
+	newConn := func() *testMessageConn {
+		server, client := net.Pipe()
+		t.Cleanup(func() { client.Close() })
+		return &testMessageConn{Conn: server, messages: make(chan Message, 10)}
+	}
+	if _, err := Login(newConn(), "loginuser", "wrong"); err != ErrBadPassword {
+		t.Error("expected a wrong password to fail, got: ", err)
+	}
+	user, err := Login(newConn(), "loginuser", "secret")
+	if err != nil {
+		t.Fatal("could not log in: ", err)
+	}
+	if _, err := Login(newConn(), "loginuser", "secret"); err != ErrUsernameTaken {
+		t.Error("expected a second login to fail, got: ", err)
+	}
+	if user.Client() != "test" {
+		t.Error("expected the client of the connection but got ", user.Client())
+	}
+
+	//Messages arrive whole instead of as text
+	conn := user.conn.(*trackedConn).Conn.(*testMessageConn)
+	if err := SendKindAs("someone", KindAction, "", "loginuser", "waves"); err != nil {
+		t.Fatal("could not send: ", err)
+	}
+	select {
+	case m := <-conn.messages:
+		if m.From != "someone" || m.Kind != KindAction || m.Text != "waves" || m.To != "loginuser" {
+			t.Error("wrong message: ", m)
+		}
+	case <-time.After(time.Second):
+		t.Error("expected to receive the message")
+	}
+
+	if err := Logout("loginuser"); err != nil {
+		t.Error("could not log out: ", err)
+	}
+	if _, ok := OnlineUser("loginuser"); ok {
+		t.Error("expected the user to be logged out")
+	}
+}
+
+func TestMailbox(t *testing.T) {
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+		if err != nil {
+			t.Fatal("could not connect to TCP server: ", err)
+		}
+		return conn
+	}
+	conn := dial()
+	defer conn.Close()
+	conn2 := dial()
+	defer conn2.Close()
+	var conn3 net.Conn
+
+	tests := []struct {
+		name    string
+		conn    *net.Conn
+		payload [][]byte
+		want    []byte
+	}{
+		{
+			"register",
+			&conn,
+			[][]byte{
+				[]byte("mailuser\n"),
+				[]byte("/register\n"),
+				[]byte("secret\n"),
+				[]byte("secret\n"),
+			},
+			[]byte("Registered user: mailuser"),
+		},
+		{
+			"quit",
+			&conn,
+			[][]byte{
+				[]byte("/quit\n"),
+			},
+			[]byte("You have quit the chat"),
+		},
+		{
+			"pm offline user",
+			&conn2,
+			[][]byte{
+				[]byte("mailsender\n"),
+				[]byte("/pm\n"),
+				[]byte("mailuser\n"),
+				[]byte("helloLater\n"),
+			},
+			[]byte("Message saved to mailbox of: mailuser"),
+		},
+		{
+			"wrong password",
+			&conn3,
+			[][]byte{
+				[]byte("mailuser\n"),
+				[]byte("wrong\n"),
+			},
+			[]byte("incorrect password"),
+		},
+		{
+			"login with mail",
+			&conn3,
+			[][]byte{
+				[]byte("mailuser\n"),
+				[]byte("secret\n"),
+			},
+			[]byte("While you were away you received 1 message from mailsender (1)"),
+		},
+		{
+			"inbox",
+			&conn3,
+			[][]byte{
+				[]byte("/inbox\n"),
+			},
+			[]byte("|mailsender|helloLater"),
+		},
+	}
+	for _, tt := range tests {
+		if *tt.conn == nil {
+			*tt.conn = dial()
+			defer (*tt.conn).Close()
+		}
+		for _, send := range tt.payload {
+			(*tt.conn).Write(send)
+			time.Sleep(time.Second / 10)
+		}
+		out := make([]byte, 4096)
+		if _, err := (*tt.conn).Read(out); err == nil {
+			if !bytes.Contains(out, tt.want) {
+				t.Error(tt.name+" test failed. got: "+string(out)+" want: ", string(tt.want))
+			}
+		}
+	}
+	conn2.Write([]byte("/quit\n"))
+	conn3.Write([]byte("/quit\n"))
+}
+
+func TestMailboxLimit(t *testing.T) {
+	defer LoadMailboxes("", defaultMailboxLimit)
+	if err := LoadMailboxes("", 2); err != nil {
+		t.Fatal("could not load mailboxes: ", err)
+	}
+	if err := Register("fullbox", "secret"); err != nil {
+		t.Fatal("could not register: ", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := SendAs("filler", "", "fullbox", "hello"); err != nil {
+			t.Error("could not send offline message: ", err)
+		}
+	}
+	if err := SendAs("filler", "", "fullbox", "hello"); err == nil {
+		t.Error("expected full mailbox to reject message")
+	}
+	//Read messages make room for new ones
+	readMail("fullbox")
+	if err := SendAs("filler", "", "fullbox", "hello"); err != nil {
+		t.Error("could not send offline message after reading: ", err)
+	}
+	if err := SendAs("filler", "", "nobody", "hello"); err == nil {
+		t.Error("expected message to unregistered offline user to fail")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	setTimeouts(timeouts{login: time.Second / 5, idle: time.Second / 5})
+	defer setTimeouts(timeouts{})
+
+	//Login timeout closes the connection
+	conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, _ := io.ReadAll(conn)
+	if !bytes.Contains(out, []byte("login timed out")) {
+		t.Error("login timeout test failed. got: " + string(out))
+	}
+
+	//Idle users are disconnected and cleaned up
+	conn2, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	defer conn2.Close()
+	conn2.Write([]byte("idleuser\n"))
+	conn2.SetReadDeadline(time.Now().Add(2 * time.Second))
+	out, _ = io.ReadAll(conn2)
+	if !bytes.Contains(out, []byte("Disconnected for being idle")) {
+		t.Error("idle timeout test failed. got: " + string(out))
+	}
+	if _, ok := OnlineUser("idleuser"); ok {
+		t.Error("idle user was not removed")
+	}
+}
+
+func TestDeadPeerCleanup(t *testing.T) {
+	setTimeouts(timeouts{keepAlive: time.Second / 10})
+	defer setTimeouts(timeouts{})
+
+	conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	if err := CreateChannel("deadchannel", "tester"); err != nil {
+		t.Fatal("could not create channel: ", err)
+	}
+	for _, send := range []string{"deaduser\n", "/join\n", "deadchannel\n"} {
+		conn.Write([]byte(send))
+		time.Sleep(time.Second / 10)
+	}
+	if members, _ := channelMembers("deadchannel"); len(members) != 1 {
+		t.Fatal("user did not join channel")
+	}
+	//Peer goes away without quitting
+	conn.Close()
+	time.Sleep(time.Second / 2)
+	if _, ok := OnlineUser("deaduser"); ok {
+		t.Error("dead user was not removed")
+	}
+	if members, _ := channelMembers("deadchannel"); len(members) != 0 {
+		t.Error("dead user was not removed from channel")
+	}
+}
+
+func TestConnectionLimits(t *testing.T) {
+	defer setLimits(0, 0, 0)
+	//Limits are guarded by connMu since the server reads them
+	setLimit := func(limit *int, value int) {
+		connMu.Lock()
+		defer connMu.Unlock()
+		*limit = value
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+		if err != nil {
+			t.Fatal("could not connect to TCP server: ", err)
+		}
+		time.Sleep(time.Second / 10)
+		return conn
+	}
+	//Leave room for exactly one more connection under each limit
+	stats := GetConnectionStats()
+	connMu.Lock()
+	perIP := connsPerIP["127.0.0.1"]
+	connMu.Unlock()
+	tests := []struct {
+		name  string
+		limit *int
+		value int
+		want  []byte
+	}{
+		{"max connections", &maxConnections, stats.Connections + 1, []byte("server is full")},
+		{"max per ip", &maxConnectionsPerIP, perIP + 1, []byte("too many connections from your address")},
+		{"max pending logins", &maxPendingLogins, stats.PendingLogins + 1, []byte("too many logins in progress")},
+	}
+	for _, tt := range tests {
+		setLimit(tt.limit, tt.value)
+		allowed := dial()
+		rejected := dial()
+		rejected.SetReadDeadline(time.Now().Add(time.Second))
+		out, _ := io.ReadAll(rejected)
+		if !bytes.Contains(out, tt.want) {
+			t.Error(tt.name+" test failed. got: "+string(out)+" want: ", string(tt.want))
+		}
+		rejected.Close()
+		allowed.Close()
+		setLimit(tt.limit, 0)
+		time.Sleep(time.Second / 10)
+	}
+	if got := GetConnectionStats(); got.RejectedMaxConns != 1 || got.RejectedPerIP != 1 || got.RejectedPendingLogins != 1 {
+		t.Error("rejections not counted: ", got)
+	}
+}
+
+func TestBannedConnection(t *testing.T) {
+	if _, err := ban.Add("127.0.0.1", 0, "testing", "tester"); err != nil {
+		t.Fatal("could not add ban: ", err)
+	}
+	defer ban.Remove("127.0.0.1")
+
+	conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	out, _ := io.ReadAll(conn)
+	if !bytes.Contains(out, []byte("you are banned from this server")) {
+		t.Error("banned connection test failed. got: " + string(out))
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	auditPath := t.TempDir() + "/audit.txt"
+	setAuditLog(auditPath)
+	defer setAuditLog("")
+	setAdmins([]string{"rootuser"})
+	defer setAdmins(nil)
+	if err := Register("rootuser", "secret"); err != nil {
+		t.Fatal("could not register: ", err)
+	}
+	shutdownCalled := false
+	Shutdown = func() { shutdownCalled = true }
+
+	conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	defer conn.Close()
+	conn2, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	defer conn2.Close()
+
+	tests := []struct {
+		name    string
+		conn    net.Conn
+		payload [][]byte
+		want    []byte
+	}{
+		{
+			"login admin",
+			conn,
+			[][]byte{
+				[]byte("rootuser\n"),
+				[]byte("secret\n"),
+			},
+			[]byte("Welcome"),
+		},
+		{
+			"login user",
+			conn2,
+			[][]byte{
+				[]byte("plainuser\n"),
+				[]byte("/create\n"),
+				[]byte("doomedchannel\n"),
+				[]byte("/join\n"),
+				[]byte("doomedchannel\n"),
+			},
+			[]byte("Joined channel: doomedchannel"),
+		},
+		{
+			"not an admin",
+			conn2,
+			[][]byte{
+				[]byte("/admin broadcast hi\n"),
+			},
+			[]byte("permission denied"),
+		},
+		{
+			"broadcast",
+			conn,
+			[][]byte{
+				[]byte("/admin broadcast maintenance soon\n"),
+			},
+			[]byte("*** maintenance soon"),
+		},
+		{
+			"broadcast received",
+			conn2,
+			[][]byte{},
+			[]byte("*** maintenance soon"),
+		},
+		{
+			"close channel",
+			conn,
+			[][]byte{
+				[]byte("/admin closechannel doomedchannel\n"),
+			},
+			[]byte("Closed channel: doomedchannel"),
+		},
+		{
+			"channel closed",
+			conn2,
+			[][]byte{},
+			[]byte("Channel: doomedchannel was closed"),
+		},
+		{
+			"kick",
+			conn,
+			[][]byte{
+				[]byte("/admin kick plainuser spam\n"),
+			},
+			[]byte("Kicked user: plainuser"),
+		},
+		{
+			"kicked",
+			conn2,
+			[][]byte{},
+			[]byte("You have been kicked from the chat. reason: spam"),
+		},
+		{
+			"add api key",
+			conn,
+			[][]byte{
+				[]byte("/admin apikey add deploybot send+stats\n"),
+			},
+			[]byte("Added API key: deploybot. It will not be shown again: "),
+		},
+		{
+			"list api keys",
+			conn,
+			[][]byte{
+				[]byte("/admin apikey list\n"),
+			},
+			[]byte("deploybot: send+stats"),
+		},
+		{
+			"bad api key scope",
+			conn,
+			[][]byte{
+				[]byte("/admin apikey add otherbot fly\n"),
+			},
+			[]byte("unknown scope: fly"),
+		},
+		{
+			"remove api key",
+			conn,
+			[][]byte{
+				[]byte("/admin apikey remove deploybot\n"),
+			},
+			[]byte("Removed API key: deploybot"),
+		},
+		{
+			"add incoming webhook",
+			conn,
+			[][]byte{
+				[]byte("/admin hook add alertbot alerts\n"),
+			},
+			[]byte("Added incoming webhook: alertbot. Post to /api/v1/hooks/"),
+		},
+		{
+			"list incoming webhooks",
+			conn,
+			[][]byte{
+				[]byte("/admin hook list\n"),
+			},
+			[]byte("alertbot: alerts"),
+		},
+		{
+			"remove incoming webhook",
+			conn,
+			[][]byte{
+				[]byte("/admin hook remove alertbot\n"),
+			},
+			[]byte("Removed incoming webhook: alertbot"),
+		},
+		{
+			"shutdown",
+			conn,
+			[][]byte{
+				[]byte("/admin shutdown\n"),
+			},
+			[]byte("*** server is shutting down"),
+		},
+	}
+	for _, tt := range tests {
+		for _, send := range tt.payload {
+			tt.conn.Write(send)
+			time.Sleep(time.Second / 10)
+		}
+		out := make([]byte, 4096)
+		tt.conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, err := tt.conn.Read(out); err == nil {
+			if !bytes.Contains(out, tt.want) {
+				t.Error(tt.name+" test failed. got: "+string(out)+" want: ", string(tt.want))
+			}
+		} else {
+			t.Error(tt.name+" test failed. err: ", err)
+		}
+	}
+	if ChannelExists("doomedchannel") {
+		t.Error("channel was not closed")
+	}
+	if !shutdownCalled {
+		t.Error("shutdown was not called")
+	}
+	if commandsTotal.Value("/admin") < 10 || errorsTotal.Value("command") < 1 {
+		t.Error("admin commands were not counted")
+	}
+
+	//Every admin command is audited, including denied ones
+	contents, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatal("could not read audit log: ", err)
+	}
+	for _, want := range []string{
+		`admin=plainuser command=broadcast args="hi" result="denied"`,
+		`admin=rootuser command=kick args="plainuser spam" result="ok"`,
+		`admin=rootuser command=closechannel args="doomedchannel" result="ok"`,
+		`admin=rootuser command=apikey args="add deploybot send+stats" result="ok"`,
+	} {
+		if !bytes.Contains(contents, []byte(want)) {
+			t.Error("audit log missing: " + want + " got: " + string(contents))
+		}
+	}
+	conn.Write([]byte("/quit\n"))
+}
+
+func TestIgnores(t *testing.T) {
+	if err := Register("ignorer", "secret"); err != nil {
+		t.Fatal("could not register: ", err)
+	}
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+		if err != nil {
+			t.Fatal("could not connect to TCP server: ", err)
+		}
+		return conn
+	}
+	send := func(conn net.Conn, lines ...string) []byte {
+		for _, line := range lines {
+			conn.Write([]byte(line + "\n"))
+			time.Sleep(time.Second / 10)
+		}
+		out := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(out)
+		return out[:n]
+	}
+	conn := dial()
+	defer conn.Close()
+	pest := dial()
+	defer pest.Close()
+
+	send(conn, "ignorer", "secret")
+	send(pest, "pest")
+	if out := send(conn, "/ignoreuser", "pest"); !bytes.Contains(out, []byte("Ignored user: pest")) {
+		t.Error("ignore user test failed. got: " + string(out))
+	}
+	if out := send(conn, "/ignoreuser", "http"); !bytes.Contains(out, []byte("Ignored user: http")) {
+		t.Error("ignore http test failed. got: " + string(out))
+	}
+	if out := send(conn, "/ignoreuser", "nobody"); !bytes.Contains(out, []byte("Ignored user: nobody")) {
+		t.Error("ignore offline user test failed. got: " + string(out))
+	}
+	if out := send(conn, "/ignoreuser", "no|body"); !bytes.Contains(out, []byte("name can not contain '|'")) {
+		t.Error("ignore invalid name test failed. got: " + string(out))
+	}
+	send(conn, "/quit")
+
+	//Ignores are kept after logging in again
+	conn = dial()
+	defer conn.Close()
+	send(conn, "ignorer", "secret")
+	if out := send(conn, "/listignored"); !bytes.Contains(out, []byte("pest\nhttp\n")) {
+		t.Error("list ignored test failed. got: " + string(out))
+	}
+
+	//Broadcast, pm and http messages from ignored senders are hidden
+	pest.Write([]byte("pestBroadcast\n"))
+	time.Sleep(time.Second / 10)
+	send(pest, "/pm", "ignorer", "pestPM")
+	SendKindAs("http", KindMessage, "", "", "httpMessage")
+	SendAs("friend", "", "ignorer", "friendMessage")
+	time.Sleep(time.Second / 10)
+	out := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _ := conn.Read(out)
+	out = out[:n]
+	if !bytes.Contains(out, []byte("friendMessage")) {
+		t.Error("expected message from friend. got: " + string(out))
+	}
+	for _, hidden := range []string{"pestBroadcast", "pestPM", "httpMessage"} {
+		if bytes.Contains(out, []byte(hidden)) {
+			t.Error("expected " + hidden + " to be ignored. got: " + string(out))
+		}
+	}
+	if out := send(conn, "/unignoreuser", "pest"); !bytes.Contains(out, []byte("Unignored user: pest")) {
+		t.Error("unignore test failed. got: " + string(out))
+	}
+	conn.Write([]byte("/quit\n"))
+	pest.Write([]byte("/quit\n"))
+}
+
+func TestChannelNotifications(t *testing.T) {
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+		if err != nil {
+			t.Fatal("could not connect to TCP server: ", err)
+		}
+		return conn
+	}
+	send := func(conn net.Conn, lines ...string) []byte {
+		for _, line := range lines {
+			conn.Write([]byte(line + "\n"))
+			time.Sleep(time.Second / 10)
+		}
+		out := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _ := conn.Read(out)
+		return out[:n]
+	}
+	conn := dial()
+	defer conn.Close()
+	send(conn, "quietuser", "/create", "quietchannel", "/join", "quietchannel")
+
+	tests := []struct {
+		name    string
+		command []string
+		message string
+		shown   bool
+	}{
+		{"default shows all", []string{"/notify quietchannel all"}, "plainMessage", true},
+		{"mentions hides others", []string{"/notify quietchannel mentions"}, "otherMessage", false},
+		{"mentions shows mentions", []string{}, "hey @QuietUser look", true},
+		{"none hides mentions", []string{"/notify quietchannel none"}, "hey @quietuser again", false},
+		{"muted hides all", []string{"/notify quietchannel all", "/mute quietchannel"}, "mutedMessage", false},
+		{"unmuted shows all", []string{"/unmute quietchannel"}, "unmutedMessage", true},
+	}
+	for _, tt := range tests {
+		for _, cmd := range tt.command {
+			send(conn, cmd)
+		}
+		SendAs("chatter", "quietchannel", "", tt.message)
+		time.Sleep(time.Second / 10)
+		out := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second / 5))
+		n, _ := conn.Read(out)
+		if bytes.Contains(out[:n], []byte(tt.message)) != tt.shown {
+			t.Error(tt.name+" test failed. got: ", string(out[:n]))
+		}
+	}
+	//Listing resets the hidden counts
+	send(conn, "/listmychannels")
+	send(conn, "/mute quietchannel")
+	SendAs("chatter", "quietchannel", "", "hiddenMessage")
+	if out := send(conn, "/listmychannels"); !bytes.Contains(out, []byte("quietchannel [notify: all, muted, 1 hidden]")) {
+		t.Error("list my channels test failed. got: " + string(out))
+	}
+	if out := send(conn, "/notify quietchannel loud"); !bytes.Contains(out, []byte("usage: /notify")) {
+		t.Error("invalid notify level test failed. got: " + string(out))
+	}
+	conn.Write([]byte("/quit\n"))
+}
+
+func TestMessageRender(t *testing.T) {
+	sent := time.Date(2023, 7, 17, 10, 12, 51, 0, time.UTC)
+	tokyo, err := loadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Fatal("could not load timezone: ", err)
+	}
+	msg := Message{Time: sent, Kind: KindMessage, From: "foo", Text: "hi"}
+	tests := []struct {
+		name   string
+		loc    *time.Location
+		format string
+		msg    Message
+		want   string
+	}{
+		{"default utc", time.UTC, TimeFormatDefault, msg, "17/07/2023 10:12:51|foo|hi"},
+		{"default tokyo", tokyo, TimeFormatDefault, msg, "17/07/2023 19:12:51|foo|hi"},
+		{"us", tokyo, TimeFormatUS, msg, "07/17/2023 07:12:51 PM|foo|hi"},
+		{"iso8601", tokyo, TimeFormatISO8601, msg, "2023-07-17T19:12:51+09:00|foo|hi"},
+		{"relative now", time.UTC, TimeFormatRelative, Message{Time: time.Now().UTC(), From: "foo", Text: "hi"}, "just now|foo|hi"},
+		{"relative hours", time.UTC, TimeFormatRelative, Message{Time: time.Now().UTC().Add(-3 * time.Hour), From: "foo", Text: "hi"}, "3h ago|foo|hi"},
+	}
+	for _, tt := range tests {
+		if got := tt.msg.Render(tt.loc, tt.format, ""); got != tt.want {
+			t.Error(tt.name + " test failed. got: " + got + " want: " + tt.want)
+		}
+	}
+}
+
+func TestTimePrefs(t *testing.T) {
+	conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	defer conn.Close()
+	send := func(line string) string {
+		conn.Write([]byte(line + "\n"))
+		time.Sleep(time.Second / 10)
+		out := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second / 5))
+		n, _ := conn.Read(out)
+		return string(out[:n])
+	}
+	send("clockuser")
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"unknown timezone", "/timezone Mars/Olympus", "unknown timezone"},
+		{"timezone", "/timezone Asia/Tokyo", "Timezone set to: Asia/Tokyo"},
+		{"unknown format", "/timeformat sundial", "usage: /timeformat"},
+		{"format", "/timeformat iso8601", "Time format set to: iso8601"},
+	}
+	for _, tt := range tests {
+		if got := send(tt.command); !strings.Contains(got, tt.want) {
+			t.Error(tt.name + " test failed. got: " + got)
+		}
+	}
+	SendAs("chatter", "", "clockuser", "what time is it")
+	time.Sleep(time.Second / 10)
+	out := make([]byte, 4096)
+	conn.SetReadDeadline(time.Now().Add(time.Second / 5))
+	n, _ := conn.Read(out)
+	if !strings.Contains(string(out[:n]), "+09:00|chatter|") {
+		t.Error("message time test failed. got: " + string(out[:n]))
+	}
+	conn.Write([]byte("/quit\n"))
+}
+
+func TestLanguage(t *testing.T) {
+	if err := locale.Load("../locales"); err != nil {
+		t.Fatal("could not load translations: ", err)
+	}
+	defer locale.Load("")
+	conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	defer conn.Close()
+	send := func(line string) string {
+		conn.Write([]byte(line + "\n"))
+		time.Sleep(time.Second / 10)
+		out := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second / 5))
+		n, _ := conn.Read(out)
+		return string(out[:n])
+	}
+	send("hablante")
+	tests := []struct {
+		name    string
+		command string
+		want    string
+	}{
+		{"unknown language", "/lang xx", "usage: /lang en|es"},
+		{"set language", "/lang es-MX", "Idioma cambiado a: es"},
+		{"prompt", "/join", "Canal al que unirte: "},
+		{"error", "nochannel", "comando no válido. error: el canal no existe"},
+		{"help", "/help", "Menú de ayuda"},
+		{"back to english", "/lang en", "Language set to: en"},
+	}
+	for _, tt := range tests {
+		if got := send(tt.command); !strings.Contains(got, tt.want) {
+			t.Error(tt.name + " test failed. got: " + got)
+		}
+	}
+	conn.Write([]byte("/quit\n"))
+}
+
+func TestSanitize(t *testing.T) {
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"plain", "hello there", "hello there"},
+		{"unicode", "héllo 世界 👋", "héllo 世界 👋"},
+		{"tab", "a\tb", "a\tb"},
+		{"clear screen", "\x1b[2J\x1b[Hgotcha", "gotcha"},
+		{"colour", "\x1b[31mred\x1b[0m", "red"},
+		{"private mode", "\x1b[?25lhidden cursor", "hidden cursor"},
+		{"window title", "\x1b]0;pwned\x07title", "title"},
+		{"title with st", "\x1b]0;pwned\x1b\\title", "title"},
+		{"charset", "\x1b(Bx", "x"},
+		{"reset", "\x1bcx", "x"},
+		{"lone escape", "x\x1b", "x"},
+		{"8-bit csi", "\u009b2Jx", "x"},
+		{"8-bit osc", "\u009d0;pwned\u009cx", "x"},
+		{"c0 controls", "a\x00b\x07c\x08d\x7fe", "abcde"},
+		{"c1 controls", "a\u0085b", "ab"},
+		{"spoofed line", "hi\r\n17/07/2023 10:12:51|admin|fake", "hi  17/07/2023 10:12:51|admin|fake"},
+		{"bidi override", "abc‮dcba", "abcdcba"},
+		{"invalid utf8", "a\xffb", "ab"},
+	}
+	for _, tt := range tests {
+		if got := sanitize(tt.text); got != tt.want {
+			t.Errorf("%s test failed. got: %q want: %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Checks that text is safe to write to a terminal
+func checkTerminalSafe(t *testing.T, text string, allowNewline bool) {
+	if !utf8.ValidString(text) {
+		t.Fatalf("invalid utf8 in %q", text)
+	}
+	for _, r := range text {
+		if r == '\t' || (r == '\n' && allowNewline) {
+			continue
+		}
+		if unicode.IsControl(r) || isBidiControl(r) {
+			t.Fatalf("control character %U in %q", r, text)
+		}
+	}
+}
+
+func FuzzSanitize(f *testing.F) {
+	for _, seed := range []string{"hello", "\x1b[2J", "\x1b]0;title\x07", "\u009b31m", "a\r\nb", "\x1b[", "\x1b]", "\xff\xfe"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, text string) {
+		got := sanitize(text)
+		checkTerminalSafe(t, got, false)
+		if again := sanitize(got); again != got {
+			t.Fatalf("sanitize is not idempotent. %q became %q", got, again)
+		}
+	})
+}
+
+func FuzzRenderMessage(f *testing.F) {
+	f.Add("alice", "general", "\x1b[2Jhi", "bob: \x1b]0;x\x07quote", uint64(3))
+	f.Add("\x1b[31mmallory", "", "line\nbreak", "", uint64(0))
+	f.Fuzz(func(t *testing.T, from string, channel string, text string, quote string, parent uint64) {
+		m := newMessage(from, KindMessage, text)
+		m.Channel, m.Quote, m.Parent = channel, quote, parent
+		for _, kind := range []string{KindMessage, KindAction, KindEdit, KindDelete, KindNotice} {
+			m.Kind = kind
+			//Replies are shown on two lines so the only newline allowed is the one after the quote
+			out := m.Render(time.UTC, TimeFormatDefault, "")
+			if parent != 0 {
+				_, out, _ = strings.Cut(out, "\n")
+			}
+			checkTerminalSafe(t, out, false)
+		}
+	})
+}
+
+func TestNameValidation(t *testing.T) {
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+		if err != nil {
+			t.Fatal("could not connect to TCP server: ", err)
+		}
+		return conn
+	}
+	send := func(conn net.Conn, line string) string {
+		conn.Write([]byte(line + "\n"))
+		time.Sleep(time.Second / 10)
+		out := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(time.Second / 5))
+		n, _ := conn.Read(out)
+		return string(out[:n])
+	}
+	conn := dial()
+	defer conn.Close()
+	conn2 := dial()
+	defer conn2.Close()
+	send(conn, "namer")
+	send(conn, "/create")
+	send(conn, "namechannel")
+
+	tests := []struct {
+		name  string
+		conn  net.Conn
+		input string
+		want  string
+	}{
+		{"empty username", conn2, "", "name can not be empty"},
+		{"space in username", conn2, "bad name", "name can not contain ' '"},
+		{"pipe in username", conn2, "bad|name", "name can not contain '|'"},
+		{"reserved username", conn2, "HTTP", "name HTTP is reserved"},
+		{"taken username", conn2, "NAMER", "user already exists"},
+		{"confusable username", conn2, "narner", "user already exists"},
+		{"valid username", conn2, "nam3r", "Welcome"},
+		{"pipe in channel", conn, "/create", "Enter new channel name"},
+		{"pipe in channel name", conn, "bad|channel", "name can not contain '|'"},
+		{"taken channel", conn, "/create", "Enter new channel name"},
+		{"taken channel name", conn, "NameChanneI", "channel already exists"},
+	}
+	for _, tt := range tests {
+		if got := send(tt.conn, tt.input); !strings.Contains(got, tt.want) {
+			t.Error(tt.name + " test failed. got: " + got)
+		}
+	}
+	conn.Write([]byte("/quit\n"))
+	conn2.Write([]byte("/quit\n"))
+}
+
+func TestChannelFunctions(t *testing.T) {
+	conn, err := net.Dial("tcp", cfg.TelNetIp+":"+cfg.TelNetPort)
+	if err != nil {
+		t.Fatal("could not connect to TCP server: ", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("joiner\n"))
+	time.Sleep(time.Second / 10)
+
+	if err := CreateChannel("joinchannel", "tester"); err != nil {
+		t.Fatal("could not create channel: ", err)
+	}
+	if err := CreateChannel("JoinChannel", "tester"); err == nil {
+		t.Error("created a channel whose name was taken")
+	}
+	if joined, err := JoinChannel("joiner", "joinchannel"); !joined || err != nil {
+		t.Error("join test failed. err: ", err)
+	}
+	if joined, err := JoinChannel("joiner", "joinchannel"); joined || err != nil {
+		t.Error("join again test failed. err: ", err)
+	}
+	if _, err := JoinChannel("nobody", "joinchannel"); err == nil || err.Error() != "user is not online" {
+		t.Error("join offline user test failed. err: ", err)
+	}
+	if err := LeaveChannel("joiner", "joinchannel"); err != nil {
+		t.Error("leave test failed. err: ", err)
+	}
+	if err := LeaveChannel("joiner", "joinchannel"); err == nil || err.Error() != "user is not in the channel" {
+		t.Error("leave again test failed. err: ", err)
+	}
+	if members, _ := channelMembers("joinchannel"); len(members) != 0 {
+		t.Error("channel still has members: ", len(members))
+	}
+	CloseChannel("joinchannel", "tester")
+	conn.Write([]byte("/quit\n"))
+}
+
+func TestThreadVisibility(t *testing.T) {
+	pm := newMessage("threadsender", KindMessage, "secret plans")
+	pm.To = "threadreader"
+	pm = recordMessage(pm)
+
+	tests := []struct {
+		name   string
+		viewer string
+		err    error
+	}{
+		{"sender", "threadsender", nil},
+		{"recipient", "threadreader", nil},
+		{"someone else", "snooper", ErrNoMessage},
+		{"anonymous", "", ErrNoMessage},
+	}
+	for _, tt := range tests {
+		thread, err := Thread(pm.ID, tt.viewer)
+		if err != tt.err {
+			t.Errorf(tt.name+": expected %v but got %v", tt.err, err)
+		}
+		if err == nil && (len(thread) != 1 || thread[0].Text != "secret plans") {
+			t.Errorf(tt.name+": expected only the pm but got %v", thread)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package telnet
+
+import (
+	"chatservice/locale"
+	"sync"
+	"time"
+	_ "time/tzdata" // Timezones work even if the host has no timezone database
+)
+
+// Formats users can pick for message timestamps
+const (
+	TimeFormatDefault  = "default"  // 02/01/2006 15:04:05
+	TimeFormatUS       = "us"       // 01/02/2006 03:04:05 PM
+	TimeFormatISO8601  = "iso8601"  // 2006-01-02T15:04:05-07:00
+	TimeFormatRelative = "relative" // 5m ago
+)
+
+const timeFormatUS = "01/02/2006 03:04:05 PM"
+
+var locations = map[string]*time.Location{} // Cache of loaded timezones
+var locationsMu sync.Mutex
+
+// Checks if a time format is known
+func validTimeFormat(format string) bool {
+	switch format {
+	case TimeFormatDefault, TimeFormatUS, TimeFormatISO8601, TimeFormatRelative:
+		return true
+	}
+	return false
+}
+
+// Loads a timezone by its IANA name, e.g. "America/New_York". Empty is the servers local time
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	locationsMu.Lock()
+	defer locationsMu.Unlock()
+	if loc, ok := locations[name]; ok {
+		return loc, nil
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, err
+	}
+	locations[name] = loc
+	return loc, nil
+}
+
+// Formats a timestamp in a timezone and time format. Relative times are in lang
+func formatTime(t time.Time, loc *time.Location, format string, lang string) string {
+	t = t.In(loc)
+	switch format {
+	case TimeFormatUS:
+		return t.Format(timeFormatUS)
+	case TimeFormatISO8601:
+		return t.Format(time.RFC3339)
+	case TimeFormatRelative:
+		return relativeTime(t, lang)
+	default:
+		return t.Format(timeFormat)
+	}
+}
+
+// Describes how long ago a time was, e.g. "just now" or "3h ago"
+func relativeTime(t time.Time, lang string) string {
+	ago := time.Since(t)
+	switch {
+	case ago < time.Minute:
+		return locale.T(lang, "just now")
+	case ago < time.Hour:
+		return locale.Tf(lang, "%dm ago", int(ago/time.Minute))
+	case ago < 24*time.Hour:
+		return locale.Tf(lang, "%dh ago", int(ago/time.Hour))
+	case ago < 30*24*time.Hour:
+		return locale.Tf(lang, "%dd ago", int(ago/(24*time.Hour)))
+	default:
+		return t.Format("02 Jan 2006")
+	}
+}
@@ -1,24 +1,35 @@
 package telnet
 
 import (
+	"chatservice/locale"
 	"errors"
 	"log"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 type User struct {
 	username    string
 	conn        net.Conn
-	messageChan chan string
+	messageChan chan Message
 	channels    []string
-	ignored     []*User
 	closeChan   chan bool
+	closeOnce   sync.Once
+	registered  bool // Logged in to a registered account
+	prefs       Prefs
+	prefsMu     sync.Mutex
+	hidden      map[string]int // Map of channels to messages hidden by notify settings
 }
 
+const ClientTelnet = "telnet" // Client of users connected over telnet
+
 const timeFormat = "02/01/2006 15:04:05" // Used to format the timestamp consistently
 
+var telnetNOP = []byte{255, 241} // IAC NOP, ignored by telnet clients
+
 // Reads input from CLI, checks if its a command, if not, sends message to chat room
 func (u *User) ReadFromCLI() {
 	for {
@@ -27,14 +38,17 @@ func (u *User) ReadFromCLI() {
 			log.Printf("messege sending channel closed for user: %s", u.username)
 			return
 		default:
+			u.resetIdleTimeout()
 			msg, err := ReadInput(u.conn, "")
 			if err != nil {
-				_, err = u.conn.Write([]byte("unable to read input from cli. error: " + err.Error()))
-				if err != nil {
-					log.Printf("error writing to connection %v. error %s", u.conn.RemoteAddr(), err)
+				if isTimeout(err) {
+					u.conn.Write([]byte("\n" + u.t("Disconnected for being idle") + "\n"))
 				}
-				close(u.closeChan)
+				u.drop("read failed: " + err.Error())
+				return
 			}
+			//Commands that prompt for more input get a full idle period
+			u.resetIdleTimeout()
 
 			if len(msg) == 0 {
 				continue
@@ -43,22 +57,15 @@ func (u *User) ReadFromCLI() {
 			if msg[0] == '/' {
 				err = u.commandHandler(msg)
 				if err != nil {
-					_, err = u.conn.Write([]byte("invalid command. error: " + err.Error() + "\r\n"))
+					errorsTotal.Inc("command")
+					_, err = u.conn.Write([]byte(u.t("invalid command. error: ") + locale.TranslateError(u.lang(), err) + "\r\n"))
 					if err != nil {
+						errorsTotal.Inc("write")
 						log.Printf("error writing to connection %v. error %s", u.conn.RemoteAddr(), err)
 					}
 				}
 			} else { //Send to all users
-				msgToSend := time.Now().Format(timeFormat) + "|" + u.username + "|" + msg
-
-				for _, user := range Users {
-					user.messageChan <- msgToSend
-				}
-				log.Printf("message sent to all: %s", msgToSend)
-
-				MessagesSent.mu.Lock()
-				MessagesSent.C++
-				MessagesSent.mu.Unlock()
+				sendAllMessage(newMessage(u.username, KindMessage, msg))
 			}
 		}
 	}
@@ -72,30 +79,130 @@ func (u *User) ReceiveMessage() {
 			log.Printf("receive channel closed for user: %s", u.username)
 			return
 		case msg := <-u.messageChan:
-			//Check for ignored user
-			split := strings.Split(msg, "|")
-			user := split[1]
-
-			ignored := false
-			for _, ignoredUser := range u.ignored {
-				if user == ignoredUser.username {
-					ignored = true
-					break
-				}
+			//Check for ignored user. Admin notices can not be ignored
+			prefs := u.getPrefs()
+			ignored := msg.Kind != KindNotice && prefs.ignores(msg.From)
+			//Check channel notification settings
+			if !ignored && !prefs.shows(msg, u.username) {
+				u.countHidden(msg.Channel)
+				ignored = true
 			}
 			if !ignored {
-				_, err := u.conn.Write([]byte(msg + "\n"))
+				err := u.writeMessage(prefs, msg)
 				if err != nil {
+					errorsTotal.Inc("write")
 					log.Printf("error writing to connection %v. error %s", u.conn.RemoteAddr(), err)
+					u.drop("write failed: " + err.Error())
+					return
 				}
+				markSeen(msg.ID, u.username)
+			}
+		}
+	}
+}
+
+// Writes a message to the user formatted with their preferences, or whole if their
+// connection takes messages
+func (u *User) writeMessage(prefs Prefs, m Message) error {
+	if mc, ok := messageConn(u.conn); ok {
+		return mc.WriteMessage(m)
+	}
+	_, err := u.conn.Write([]byte(prefs.format(m) + "\n"))
+	return err
+}
+
+// Returns the name the user logged in with
+func (u *User) Username() string {
+	return u.username
+}
+
+// Returns how the user is connected, ClientTelnet or the client of their MessageConn
+func (u *User) Client() string {
+	return clientOf(u.conn)
+}
+
+// Logs the user out without telling them. Does nothing if they already left, even if
+// someone else has since logged in with their name
+func (u *User) Logout() {
+	u.drop("logged out")
+}
+
+// Returns the channels the user is in
+func (u *User) ChannelNames() []string {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return append([]string{}, u.channels...)
+}
+
+// Returns the language the user picked. Empty means the server default
+func (u *User) lang() string {
+	return u.getPrefs().Lang
+}
+
+// Translates text into the users language
+func (u *User) t(text string) string {
+	return locale.T(u.lang(), text)
+}
+
+// Writes a line translated into the users language
+func (u *User) tell(format string, args ...any) error {
+	_, err := u.conn.Write([]byte(locale.Tf(u.lang(), format, args...) + " \n"))
+	return err
+}
+
+// Pushes back the read deadline when an idle timeout is configured
+func (u *User) resetIdleTimeout() {
+	if idle := getTimeouts().idle; idle > 0 {
+		u.conn.SetReadDeadline(time.Now().Add(idle))
+	}
+}
+
+// Sends a telnet NOP, or a ping to connections that take messages, every keepalive
+// interval. A failed write means the peer is gone so the user is cleaned up
+func (u *User) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-u.closeChan:
+			return
+		case <-ticker.C:
+			var err error
+			u.conn.SetWriteDeadline(time.Now().Add(interval))
+			if mc, ok := messageConn(u.conn); ok {
+				err = mc.Ping()
+			} else {
+				_, err = u.conn.Write(telnetNOP)
+			}
+			u.conn.SetWriteDeadline(time.Time{})
+			if err != nil {
+				u.drop("keepalive failed: " + err.Error())
+				return
 			}
 		}
 	}
 }
 
+// Removes a user whose connection is no longer usable and closes the connection
+func (u *User) drop(reason string) {
+	log.Printf("dropping user: %s. reason: %s", u.username, reason)
+	u.disconnect()
+	u.conn.Close()
+}
+
+// Hands a message to the users receive go routine. Gives up if the user has disconnected
+func (u *User) deliver(msg Message) {
+	select {
+	case u.messageChan <- msg:
+	case <-u.closeChan:
+	}
+}
+
 // Switch statement for handling all command inputs
 func (u *User) commandHandler(msg string) error {
-	switch msg {
+	cmd, args, _ := strings.Cut(msg, " ")
+	commandsTotal.Inc(commandLabel(cmd))
+	switch cmd {
 	case "/quit":
 		err := u.quit()
 		if err != nil {
@@ -151,8 +258,83 @@ func (u *User) commandHandler(msg string) error {
 		if err != nil {
 			return err
 		}
+	case "/me":
+		err := u.emote(args)
+		if err != nil {
+			return err
+		}
+	case "/edit":
+		err := u.editMessage(args)
+		if err != nil {
+			return err
+		}
+	case "/delete":
+		err := u.deleteMessage(args)
+		if err != nil {
+			return err
+		}
+	case "/reply":
+		err := u.reply(args)
+		if err != nil {
+			return err
+		}
+	case "/thread":
+		err := u.showThread(args)
+		if err != nil {
+			return err
+		}
+	case "/register":
+		err := u.register()
+		if err != nil {
+			return err
+		}
+	case "/inbox":
+		err := u.inbox(args)
+		if err != nil {
+			return err
+		}
+	case "/admin":
+		err := u.adminHandler(args)
+		if err != nil {
+			return err
+		}
+	case "/listignored":
+		err := u.listIgnored()
+		if err != nil {
+			return err
+		}
+	case "/mute":
+		err := u.setMuted(args, true)
+		if err != nil {
+			return err
+		}
+	case "/unmute":
+		err := u.setMuted(args, false)
+		if err != nil {
+			return err
+		}
+	case "/notify":
+		err := u.setNotify(args)
+		if err != nil {
+			return err
+		}
+	case "/timezone":
+		err := u.setTimezone(args)
+		if err != nil {
+			return err
+		}
+	case "/timeformat":
+		err := u.setTimeFormat(args)
+		if err != nil {
+			return err
+		}
+	case "/lang":
+		err := u.setLang(args)
+		if err != nil {
+			return err
+		}
 	case "/help":
-		PrintHelpMenu(u.conn)
+		PrintHelpMenu(u.conn, u.lang())
 	default:
 		return errors.New("unknown command")
 	}
@@ -161,23 +343,11 @@ func (u *User) commandHandler(msg string) error {
 
 // Disconnects user from server and closes their go routines
 func (u *User) quit() error {
-	//Delete from channels
-	for _, uc := range u.channels {
-		if users, ok := Channels[uc]; ok {
-			for i, user := range users {
-				if user.username == u.username {
-					Channels[uc] = append(Channels[uc][:i], Channels[uc][i+1:]...)
-				}
-			}
-		}
-	}
-	//Delete from user list
-	delete(Users, u.username)
-	//Signal go routines to stop
-	close(u.closeChan)
-
-	_, err := u.conn.Write([]byte("You have quit the chat. Escape character is '^]', then enter 'close' to exit telnet"))
+	u.disconnect()
 
+	_, err := u.conn.Write([]byte(u.t("You have quit the chat. Goodbye") + "\n"))
+	//Close the connection so it no longer counts against the connection limits
+	u.conn.Close()
 	if err != nil {
 		return err
 	}
@@ -185,14 +355,50 @@ func (u *User) quit() error {
 	return nil
 }
 
+// Removes the user from all channels and the user list and signals their go routines to stop
+func (u *User) disconnect() {
+	u.closeOnce.Do(func() {
+		//Delete from channels
+		stateMu.Lock()
+		for _, uc := range u.channels {
+			if users, ok := Channels[uc]; ok {
+				for i, user := range users {
+					if user == u {
+						Channels[uc] = append(Channels[uc][:i], Channels[uc][i+1:]...)
+						break
+					}
+				}
+			}
+		}
+		//Delete from user list unless the name was taken over
+		if Users[u.username] == u {
+			delete(Users, u.username)
+		}
+		stateMu.Unlock()
+		//Signal go routines to stop
+		close(u.closeChan)
+		emitEvent(Event{Type: EventDisconnect, User: u.username})
+	})
+}
+
 // Displays available channels
 func (u *User) listChannels() error {
-	_, err := u.conn.Write([]byte("/**************Channels****************/\n"))
+	_, err := u.conn.Write([]byte("/**************" + u.t("Channels") + "****************/\n"))
 	if err != nil {
 		return err
 	}
+	stateMu.Lock()
+	lines := make([]string, 0, len(Channels))
 	for ch := range Channels {
-		_, err = u.conn.Write([]byte(ch + "\n"))
+		line := ch
+		if topic := Topics[ch]; topic != "" {
+			line += " - " + topic
+		}
+		lines = append(lines, line)
+	}
+	stateMu.Unlock()
+	for _, line := range lines {
+		_, err = u.conn.Write([]byte(line + "\n"))
 		if err != nil {
 			return err
 		}
@@ -207,12 +413,16 @@ func (u *User) listChannels() error {
 
 // Displays available users for pms
 func (u *User) listUsers() error {
-	_, err := u.conn.Write([]byte("/****************Users*****************/\n"))
+	_, err := u.conn.Write([]byte("/****************" + u.t("Users") + "*****************/\n"))
 	if err != nil {
 		return err
 	}
-	for user := range Users {
-		_, err = u.conn.Write([]byte(user + "\n"))
+	for _, user := range onlineUsers() {
+		name := user.username
+		if client := user.Client(); client != ClientTelnet {
+			name += " (" + client + ")"
+		}
+		_, err = u.conn.Write([]byte(name + "\n"))
 		if err != nil {
 			return err
 		}
@@ -227,16 +437,15 @@ func (u *User) listUsers() error {
 
 // Create a new channel
 func (u *User) createChannel() error {
-	channelName, err := ReadInput(u.conn, "Enter new channel name: ")
+	channelName, err := ReadInput(u.conn, u.t("Enter new channel name: "))
 	if err != nil {
 		return err
 	}
-	if _, ok := Channels[channelName]; !ok {
-		Channels[channelName] = []*User{}
-	} else {
-		return errors.New("channel already exists")
+	err = CreateChannel(channelName, u.username)
+	if err != nil {
+		return err
 	}
-	_, err = u.conn.Write([]byte("Channel: " + channelName + " created \n"))
+	err = u.tell("Channel: %s created", channelName)
 	if err != nil {
 		return err
 	}
@@ -245,26 +454,18 @@ func (u *User) createChannel() error {
 
 // Join a channel
 func (u *User) joinChannel() error {
-	channelName, err := ReadInput(u.conn, "Enter channel name to join: ")
+	channelName, err := ReadInput(u.conn, u.t("Enter channel name to join: "))
 	if err != nil {
 		return err
 	}
-	if _, ok := Channels[channelName]; ok {
-		for _, c := range u.channels {
-			if c == channelName {
-				_, err = u.conn.Write([]byte("Already in channel: " + channelName + " \n"))
-				if err != nil {
-					return err
-				}
-				return nil
-			}
-		}
-		Channels[channelName] = append(Channels[channelName], u)
-		u.channels = append(u.channels, channelName)
-	} else {
-		return errors.New("channel does not exist")
+	joined, err := JoinChannel(u.username, channelName)
+	if err != nil {
+		return err
 	}
-	_, err = u.conn.Write([]byte("Joined channel: " + channelName + " \n"))
+	if !joined {
+		return u.tell("Already in channel: %s", channelName)
+	}
+	err = u.tell("Joined channel: %s", channelName)
 	if err != nil {
 		return err
 	}
@@ -273,45 +474,41 @@ func (u *User) joinChannel() error {
 
 // Leave a channel
 func (u *User) leaveChannel() error {
-	channelName, err := ReadInput(u.conn, "Enter channel to leave: ")
+	channelName, err := ReadInput(u.conn, u.t("Enter channel to leave: "))
 	if err != nil {
 		return err
 	}
-	if userList, ok := Channels[channelName]; ok {
-		for i, user := range userList {
-			if user.username == u.username {
-				Channels[channelName] = append(Channels[channelName][:i], Channels[channelName][i+1:]...)
-				break
-			}
-		}
-		for i, c := range u.channels {
-			if c == channelName {
-				u.channels = append(u.channels[:i], u.channels[i+1:]...)
-				break
-			}
-		}
-		_, err := u.conn.Write([]byte("Left channel: " + channelName + " \n"))
-		if err != nil {
-			return err
-		}
-	} else {
-		return errors.New("channel does not exist")
+	err = LeaveChannel(u.username, channelName)
+	if err != nil {
+		return err
 	}
-	return nil
+	return u.tell("Left channel: %s", channelName)
 }
 
 // Add user to ignore list
 func (u *User) ignoreUser() error {
-	userName, err := ReadInput(u.conn, "Enter user to ignore: ")
+	userName, err := ReadInput(u.conn, u.t("Enter user to ignore: "))
 	if err != nil {
 		return err
 	}
-	if user, ok := Users[userName]; ok {
-		u.ignored = append(u.ignored, user)
-	} else {
-		return errors.New("user does not exist")
+	//Ignores are by name so they survive reconnects and cover users who are not online and
+	//senders such as webhooks. "http" ignores anonymous http messages
+	_, online := OnlineUser(userName)
+	if !online && !Registered(userName) && userName != "http" {
+		if err := CheckUsername(userName); err != nil {
+			return err
+		}
+	}
+	if userName == u.username {
+		return errors.New("you can not ignore yourself")
 	}
-	_, err = u.conn.Write([]byte("Ignored user: " + userName + " \n"))
+	if u.getPrefs().ignores(userName) {
+		return errors.New("user is already ignored")
+	}
+	u.updatePrefs(func(p *Prefs) {
+		p.Ignored = append(p.Ignored, userName)
+	})
+	err = u.tell("Ignored user: %s", userName)
 	if err != nil {
 		return err
 	}
@@ -320,22 +517,41 @@ func (u *User) ignoreUser() error {
 
 // Remove user from ignore list
 func (u *User) unIgnoreUser() error {
-	userName, err := ReadInput(u.conn, "Enter user to unignore: ")
+	userName, err := ReadInput(u.conn, u.t("Enter user to unignore: "))
 	if err != nil {
 		return err
 	}
-	found := false
-	for i, ignoredUser := range u.ignored {
-		if ignoredUser.username == userName {
-			u.ignored = append(u.ignored[:i], u.ignored[i+1:]...)
-			found = true
-			break
+	if !u.getPrefs().ignores(userName) {
+		return errors.New("user is not ignored")
+	}
+	u.updatePrefs(func(p *Prefs) {
+		for i, ignored := range p.Ignored {
+			if ignored == userName {
+				p.Ignored = append(p.Ignored[:i], p.Ignored[i+1:]...)
+				break
+			}
 		}
+	})
+	err = u.tell("Unignored user: %s", userName)
+	if err != nil {
+		return err
 	}
-	if !found {
-		return errors.New("user does not exist")
+	return nil
+}
+
+// Displays the users the user is ignoring
+func (u *User) listIgnored() error {
+	_, err := u.conn.Write([]byte("/***************" + u.t("Ignored") + "****************/\n"))
+	if err != nil {
+		return err
 	}
-	_, err = u.conn.Write([]byte("Unignored user: " + userName + " \n"))
+	for _, ignored := range u.getPrefs().Ignored {
+		_, err = u.conn.Write([]byte(ignored + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = u.conn.Write([]byte("/**************************************/\n"))
 	if err != nil {
 		return err
 	}
@@ -344,60 +560,223 @@ func (u *User) unIgnoreUser() error {
 
 // Send a private message
 func (u *User) sendPM() error {
-	user, err := ReadInput(u.conn, "Enter user to send pm to: ")
+	username, err := ReadInput(u.conn, u.t("Enter user to send pm to: "))
 	if err != nil {
 		return err
 	}
-	if user, ok := Users[user]; ok {
-		msg, err := ReadInput(u.conn, "Enter message: ")
+	if user, ok := OnlineUser(username); ok {
+		msg, err := ReadInput(u.conn, u.t("Enter message: "))
+		if err != nil {
+			return err
+		}
+		kind, text := parseEmote(msg)
+		sendUserMessage(newMessage(u.username, kind, text), user)
+		return nil
+	} else if Registered(username) {
+		//Registered users that are offline get the message in their mailbox
+		msg, err := ReadInput(u.conn, u.t("User is offline. Enter message for their mailbox: "))
+		if err != nil {
+			return err
+		}
+		kind, text := parseEmote(msg)
+		err = sendOfflineMessage(newMessage(u.username, kind, text), username)
+		if err != nil {
+			return err
+		}
+		err = u.tell("Message saved to mailbox of: %s", username)
 		if err != nil {
 			return err
 		}
-		msgToSend := time.Now().Format(timeFormat) + "|" + u.username + "|" + msg
-		user.messageChan <- msgToSend
-		log.Printf("message sent to pm: %s", msgToSend)
-		MessagesSent.mu.Lock()
-		MessagesSent.C++
-		MessagesSent.mu.Unlock()
 		return nil
 	} else {
-		return errors.New("user does not exist")
+		return ErrNoUser
 	}
 }
 
 // Send into channel
 func (u *User) sendIntoChannel() error {
-	channel, err := ReadInput(u.conn, "Enter channel to send message to: ")
+	channel, err := ReadInput(u.conn, u.t("Enter channel to send message to: "))
 	if err != nil {
 		return err
 	}
-	if userList, ok := Channels[channel]; ok {
-		msg, err := ReadInput(u.conn, "Enter message: ")
+	if ChannelExists(channel) {
+		msg, err := ReadInput(u.conn, u.t("Enter message: "))
 		if err != nil {
 			return err
 		}
-		msgToSend := time.Now().Format(timeFormat) + "|" + u.username + "|" + channel + "|" + msg
-		for _, user := range userList {
-			user.messageChan <- msgToSend
+		//The channel may have been closed while the message was typed
+		userList, ok := channelMembers(channel)
+		if !ok {
+			return ErrNoChannel
 		}
-		log.Printf("message sent to channel: %s", msgToSend)
-		MessagesSent.mu.Lock()
-		MessagesSent.C++
-		MessagesSent.mu.Unlock()
+		kind, text := parseEmote(msg)
+		m := newMessage(u.username, kind, text)
+		m.Channel = channel
+		sendChannelMessage(m, userList)
 		return nil
 	} else {
-		return errors.New("channel does not exist")
+		return ErrNoChannel
+	}
+}
+
+// Replies to a channel message. args are "<id> <text>"
+func (u *User) reply(args string) error {
+	idArg, msg, _ := strings.Cut(args, " ")
+	id, err := strconv.ParseUint(idArg, 10, 64)
+	if err != nil || msg == "" {
+		return errors.New("usage: /reply <id> <text>")
+	}
+	parent, ok := GetMessage(id)
+	if !ok {
+		return ErrNoMessage
+	}
+	if parent.Channel == "" {
+		return errors.New("can only reply to channel messages")
+	}
+	userList, ok := channelMembers(parent.Channel)
+	if !ok {
+		return ErrNoChannel
+	}
+	kind, text := parseEmote(msg)
+	m := newMessage(u.username, kind, text)
+	m.Channel = parent.Channel
+	m.Parent = parent.ID
+	m.Quote = quote(parent)
+	sendChannelMessage(m, userList)
+	return nil
+}
+
+// Displays the thread a message belongs to. args are "<id>"
+func (u *User) showThread(args string) error {
+	id, err := strconv.ParseUint(args, 10, 64)
+	if err != nil {
+		return errors.New("usage: /thread <id>")
+	}
+	thread, err := Thread(id, u.username)
+	if err != nil {
+		return err
+	}
+	_, err = u.conn.Write([]byte("/***************" + u.t("Thread") + "*****************/\n"))
+	if err != nil {
+		return err
+	}
+	prefs := u.getPrefs()
+	for _, m := range thread {
+		if mc, ok := messageConn(u.conn); ok {
+			err = mc.WriteMessage(m)
+		} else {
+			//Quotes are left out since the parent is already shown above
+			m.Parent = 0
+			prefix := ""
+			if m.ID != thread[0].ID {
+				prefix = "  "
+			}
+			_, err = u.conn.Write([]byte(prefix + prefs.format(m) + "\n"))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err = u.conn.Write([]byte("/**************************************/\n"))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Registers the users name so it is protected by a password and can receive mail while offline
+func (u *User) register() error {
+	if u.registered {
+		return errors.New("you are already registered")
+	}
+	password, err := ReadInput(u.conn, u.t("Enter new password: "))
+	if err != nil {
+		return err
+	}
+	confirm, err := ReadInput(u.conn, u.t("Confirm password: "))
+	if err != nil {
+		return err
+	}
+	if password != confirm {
+		return errors.New("passwords do not match")
 	}
+	err = Register(u.username, password)
+	if err != nil {
+		return err
+	}
+	u.registered = true
+	//Keep the preferences set so far
+	u.updatePrefs(func(p *Prefs) {})
+	err = u.tell("Registered user: %s", u.username)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Shows a summary of unread mail and delivers it. Called when a registered user logs in
+func (u *User) deliverMail() error {
+	summary := mailSummary(u.username, u.lang())
+	if summary == "" {
+		return nil
+	}
+	_, err := u.conn.Write([]byte(locale.Tf(u.lang(), "While you were away you received %s", summary) + "\n"))
+	if err != nil {
+		return err
+	}
+	prefs := u.getPrefs()
+	for _, mail := range readMail(u.username) {
+		if mail.Read {
+			continue
+		}
+		err = u.writeMessage(prefs, mail.Message)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Lists the messages in the users mailbox. "/inbox clear" empties it
+func (u *User) inbox(args string) error {
+	if !u.registered {
+		return errors.New("only registered users have an inbox. use /register")
+	}
+	if args == "clear" {
+		clearMail(u.username)
+		return u.tell("Inbox cleared")
+	}
+	_, err := u.conn.Write([]byte("/****************" + u.t("Inbox") + "*****************/\n"))
+	if err != nil {
+		return err
+	}
+	prefs := u.getPrefs()
+	for _, mail := range readMail(u.username) {
+		err = u.writeMessage(prefs, mail.Message)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = u.conn.Write([]byte("/**************************************/\n"))
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
 // List channels a user is subscribed to
 func (u *User) listMyChannels() error {
-	_, err := u.conn.Write([]byte("/************My Channels***************/\n"))
+	_, err := u.conn.Write([]byte("/************" + u.t("My Channels") + "***************/\n"))
 	if err != nil {
 		return err
 	}
-	for _, ch := range u.channels {
-		_, err = u.conn.Write([]byte(ch + "\n"))
+	prefs := u.getPrefs()
+	for _, ch := range u.ChannelNames() {
+		line := ch + " [" + prefs.Channels[ch].describe(prefs.Lang)
+		if hidden := u.takeHidden(ch); hidden > 0 {
+			line += ", " + locale.Tf(prefs.Lang, "%d hidden", hidden)
+		}
+		_, err = u.conn.Write([]byte(line + "]\n"))
 		if err != nil {
 			return err
 		}
@@ -410,36 +789,158 @@ func (u *User) listMyChannels() error {
 	return nil
 }
 
-// Sends message from http to a channel
-func HTTPSendChannelMessage(msg string, channel string, userList []*User) {
-	msgToSend := time.Now().Format(timeFormat) + "|http|" + channel + "|" + msg
+// Mutes or unmutes a channel. args are "<channel>"
+func (u *User) setMuted(channel string, muted bool) error {
+	if channel == "" {
+		return errors.New("usage: /mute <channel> or /unmute <channel>")
+	}
+	if !ChannelExists(channel) {
+		return ErrNoChannel
+	}
+	u.updatePrefs(func(p *Prefs) {
+		cp := p.Channels[channel]
+		cp.Muted = muted
+		p.Channels[channel] = cp
+	})
+	if muted {
+		return u.tell("Muted channel: %s", channel)
+	}
+	return u.tell("Unmuted channel: %s", channel)
+}
+
+// Sets which messages of a channel are shown. args are "<channel> all|mentions|none"
+func (u *User) setNotify(args string) error {
+	channel, level, _ := strings.Cut(args, " ")
+	if channel == "" || !validNotify(level) {
+		return errors.New("usage: /notify <channel> all|mentions|none")
+	}
+	if !ChannelExists(channel) {
+		return ErrNoChannel
+	}
+	u.updatePrefs(func(p *Prefs) {
+		cp := p.Channels[channel]
+		cp.Notify = level
+		p.Channels[channel] = cp
+	})
+	return u.tell("Notifications for channel: %s set to: %s", channel, level)
+}
+
+// Sets the timezone timestamps are shown in. args are "<timezone>", e.g. "Europe/London"
+func (u *User) setTimezone(args string) error {
+	if args == "" {
+		return errors.New("usage: /timezone <name>, e.g. /timezone Europe/London")
+	}
+	_, err := loadLocation(args)
+	if err != nil {
+		return locale.Errorf("unknown timezone: %s", args)
+	}
+	u.updatePrefs(func(p *Prefs) {
+		p.Timezone = args
+	})
+	err = u.tell("Timezone set to: %s", args)
+	return err
+}
+
+// Sets how timestamps are shown. args are "default|us|iso8601|relative"
+func (u *User) setTimeFormat(args string) error {
+	if !validTimeFormat(args) {
+		return errors.New("usage: /timeformat default|us|iso8601|relative")
+	}
+	u.updatePrefs(func(p *Prefs) {
+		p.TimeFormat = args
+	})
+	err := u.tell("Time format set to: %s", args)
+	return err
+}
+
+// Sets the language server messages are shown in. args are "<language>", e.g. "es"
+func (u *User) setLang(args string) error {
+	lang, ok := locale.Resolve(args)
+	if !ok {
+		return locale.Errorf("usage: /lang %s", strings.Join(locale.Languages(), "|"))
+	}
+	u.updatePrefs(func(p *Prefs) {
+		p.Lang = lang
+	})
+	return u.tell("Language set to: %s", lang)
+}
+
+// Sends an action message to all users
+func (u *User) emote(action string) error {
+	if action == "" {
+		return errors.New("nothing to emote. usage: /me <action>")
+	}
+	sendAllMessage(newMessage(u.username, KindAction, action))
+	return nil
+}
+
+// Edits one of the users messages. args are "<id> <text>"
+func (u *User) editMessage(args string) error {
+	idArg, text, _ := strings.Cut(args, " ")
+	id, err := strconv.ParseUint(idArg, 10, 64)
+	if err != nil || text == "" {
+		return errors.New("usage: /edit <id> <text>")
+	}
+	err = EditMessage(id, u.username, text)
+	if err != nil {
+		return err
+	}
+	err = u.tell("Edited message: %s", idArg)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Deletes one of the users messages. args are "<id>"
+func (u *User) deleteMessage(args string) error {
+	id, err := strconv.ParseUint(args, 10, 64)
+	if err != nil {
+		return errors.New("usage: /delete <id>")
+	}
+	err = DeleteMessage(id, u.username)
+	if err != nil {
+		return err
+	}
+	err = u.tell("Deleted message: %s", args)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// Sends a message to everyone in its channel
+func sendChannelMessage(m Message, userList []*User) {
+	m.Time = time.Now().UTC()
+	m = recordMessage(m)
 	for _, user := range userList {
-		user.messageChan <- msgToSend
-	}
-	MessagesSent.mu.Lock()
-	MessagesSent.C++
-	MessagesSent.mu.Unlock()
-	log.Printf("message sent to channel: %s", msgToSend)
-}
-
-// Sends message from http to a specific user
-func HTTPSendUserMessage(msg string, user *User) {
-	msgToSend := time.Now().Format(timeFormat) + "|http|" + msg
-	user.messageChan <- msgToSend
-	MessagesSent.mu.Lock()
-	MessagesSent.C++
-	MessagesSent.mu.Unlock()
-	log.Printf("message sent to pm: %s", msgToSend)
-}
-
-// Sends message from http to a all users
-func HTTPSendAllMessage(msg string) {
-	msgToSend := time.Now().Format(timeFormat) + "|http|" + msg
-	for _, user := range Users {
-		user.messageChan <- msgToSend
-	}
-	MessagesSent.mu.Lock()
-	MessagesSent.C++
-	MessagesSent.mu.Unlock()
-	log.Printf("message sent to all: %s", msgToSend)
+		user.deliver(m)
+	}
+	messagesTotal.Inc(m.Kind, "channel")
+	channelMessages.Inc(m.Channel)
+	log.Printf("%s sent to channel: %s", m.Kind, m)
+	emitEvent(Event{Type: EventMessage, ID: m.ID, Parent: m.Parent, Kind: m.Kind, User: m.From, Channel: m.Channel, Text: m.Text})
+}
+
+// Sends a private message to a specific user
+func sendUserMessage(m Message, user *User) {
+	m.Time = time.Now().UTC()
+	m.To = user.username
+	m = recordMessage(m)
+	user.deliver(m)
+	messagesTotal.Inc(m.Kind, "user")
+	log.Printf("%s sent to pm: %s", m.Kind, m)
+	emitEvent(Event{Type: EventMessage, ID: m.ID, Kind: m.Kind, User: m.From, To: m.To, Text: m.Text})
+}
+
+// Sends a message to all users
+func sendAllMessage(m Message) {
+	m.Time = time.Now().UTC()
+	m = recordMessage(m)
+	for _, user := range onlineUsers() {
+		user.deliver(m)
+	}
+	messagesTotal.Inc(m.Kind, "all")
+	log.Printf("%s sent to all: %s", m.Kind, m)
+	emitEvent(Event{Type: EventMessage, ID: m.ID, Kind: m.Kind, User: m.From, Text: m.Text})
 }
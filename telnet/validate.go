@@ -0,0 +1,103 @@
+package telnet
+
+import (
+	"chatservice/config"
+	"chatservice/names"
+	"sync"
+)
+
+var usernameRules = names.Rules{Reserved: []string{"http"}} // Rules new usernames must follow
+var channelRules = names.Rules{}                            // Rules new channel names must follow
+var rulesMu sync.Mutex                                      // A reload can change the rules while names are checked
+
+// Sets the rules for names from the config. "http" is always reserved for anonymous http messages
+func setNameRules(cfg config.Config) {
+	ascii := cfg.NameCharset == "ascii"
+	rulesMu.Lock()
+	defer rulesMu.Unlock()
+	usernameRules = names.Rules{
+		MinLength: cfg.UsernameMinLength,
+		MaxLength: cfg.UsernameMaxLength,
+		ASCIIOnly: ascii,
+		Reserved:  append([]string{"http"}, cfg.ReservedNames...),
+	}
+	channelRules = names.Rules{
+		MinLength: cfg.ChannelMinLength,
+		MaxLength: cfg.ChannelMaxLength,
+		ASCIIOnly: ascii,
+		Reserved:  cfg.ReservedNames,
+	}
+}
+
+// Checks a new username against the rules, without checking if it is taken
+func CheckUsername(username string) error {
+	rulesMu.Lock()
+	rules := usernameRules
+	rulesMu.Unlock()
+	return rules.Check(username)
+}
+
+// Checks a new channel name against the rules, without checking if it is taken
+func CheckChannelName(channel string) error {
+	rulesMu.Lock()
+	rules := channelRules
+	rulesMu.Unlock()
+	return rules.Check(channel)
+}
+
+// Checks if a username can be used to log in. Registered users can always use their own name,
+// anyone else needs a name that follows the rules and does not look like a taken name
+func ValidUsername(username string) error {
+	if !Registered(username) {
+		err := CheckUsername(username)
+		if err != nil {
+			return err
+		}
+		if registeredLike(username) {
+			return ErrUsernameTaken
+		}
+	}
+	if onlineLike(username) {
+		return ErrUsernameTaken
+	}
+	return nil
+}
+
+// Checks if a name looks like the name of an online user or a registered account,
+// such as a sender name that must not pose as a user
+func NameInUse(username string) bool {
+	return onlineLike(username) || registeredLike(username)
+}
+
+// Checks if an online user has a name that looks like username
+func onlineLike(username string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for name := range Users {
+		if names.Same(name, username) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if a channel can be created with a name
+func ValidChannelName(channel string) error {
+	err := CheckChannelName(channel)
+	if err != nil {
+		return err
+	}
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	return channelTaken(channel)
+}
+
+// Returns ErrChannelExists if there is a channel that looks like the name. stateMu must be held
+func channelTaken(channel string) error {
+	for name := range Channels {
+		if names.Same(name, channel) {
+			return ErrChannelExists
+		}
+	}
+	return nil
+}
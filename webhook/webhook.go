@@ -0,0 +1,309 @@
+package webhook
+
+import (
+	"bytes"
+	"chatservice/metrics"
+	"chatservice/telnet"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Event types that can be sent to webhooks
+var Events = []string{telnet.EventMessage, telnet.EventJoin, telnet.EventLeave, telnet.EventCreate}
+
+const (
+	queueSize   = 256 // Deliveries buffered per webhook before events are dropped
+	maxAttempts = 5   // Tries per delivery before giving up
+)
+
+var minBackoff = time.Second      // Wait before the first retry of a failed delivery
+var maxBackoff = 30 * time.Second // Longest wait between retries
+var timeout = 10 * time.Second    // Longest a single request may take
+
+// Metrics for /metrics
+var (
+	queueDepth    = metrics.NewGauge("chat_webhook_queue_depth", "Deliveries waiting for each webhook", "webhook")
+	eventsDropped = metrics.NewCounter("chat_webhook_events_dropped_total", "Events dropped because a webhook was too far behind", "webhook")
+	attemptsTotal = metrics.NewCounter("chat_webhook_attempts_total", "Delivery attempts, by webhook and result", "webhook", "result")
+)
+
+// Config for a single webhook as read from the webhook file
+type Config struct {
+	Name     string   `json:"name"`
+	URL      string   `json:"url"`
+	Secret   string   `json:"secret"`   // Signs each request in X-Chat-Signature. Empty sends no signature
+	Events   []string `json:"events"`   // Event types to send, empty means all
+	Channels []string `json:"channels"` // Only send events from these channels, empty means any
+	Keywords []string `json:"keywords"` // Only send messages containing one of these, empty means any
+}
+
+// An event waiting to be posted
+type delivery struct {
+	id    string
+	event telnet.Event
+}
+
+// A webhook and the deliveries queued for it
+type Hook struct {
+	cfg   Config
+	queue chan delivery
+	stop  chan bool
+	done  chan bool
+}
+
+// Manages all configured webhooks
+type Host struct {
+	hooks       []*Hook
+	unsubscribe func()
+	client      *http.Client
+	ctx         context.Context
+	cancel      context.CancelFunc
+	logFile     string // File deliveries are recorded to. Empty records them to the main log
+	logMu       sync.Mutex
+}
+
+// Reads the webhook file. It is a json list of webhook configs
+func LoadConfig(filepath string) ([]Config, error) {
+	contents, err := os.ReadFile(filepath)
+	if err != nil {
+		return nil, err
+	}
+	var cfgs []Config
+	err = json.Unmarshal(contents, &cfgs)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cfgs {
+		if c.Name == "" {
+			return nil, errors.New("webhook name missing")
+		}
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, errors.New("webhook url must be an http or https url for: " + c.Name)
+		}
+		for _, e := range c.Events {
+			if !contains(Events, e) {
+				return nil, errors.New("unknown webhook event: " + e + ". events are " + strings.Join(Events, ", "))
+			}
+		}
+	}
+	return cfgs, nil
+}
+
+// Starts delivering server events to the webhooks. Deliveries are recorded to logFile
+func Start(cfgs []Config, logFile string) *Host {
+	h := &Host{client: &http.Client{Timeout: timeout}, logFile: logFile}
+	h.ctx, h.cancel = context.WithCancel(context.Background())
+	for _, c := range cfgs {
+		hook := &Hook{
+			cfg:   c,
+			queue: make(chan delivery, queueSize),
+			stop:  make(chan bool),
+			done:  make(chan bool),
+		}
+		h.hooks = append(h.hooks, hook)
+		go h.run(hook)
+	}
+	h.unsubscribe = telnet.Subscribe(h.dispatch)
+	log.Printf("started %d webhooks", len(h.hooks))
+	return h
+}
+
+// Stops all webhooks, dropping deliveries that have not been made
+func (h *Host) Stop() {
+	h.unsubscribe()
+	h.cancel()
+	for _, hook := range h.hooks {
+		close(hook.stop)
+	}
+	for _, hook := range h.hooks {
+		<-hook.done
+	}
+}
+
+// Queues an event for every webhook that wants it. Drops the event if a webhook is too far behind
+func (h *Host) dispatch(e telnet.Event) {
+	for _, hook := range h.hooks {
+		if !hook.wants(e) {
+			continue
+		}
+		select {
+		case hook.queue <- delivery{id: deliveryID(), event: e}:
+		default:
+			eventsDropped.Inc(hook.cfg.Name)
+			log.Printf("webhook: %s queue full, dropping %s event", hook.cfg.Name, e.Type)
+		}
+		queueDepth.Set(float64(len(hook.queue)), hook.cfg.Name)
+	}
+}
+
+// Checks if an event passes the webhook's filters. Private messages are never sent
+func (hook *Hook) wants(e telnet.Event) bool {
+	if !contains(Events, e.Type) {
+		return false
+	}
+	if len(hook.cfg.Events) > 0 && !contains(hook.cfg.Events, e.Type) {
+		return false
+	}
+	if e.Type == telnet.EventMessage && e.To != "" {
+		return false
+	}
+	if len(hook.cfg.Channels) > 0 && !contains(hook.cfg.Channels, e.Channel) {
+		return false
+	}
+	if e.Type == telnet.EventMessage && len(hook.cfg.Keywords) > 0 {
+		text := strings.ToLower(e.Text)
+		for _, k := range hook.cfg.Keywords {
+			if strings.Contains(text, strings.ToLower(k)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// Posts queued deliveries one at a time until the webhook is stopped
+func (h *Host) run(hook *Hook) {
+	defer close(hook.done)
+	for {
+		select {
+		case <-hook.stop:
+			return
+		case d := <-hook.queue:
+			queueDepth.Set(float64(len(hook.queue)), hook.cfg.Name)
+			h.deliver(hook, d)
+		}
+	}
+}
+
+// Posts an event, retrying with backoff when the request fails or the receiver has
+// a server error. Other responses are not retried
+func (h *Host) deliver(hook *Hook, d delivery) {
+	body, err := json.Marshal(d.event)
+	if err != nil {
+		log.Printf("webhook: %s unable to encode event. err: %s", hook.cfg.Name, err)
+		return
+	}
+	backoff := minBackoff
+	for attempt := 1; ; attempt++ {
+		status, err := h.post(hook, d, body)
+		ok := err == nil && status >= 200 && status < 300
+		retry := !ok && attempt < maxAttempts && (err != nil || status >= 500 || status == http.StatusTooManyRequests)
+		result := "ok"
+		switch {
+		case err != nil:
+			result = "error: " + err.Error()
+		case !ok:
+			result = "status " + strconv.Itoa(status)
+		}
+		if retry {
+			result += ". retrying in " + backoff.String()
+		} else if !ok {
+			result += ". giving up"
+		}
+		h.record(hook, d, attempt, status, result)
+		switch {
+		case ok:
+			attemptsTotal.Inc(hook.cfg.Name, "ok")
+		case retry:
+			attemptsTotal.Inc(hook.cfg.Name, "retry")
+		default:
+			attemptsTotal.Inc(hook.cfg.Name, "failed")
+		}
+		if !retry {
+			return
+		}
+		select {
+		case <-hook.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Makes a single request and returns its status code
+func (h *Host) post(hook *Hook, d delivery, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(h.ctx, http.MethodPost, hook.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "chatservice-webhook")
+	req.Header.Set("X-Chat-Event", d.event.Type)
+	req.Header.Set("X-Chat-Delivery", d.id)
+	if hook.cfg.Secret != "" {
+		req.Header.Set("X-Chat-Signature", Sign(hook.cfg.Secret, body))
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// Returns the X-Chat-Signature header for a body, "sha256=" and the hex HMAC-SHA256
+// of the body keyed with the secret. Receivers compute the same to check requests
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Appends a line describing a delivery attempt to the delivery log
+func (h *Host) record(hook *Hook, d delivery, attempt int, status int, result string) {
+	line := time.Now().UTC().Format(time.RFC3339) + " webhook=" + hook.cfg.Name + " event=" + d.event.Type +
+		" delivery=" + d.id + " attempt=" + strconv.Itoa(attempt) + " status=" + strconv.Itoa(status) +
+		" result=" + strconv.Quote(result) + "\n"
+	h.logMu.Lock()
+	defer h.logMu.Unlock()
+	if h.logFile == "" {
+		log.Printf("webhook delivery: %s", strings.TrimSpace(line))
+		return
+	}
+	f, err := os.OpenFile(h.logFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		log.Printf("unable to open webhook log. err: %s. delivery: %s", err, line)
+		return
+	}
+	defer f.Close()
+	_, err = f.WriteString(line)
+	if err != nil {
+		log.Printf("unable to write webhook log. err: %s. delivery: %s", err, line)
+	}
+}
+
+// Returns a random id that receivers can use to spot repeated deliveries
+func deliveryID() string {
+	id := make([]byte, 8)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Checks if a list has a value
+func contains(list []string, value string) bool {
+	for _, v := range list {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,174 @@
+package webhook
+
+import (
+	"chatservice/telnet"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A request received by the test receiver
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+// Starts a receiver that answers with the given status codes in turn, then 200
+func receiver(t *testing.T, statuses ...int) (*httptest.Server, chan received) {
+	requests := make(chan received, 10)
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- received{header: r.Header, body: body}
+		mu.Lock()
+		defer mu.Unlock()
+		if len(statuses) > 0 {
+			w.WriteHeader(statuses[0])
+			statuses = statuses[1:]
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// Waits for the next request to the receiver
+func next(t *testing.T, requests chan received) received {
+	select {
+	case r := <-requests:
+		return r
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not called")
+	}
+	return received{}
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.json")
+	tests := []struct {
+		name     string
+		contents string
+		err      string
+	}{
+		{"valid", `[{"name":"ci","url":"https://ci.example.com/hook","events":["message","join"]}]`, ""},
+		{"missing name", `[{"url":"https://ci.example.com/hook"}]`, "webhook name missing"},
+		{"bad url", `[{"name":"ci","url":"ci.example.com"}]`, "webhook url must be an http or https url for: ci"},
+		{"unknown event", `[{"name":"ci","url":"http://ci","events":["topic"]}]`, "unknown webhook event: topic. events are message, join, leave, create"},
+	}
+	for _, tt := range tests {
+		require.NoError(t, os.WriteFile(path, []byte(tt.contents), 0666))
+		cfgs, err := LoadConfig(path)
+		if tt.err == "" {
+			assert.NoError(t, err, tt.name)
+			assert.Len(t, cfgs, 1, tt.name)
+		} else {
+			assert.EqualError(t, err, tt.err, tt.name)
+		}
+	}
+}
+
+func TestWants(t *testing.T) {
+	hook := &Hook{cfg: Config{Events: []string{telnet.EventMessage, telnet.EventJoin}, Channels: []string{"ops"}, Keywords: []string{"Deploy"}}}
+	tests := []struct {
+		name  string
+		event telnet.Event
+		want  bool
+	}{
+		{"matching message", telnet.Event{Type: telnet.EventMessage, Channel: "ops", Text: "deploy done"}, true},
+		{"no keyword", telnet.Event{Type: telnet.EventMessage, Channel: "ops", Text: "hello"}, false},
+		{"other channel", telnet.Event{Type: telnet.EventMessage, Channel: "random", Text: "deploy done"}, false},
+		{"private message", telnet.Event{Type: telnet.EventMessage, To: "ops", Text: "deploy done"}, false},
+		{"join", telnet.Event{Type: telnet.EventJoin, Channel: "ops"}, true},
+		{"not subscribed", telnet.Event{Type: telnet.EventLeave, Channel: "ops"}, false},
+		{"not supported", telnet.Event{Type: telnet.EventTopic, Channel: "ops"}, false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, hook.wants(tt.event), tt.name)
+	}
+	all := &Hook{}
+	assert.True(t, all.wants(telnet.Event{Type: telnet.EventMessage, Text: "hi"}))
+	assert.True(t, all.wants(telnet.Event{Type: telnet.EventCreate, Channel: "new"}))
+	assert.False(t, all.wants(telnet.Event{Type: telnet.EventConnect}))
+}
+
+func TestDelivery(t *testing.T) {
+	server, requests := receiver(t)
+	host := Start([]Config{{Name: "ci", URL: server.URL, Secret: "hush", Channels: []string{"hooked"}, Keywords: []string{"deploy"}}}, "")
+	defer host.Stop()
+
+	require.NoError(t, telnet.CreateChannel("hooked", "tester"))
+	r := next(t, requests)
+	assert.Equal(t, "application/json", r.header.Get("Content-Type"))
+	assert.Equal(t, telnet.EventCreate, r.header.Get("X-Chat-Event"))
+	assert.NotEmpty(t, r.header.Get("X-Chat-Delivery"))
+	assert.Equal(t, Sign("hush", r.body), r.header.Get("X-Chat-Signature"))
+	var e telnet.Event
+	require.NoError(t, json.Unmarshal(r.body, &e))
+	assert.Equal(t, telnet.Event{Type: telnet.EventCreate, Time: e.Time, User: "tester", Channel: "hooked"}, e)
+
+	//Only messages with a keyword are sent
+	require.NoError(t, telnet.SendAs("tester", "hooked", "", "hello"))
+	require.NoError(t, telnet.SendAs("tester", "hooked", "", "Deploy finished"))
+	r = next(t, requests)
+	require.NoError(t, json.Unmarshal(r.body, &e))
+	assert.Equal(t, "Deploy finished", e.Text)
+	assert.Equal(t, "hooked", e.Channel)
+	assert.Equal(t, Sign("hush", r.body), r.header.Get("X-Chat-Signature"))
+	select {
+	case r := <-requests:
+		t.Error("unexpected delivery: " + string(r.body))
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestRetries(t *testing.T) {
+	defer func(d time.Duration) { minBackoff = d }(minBackoff)
+	minBackoff = 10 * time.Millisecond
+	logFile := filepath.Join(t.TempDir(), "webhooks.log")
+	server, requests := receiver(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK, http.StatusBadRequest)
+	host := Start([]Config{{Name: "flaky", URL: server.URL, Events: []string{telnet.EventCreate}}}, logFile)
+	defer host.Stop()
+
+	//Server errors are retried with the same delivery id
+	require.NoError(t, telnet.CreateChannel("retried", "tester"))
+	first := next(t, requests)
+	assert.Empty(t, first.header.Get("X-Chat-Signature"))
+	id := first.header.Get("X-Chat-Delivery")
+	assert.Equal(t, id, next(t, requests).header.Get("X-Chat-Delivery"))
+	assert.Equal(t, id, next(t, requests).header.Get("X-Chat-Delivery"))
+
+	//Client errors are not
+	require.NoError(t, telnet.CreateChannel("refused", "tester"))
+	next(t, requests)
+	select {
+	case <-requests:
+		t.Error("refused delivery was retried")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	assert.Equal(t, 2.0, attemptsTotal.Value("flaky", "retry"))
+	assert.Equal(t, 1.0, attemptsTotal.Value("flaky", "ok"))
+	assert.Equal(t, 1.0, attemptsTotal.Value("flaky", "failed"))
+
+	contents, err := os.ReadFile(logFile)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+	require.Len(t, lines, 4)
+	for i, want := range []string{
+		"webhook=flaky event=create delivery=" + id + ` attempt=1 status=503 result="status 503. retrying in 10ms"`,
+		"webhook=flaky event=create delivery=" + id + ` attempt=2 status=502 result="status 502. retrying in 20ms"`,
+		"webhook=flaky event=create delivery=" + id + ` attempt=3 status=200 result="ok"`,
+		`attempt=1 status=400 result="status 400. giving up"`,
+	} {
+		assert.Contains(t, lines[i], want)
+	}
+}
@@ -0,0 +1,330 @@
+package websocket
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Frame opcodes from RFC 6455
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xA
+)
+
+// Close codes from RFC 6455
+const (
+	CloseNormal      = 1000
+	CloseGoingAway   = 1001
+	CloseProtocol    = 1002
+	CloseInvalidData = 1007
+	CloseTooBig      = 1009
+)
+
+const closeNoStatus = 1005 // Received when the peer sent no code. Never sent
+const maxControlPayload = 125
+const handshakeGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11" // Appended to the client key to make the accept key
+
+var MaxMessageSize = 64 * 1024 // Largest message accepted from a client. Bigger ones close the connection
+
+var (
+	ErrNotWebSocket = errors.New("not a websocket handshake")
+	ErrBadVersion   = errors.New("unsupported websocket version")
+	ErrBadOrigin    = errors.New("websocket origin not allowed")
+	errProtocol     = errors.New("websocket protocol error")
+	errTooBig       = errors.New("websocket message too big")
+	errInvalidUTF8  = errors.New("websocket text message is not valid utf-8")
+)
+
+// A server side WebSocket connection
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	writeMu   sync.Mutex
+	closeOnce sync.Once
+}
+
+// Completes the opening handshake of a WebSocket request and takes over its connection
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != http.MethodGet || !headerHas(r.Header, "Connection", "upgrade") ||
+		!headerHas(r.Header, "Upgrade", "websocket") {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, ErrBadVersion.Error(), http.StatusUpgradeRequired)
+		return nil, ErrBadVersion
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		http.Error(w, ErrNotWebSocket.Error(), http.StatusBadRequest)
+		return nil, ErrNotWebSocket
+	}
+	if !sameOrigin(r) {
+		http.Error(w, ErrBadOrigin.Error(), http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket is not supported", http.StatusInternalServerError)
+		return nil, errors.New("response can not be hijacked")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + AcceptKey(key) + "\r\n\r\n"
+	_, err = conn.Write([]byte(response))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Conn{conn: conn, reader: rw.Reader}, nil
+}
+
+// Checks that a browser opened the request from a page on the same host, so other sites
+// can not use a visitor's credentials. Clients that are not browsers send no Origin
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// Returns the Sec-WebSocket-Accept value for a Sec-WebSocket-Key
+func AcceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + handshakeGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Checks if a comma separated header contains a token, ignoring case
+func headerHas(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reads the next text or binary message, joining fragments. Pings are answered and pongs
+// skipped. Returns io.EOF once the client closes the connection
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	var opcode int
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, c.fail(err)
+		}
+		switch op {
+		case OpPing:
+			err = c.writeFrame(OpPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case OpPong:
+			continue
+		case OpClose:
+			code := closeNoStatus
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			if code == closeNoStatus {
+				code = CloseNormal
+			}
+			c.CloseWith(code, "")
+			return 0, nil, io.EOF
+		case OpText, OpBinary:
+			if opcode != 0 {
+				return 0, nil, c.fail(errProtocol)
+			}
+			opcode = op
+		case OpContinuation:
+			if opcode == 0 {
+				return 0, nil, c.fail(errProtocol)
+			}
+		default:
+			return 0, nil, c.fail(errProtocol)
+		}
+		if len(message)+len(payload) > MaxMessageSize {
+			return 0, nil, c.fail(errTooBig)
+		}
+		message = append(message, payload...)
+		if fin {
+			if opcode == OpText && !utf8.Valid(message) {
+				return 0, nil, c.fail(errInvalidUTF8)
+			}
+			return opcode, message, nil
+		}
+	}
+}
+
+// Reads one frame and unmasks its payload
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	var header [2]byte
+	_, err := io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	fin := header[0]&0x80 != 0
+	op := int(header[0] & 0x0F)
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	//Extensions are never negotiated so the reserved bits must be clear,
+	//and clients must mask every frame they send
+	if header[0]&0x70 != 0 || !masked {
+		return false, 0, nil, errProtocol
+	}
+	switch length {
+	case 126:
+		var ext [2]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		_, err = io.ReadFull(c.reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if err != nil {
+		return false, 0, nil, err
+	}
+	if op >= OpClose && (!fin || length > maxControlPayload) {
+		return false, 0, nil, errProtocol
+	}
+	if length > uint64(MaxMessageSize) {
+		return false, 0, nil, errTooBig
+	}
+	var mask [4]byte
+	_, err = io.ReadFull(c.reader, mask[:])
+	if err != nil {
+		return false, 0, nil, err
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	if err != nil {
+		return false, 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return fin, op, payload, nil
+}
+
+// Closes the connection with the close code matching a read error
+func (c *Conn) fail(err error) error {
+	switch err {
+	case errProtocol:
+		c.CloseWith(CloseProtocol, err.Error())
+	case errTooBig:
+		c.CloseWith(CloseTooBig, err.Error())
+	case errInvalidUTF8:
+		c.CloseWith(CloseInvalidData, err.Error())
+	default:
+		c.conn.Close()
+	}
+	return err
+}
+
+// Sends a text or binary message in a single frame
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	return c.writeFrame(opcode, data)
+}
+
+// Sends a ping. The client answers with a pong
+func (c *Conn) Ping() error {
+	return c.writeFrame(OpPing, nil)
+}
+
+// Writes one unmasked frame
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	frame := []byte{0x80 | byte(opcode)}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	default:
+		frame = append(frame, 127, 0, 0, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint64(frame[2:], uint64(len(payload)))
+	}
+	frame = append(frame, payload...)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Sends a close frame with a code and reason and closes the connection
+func (c *Conn) CloseWith(code int, reason string) error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+		if len(reason) > maxControlPayload-2 {
+			reason = reason[:maxControlPayload-2]
+		}
+		payload = append(payload, reason...)
+		//The connection is closed either way so a failed close frame is not an error
+		c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		c.writeFrame(OpClose, payload)
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// Closes the connection normally
+func (c *Conn) Close() error {
+	return c.CloseWith(CloseNormal, "")
+}
+
+// Returns the address of the client
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// Returns the address of the server
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// Sets the read and write deadlines of the underlying connection
+func (c *Conn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+// Sets the read deadline of the underlying connection
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// Sets the write deadline of the underlying connection
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
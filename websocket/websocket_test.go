@@ -0,0 +1,206 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Opens a websocket to a test server that echoes every message back
+func dialEcho(t *testing.T) (net.Conn, *bufio.Reader) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ws, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		defer ws.Close()
+		for {
+			op, data, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			ws.WriteMessage(op, data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n"))
+	require.NoError(t, err)
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSwitchingProtocols, res.StatusCode)
+	require.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", res.Header.Get("Sec-WebSocket-Accept"))
+	return conn, reader
+}
+
+// Writes a masked client frame
+func writeFrame(t *testing.T, conn net.Conn, first byte, payload []byte, masked bool) {
+	frame := []byte{first}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, byte(len(payload)))
+	default:
+		frame = append(frame, 126, 0, 0)
+		binary.BigEndian.PutUint16(frame[2:], uint16(len(payload)))
+	}
+	if masked {
+		frame[1] |= 0x80
+		mask := []byte{1, 2, 3, 4}
+		frame = append(frame, mask...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := conn.Write(frame)
+	require.NoError(t, err)
+}
+
+// Reads an unmasked server frame
+func readFrame(t *testing.T, reader *bufio.Reader) (byte, []byte) {
+	var header [2]byte
+	_, err := io.ReadFull(reader, header[:])
+	require.NoError(t, err)
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		_, err = io.ReadFull(reader, ext[:])
+		require.NoError(t, err)
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(reader, payload)
+	require.NoError(t, err)
+	return header[0], payload
+}
+
+func TestAcceptKey(t *testing.T) {
+	//Example from RFC 6455 section 1.3
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", AcceptKey("dGhlIHNhbXBsZSBub25jZQ=="))
+}
+
+func TestUpgradeRejected(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{"plain request", http.MethodGet, map[string]string{}, http.StatusBadRequest},
+		{"post", http.MethodPost, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, http.StatusBadRequest},
+		{"old version", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"bad key", http.MethodGet, map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+		{"other origin", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Origin": "https://evil.example"}, http.StatusForbidden},
+		{"opaque origin", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Origin": "null"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/", nil)
+		for k, v := range tt.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		_, err := Upgrade(w, req)
+		assert.Error(t, err, tt.name)
+		assert.Equal(t, tt.status, w.Code, tt.name)
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://chat.example:8080", true},
+		{"https://CHAT.example:8080", true},
+		{"http://chat.example", false},
+		{"http://evil.example:8080", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "http://chat.example:8080/", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		assert.Equal(t, tt.want, sameOrigin(req), tt.origin)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	conn, reader := dialEcho(t)
+
+	writeFrame(t, conn, 0x80|OpText, []byte("hello"), true)
+	first, payload := readFrame(t, reader)
+	assert.Equal(t, byte(0x80|OpText), first)
+	assert.Equal(t, "hello", string(payload))
+
+	//Fragments with a ping in the middle are joined
+	writeFrame(t, conn, OpText, []byte("frag"), true)
+	writeFrame(t, conn, 0x80|OpPing, []byte("hi"), true)
+	writeFrame(t, conn, 0x80|OpContinuation, []byte("mented"), true)
+	first, payload = readFrame(t, reader)
+	assert.Equal(t, byte(0x80|OpPong), first)
+	assert.Equal(t, "hi", string(payload))
+	_, payload = readFrame(t, reader)
+	assert.Equal(t, "fragmented", string(payload))
+
+	//Medium length messages use the 16 bit length
+	long := strings.Repeat("a", 300)
+	writeFrame(t, conn, 0x80|OpText, []byte(long), true)
+	_, payload = readFrame(t, reader)
+	assert.Equal(t, long, string(payload))
+
+	//Closing is answered with a close frame
+	writeFrame(t, conn, 0x80|OpClose, []byte{0x03, 0xE8}, true)
+	first, payload = readFrame(t, reader)
+	assert.Equal(t, byte(0x80|OpClose), first)
+	assert.Equal(t, CloseNormal, int(binary.BigEndian.Uint16(payload)))
+}
+
+func TestProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		first   byte
+		payload []byte
+		masked  bool
+		code    int
+	}{
+		{"unmasked", 0x80 | OpText, []byte("hi"), false, CloseProtocol},
+		{"reserved bits", 0xC0 | OpText, []byte("hi"), true, CloseProtocol},
+		{"unknown opcode", 0x80 | 0x3, []byte("hi"), true, CloseProtocol},
+		{"stray continuation", 0x80 | OpContinuation, []byte("hi"), true, CloseProtocol},
+		{"fragmented ping", OpPing, []byte("hi"), true, CloseProtocol},
+		{"invalid utf-8", 0x80 | OpText, []byte{0xff, 0xfe}, true, CloseInvalidData},
+	}
+	for _, tt := range tests {
+		conn, reader := dialEcho(t)
+		writeFrame(t, conn, tt.first, tt.payload, tt.masked)
+		first, payload := readFrame(t, reader)
+		assert.Equal(t, byte(0x80|OpClose), first, tt.name)
+		require.GreaterOrEqual(t, len(payload), 2, tt.name)
+		assert.Equal(t, tt.code, int(binary.BigEndian.Uint16(payload)), tt.name)
+	}
+}
+
+func TestMessageTooBig(t *testing.T) {
+	defer func(size int) { MaxMessageSize = size }(MaxMessageSize)
+	MaxMessageSize = 200
+	conn, reader := dialEcho(t)
+	writeFrame(t, conn, 0x80|OpText, []byte(strings.Repeat("a", 300)), true)
+	first, payload := readFrame(t, reader)
+	assert.Equal(t, byte(0x80|OpClose), first)
+	assert.Equal(t, CloseTooBig, int(binary.BigEndian.Uint16(payload)))
+}